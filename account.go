@@ -0,0 +1,603 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// verifyTTL is how long the link in a confirmation email stays valid
+const verifyTTL = 48 * time.Hour
+
+// resetTTL is how long a password reset link stays valid
+const resetTTL = time.Hour
+
+// registrations limits how many accounts one address can create per hour
+var registrations = newRateLimiter(5, time.Hour)
+
+// resetRequests limits how many reset mails one address can ask for per hour
+var resetRequests = newRateLimiter(5, time.Hour)
+
+// resetMails limits how many reset mails go to one email address per hour,
+// whichever addresses they are asked for from
+var resetMails = newRateLimiter(3, time.Hour)
+
+// mailer delivers the mail sent by the site, see setupMail
+var mailer dnews.Mailer
+
+// setupMail picks the mailer from the -smtp and -maildir flags. Without
+// either, mail only goes to the log.
+func setupMail() {
+	switch {
+	case smtpAddr != "":
+		mailer = &dnews.SMTPMailer{Addr: smtpAddr, User: smtpUser, Pass: smtpPass}
+	case mailDir != "":
+		mailer = &dnews.FileMailer{Dir: mailDir}
+	default:
+		mailer = dnews.LogMailer{}
+	}
+}
+
+// siteURL returns the absolute URL of path on this site, for use in mail
+func siteURL(path string, query url.Values) string {
+	u := strings.TrimRight(baseURL, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// sendVerification mails u a link that confirms their address
+func sendVerification(u *dnews.User) error {
+	token, err := signToken(tokenVerify, u.ID, verifyTTL)
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(mailFrom, &dnews.Message{
+		To:      u.Email,
+		Subject: "Confirm your Daemon.News account",
+		Body: fmt.Sprintf(`Hello %s,
+
+Someone, hopefully you, created the account %q on Daemon.News with this
+address. To confirm it, open this link within %d hours:
+
+%s
+
+If this was not you, ignore this mail and the account stays inactive.
+`, u.FName, u.User, int(verifyTTL.Hours()), siteURL("/register/verify", url.Values{"token": {token}})),
+	})
+}
+
+// sendTaken tells u that someone tried to register with their user name or
+// address. The visitor is shown the same page as for a new account, so the
+// form does not give away who has one.
+func sendTaken(u *dnews.User) error {
+	return mailer.Send(mailFrom, &dnews.Message{
+		To:      u.Email,
+		Subject: "Your Daemon.News account",
+		Body: fmt.Sprintf(`Hello %s,
+
+Someone, hopefully you, tried to register a new account on Daemon.News with
+your user name or this address. You already have the account %q.
+
+If you forgot its password, you can pick a new one here:
+
+%s
+
+If this was not you, ignore this mail and nothing changes.
+`, u.FName, u.User, siteURL("/password/forgot", nil)),
+	})
+}
+
+// sendReset mails u a link to pick a new password
+func sendReset(u *dnews.User, token string) error {
+	return mailer.Send(mailFrom, &dnews.Message{
+		To:      u.Email,
+		Subject: "Reset your Daemon.News password",
+		Body: fmt.Sprintf(`Hello %s,
+
+Someone, hopefully you, asked to reset the password of the account %q on
+Daemon.News. To pick a new one, open this link within %d minutes:
+
+%s
+
+If this was not you, ignore this mail and nothing changes.
+`, u.FName, u.User, int(resetTTL.Minutes()), siteURL("/password/reset", url.Values{"token": {token}})),
+	})
+}
+
+// checkSessions reloads the logged in user from the database, so handlers
+// see the current admin flag and names. Sessions whose account was disabled,
+// removed or had its password changed since they logged in are ended.
+func checkSessions(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u := sessionUser(r); u != nil {
+			session, err := store.Get(r, "session-name")
+			if err != nil {
+				errorPage(w, r, err)
+				return
+			}
+			ctx, cancel := dbContext(r)
+			fresh, err := dnews.GetUserContext(ctx, db, u.ID)
+			cancel()
+			switch {
+			case err == nil && !fresh.Disabled && fresh.PassChanged.Equal(u.PassChanged):
+				// The session is cached for the request, later lookups
+				// get the fresh copy without it being saved.
+				fresh.Authed = true
+				session.Values["user"] = fresh
+			case err == nil || dnews.KindOf(err) == dnews.NotFound:
+				delete(session.Values, "user")
+				session.Options = &sessions.Options{MaxAge: -1}
+				session.Save(r, w)
+				reqLog(r).WithField("user_id", u.ID).Info("session ended")
+			default:
+				errorPage(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// passwordForm is the data for the password templates. Done is set once the
+// action went through.
+type passwordForm struct {
+	Token string
+	Done  bool
+}
+
+// sessionsPage is the data for sessions.html. Admin is set when an
+// administrator looks at someone's sessions.
+type sessionsPage struct {
+	Owner    *dnews.User
+	Sessions dnews.Sessions
+	Current  string
+	Admin    bool
+}
+
+// tokensPage is the data for tokens.html. New holds a token that was just
+// created, it is only ever shown this once.
+type tokensPage struct {
+	Tokens dnews.APITokens
+	Scopes []string
+	New    string
+}
+
+// tokenExpiry reads the days form value, an empty one means the token
+// does not expire
+func tokenExpiry(r *http.Request) (time.Time, error) {
+	v := r.FormValue("days")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	days, err := strconv.Atoi(v)
+	if err != nil || days < 1 {
+		return time.Time{}, dnews.NewError(dnews.Invalid, err, "%q is not a number of days", v)
+	}
+	return time.Now().AddDate(0, 0, days), nil
+}
+
+// currentSessionID returns the ID of the session of r, as listed by
+// GetUserSessions
+func currentSessionID(r *http.Request) string {
+	session, err := store.Get(r, "session-name")
+	if err != nil || session.ID == "" {
+		return ""
+	}
+	return dnews.SessionID(session.ID)
+}
+
+func registerAccount(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		renderTemplate(w, r, data, "register.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		var u dnews.User
+		u.User = r.FormValue("username")
+		u.FName = r.FormValue("fname")
+		u.LName = r.FormValue("lname")
+		u.Email = r.FormValue("email")
+		u.Pass = r.FormValue("passwd")
+
+		if err := u.Validate(); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if err := dnews.CheckPassword(&u, u.Pass); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if u.Pass != r.FormValue("confirm") {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "The passwords do not match"))
+			return
+		}
+
+		ip := clientIP(r)
+		if !registrations.Allow(ip) {
+			errorPage(w, r, dnews.NewError(dnews.Limited, nil, "Too many accounts were created from your address, please try again later"))
+			return
+		}
+
+		id, err := dnews.RegisterUserContext(ctx, db, u)
+		switch {
+		case err == nil:
+			u.ID = *id
+			l := reqLog(r).WithField("user_id", u.ID).WithField("ip", ip)
+			l.Info("user registered")
+
+			if err := sendVerification(&u); err != nil {
+				// The account exists, an admin can confirm it by hand.
+				l.WithError(err).Error("sending confirmation mail")
+			}
+		case err == dnews.ErrTaken:
+			// Answer as for a new account and let the owners know instead.
+			owners, err := dnews.GetUsersByNameOrEmailContext(ctx, db, u.User, u.Email)
+			if err != nil {
+				errorPage(w, r, err)
+				return
+			}
+			for _, o := range owners {
+				l := reqLog(r).WithField("user_id", o.ID).WithField("ip", ip)
+				l.Info("registration for a taken user name or address")
+				if err := sendTaken(o); err != nil {
+					l.WithError(err).Error("sending account notice mail")
+				}
+			}
+		default:
+			errorPage(w, r, err)
+			return
+		}
+		u.Pass = ""
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = &u
+		renderTemplate(w, r, data, "register.html")
+	}).Methods("POST")
+
+	router.HandleFunc("/register/verify", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id, err := verifyToken(tokenVerify, r.FormValue("token"))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		if err := dnews.SetUserVerifiedContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		reqLog(r).WithField("user_id", id).Info("user confirmed email")
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		renderTemplate(w, r, data, "verified.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = passwordForm{}
+		renderTemplate(w, r, data, "password_forgot.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/password/forgot", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		ip := clientIP(r)
+		if !resetRequests.Allow(ip) {
+			errorPage(w, r, dnews.NewError(dnews.Limited, nil, "Too many password resets were requested from your address, please try again later"))
+			return
+		}
+
+		// Visitors always get the same answer, so this can not be used to
+		// find out who has an account.
+		email := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+		if !resetMails.Allow(email) {
+			reqLog(r).WithField("ip", ip).Warn("too many password resets for one address")
+		} else {
+			u, token, err := dnews.CreatePasswordResetContext(ctx, db, email, resetTTL)
+			switch {
+			case err == nil:
+				reqLog(r).WithField("user_id", u.ID).WithField("ip", ip).Info("password reset requested")
+				if err := sendReset(u, token); err != nil {
+					reqLog(r).WithError(err).Error("sending password reset mail")
+				}
+			case dnews.KindOf(err) == dnews.NotFound:
+				reqLog(r).WithField("ip", ip).Info("password reset for unknown address")
+			default:
+				errorPage(w, r, err)
+				return
+			}
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = passwordForm{Done: true}
+		renderTemplate(w, r, data, "password_forgot.html")
+	}).Methods("POST")
+
+	router.HandleFunc("/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		token := r.FormValue("token")
+		if _, err := dnews.GetPasswordResetContext(ctx, db, token); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = passwordForm{Token: token}
+		renderTemplate(w, r, data, "password_reset.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/password/reset", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		pass := r.FormValue("passwd")
+		if pass != r.FormValue("confirm") {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "The passwords do not match"))
+			return
+		}
+
+		u, err := dnews.ResetPasswordContext(ctx, db, r.FormValue("token"), pass)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		reqLog(r).WithField("user_id", u.ID).Info("password reset")
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = passwordForm{Done: true}
+		renderTemplate(w, r, data, "password_reset.html")
+	}).Methods("POST")
+
+	router.HandleFunc("/password", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireUser(w, r); !ok {
+			return
+		}
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = passwordForm{}
+		renderTemplate(w, r, data, "password_change.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/password", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		current, err := dnews.AuthContext(ctx, db, u.User, r.FormValue("current"))
+		if err == dnews.ErrLockedOut {
+			errorPage(w, r, err)
+			return
+		}
+		if err != nil || !current.Authed {
+			errorPage(w, r, dnews.NewError(dnews.Forbidden, err, "Your current password is not right"))
+			return
+		}
+
+		pass := r.FormValue("passwd")
+		if err := dnews.CheckPassword(u, pass); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if pass != r.FormValue("confirm") {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "The passwords do not match"))
+			return
+		}
+
+		if err := dnews.SetUserPasswordContext(ctx, db, u.ID, pass); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		// Every other session of the user ends, keep this one going.
+		fresh, err := dnews.GetUserContext(ctx, db, u.ID)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		u.PassChanged = fresh.PassChanged
+		session.Values["user"] = u
+		session.Save(r, w)
+		reqLog(r).WithField("user_id", u.ID).Info("password changed")
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = passwordForm{Done: true}
+		renderTemplate(w, r, data, "password_change.html")
+	}).Methods("POST")
+
+	router.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		ss, err := dnews.GetUserSessionsContext(ctx, db, u.ID)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = sessionsPage{Owner: u, Sessions: ss, Current: currentSessionID(r)}
+		renderTemplate(w, r, data, "sessions.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/sessions/end", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		if err := dnews.EndSessionContext(ctx, db, u.ID, r.FormValue("session")); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", u.ID).Info("session ended by user")
+		http.Redirect(w, r, "/sessions", http.StatusFound)
+	}).Methods("POST")
+
+	router.HandleFunc("/logout/all", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		n, err := dnews.EndUserSessionsContext(ctx, db, u.ID)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		session.Options = &sessions.Options{MaxAge: -1}
+		session.Save(r, w)
+
+		reqLog(r).WithField("user_id", u.ID).WithField("sessions", n).Info("logged out everywhere")
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).Methods("POST")
+
+	showTokens := func(w http.ResponseWriter, r *http.Request, u *dnews.User, token string) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		ts, err := dnews.GetAPITokensContext(ctx, db, u.ID)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = tokensPage{Tokens: ts, Scopes: dnews.Scopes, New: token}
+		renderTemplate(w, r, data, "tokens.html")
+	}
+
+	router.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requirePerm(w, r, dnews.PermWriteArticles)
+		if !ok {
+			return
+		}
+		showTokens(w, r, u, "")
+	}).Methods("GET")
+
+	router.HandleFunc("/tokens", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requirePerm(w, r, dnews.PermWriteArticles)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		expires, err := tokenExpiry(r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		r.ParseForm()
+		token, t, err := dnews.CreateAPITokenContext(ctx, db, u.ID, r.FormValue("name"), r.Form["scope"], expires)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", u.ID).WithField("token_id", t.ID).WithField("scopes", t.Scopes).Info("API token created")
+		showTokens(w, r, u, token)
+	}).Methods("POST")
+
+	router.HandleFunc("/tokens/revoke/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.RevokeAPITokenContext(ctx, db, u.ID, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", u.ID).WithField("token_id", id).Info("API token revoked")
+		http.Redirect(w, r, "/tokens", http.StatusFound)
+	}).Methods("POST")
+}
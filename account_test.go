@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+func TestPasswordResetOnce(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+
+	// password_resets, hash to user id
+	resets := map[string]int64{}
+	user := []driver.Value{int64(1), "Ed", "Itor", "editor@example.org", "editor"}
+	f.rows("from users where lower(email)", user)
+	f.on("insert into password_resets", func(args []driver.Value) (fakeResult, error) {
+		resets[args[1].(string)] = args[0].(int64)
+		return fakeResult{affected: 1}, nil
+	})
+	f.on("delete from password_resets", func(args []driver.Value) (fakeResult, error) {
+		for h, id := range resets {
+			if id == args[0] {
+				delete(resets, h)
+			}
+		}
+		return fakeResult{}, nil
+	})
+	f.on("from password_resets", func(args []driver.Value) (fakeResult, error) {
+		if _, ok := resets[args[0].(string)]; !ok {
+			return fakeResult{}, nil
+		}
+		return fakeResult{rows: [][]driver.Value{user}}, nil
+	})
+	f.rows("update users set hash")
+
+	ctx := context.Background()
+	_, token, err := dnews.CreatePasswordResetContext(ctx, db, "Editor@example.org", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resets[token]; ok || len(resets) != 1 {
+		t.Fatalf("the token is not stored hashed: %v", resets)
+	}
+
+	// A password the policy rejects leaves the token for another try.
+	if _, err := dnews.ResetPasswordContext(ctx, db, token, "short"); dnews.KindOf(err) != dnews.Invalid {
+		t.Fatalf("a short password gave %v", err)
+	}
+	if _, err := dnews.GetPasswordResetContext(ctx, db, token); err != nil {
+		t.Fatalf("the token was used up by a rejected password: %v", err)
+	}
+
+	u, err := dnews.ResetPasswordContext(ctx, db, token, "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 1 {
+		t.Errorf("reset the password of user %d", u.ID)
+	}
+
+	if _, err := dnews.ResetPasswordContext(ctx, db, token, "another horse battery"); dnews.KindOf(err) != dnews.Invalid {
+		t.Errorf("the token worked twice: %v", err)
+	}
+	if _, err := dnews.GetPasswordResetContext(ctx, db, token); dnews.KindOf(err) != dnews.Invalid {
+		t.Errorf("the used token still shows the form: %v", err)
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var apDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "dnews",
+	Name:      "activitypub_deliveries_total",
+	Help:      "Activities delivered to remote inboxes by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(apDeliveries)
+}
+
+// Deliveries are tried apTries times, apRetry apart. The outbox shows the
+// last apOutboxSize articles, inboxes take bodies up to apMaxBody.
+const (
+	apTries      = 3
+	apRetry      = 30 * time.Second
+	apTimeout    = 10 * time.Second
+	apOutboxSize = 20
+	apMaxBody    = 1 << 20
+)
+
+// apInboxRequests limits how many activities one address can send per
+// hour, every one makes the server fetch the key of the sender
+var apInboxRequests = newRateLimiter(600, time.Hour)
+
+// apClient fetches remote actors and delivers to their inboxes. Redirects
+// are not followed, a signed request is only sent where it was meant to,
+// and private addresses are not dialed, key ids come from the sender.
+var apClient = &http.Client{
+	Timeout:   apTimeout,
+	Transport: publicTransport,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// apActorURL is the id of the local actor with the given name
+func apActorURL(name string) string {
+	return siteURL("/ap/actor/"+name, nil)
+}
+
+// apKeyID names the key of the local actor with the given name
+func apKeyID(name string) string {
+	return apActorURL(name) + "#main-key"
+}
+
+// apArticleID is the id of a as an ActivityStreams object
+func apArticleID(a *dnews.Article) string {
+	return siteURL(fmt.Sprintf("/ap/article/%d", a.ID), nil)
+}
+
+// apHost is the domain of the acct: names of the local actors
+func apHost() string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// writeActivity sends v as an ActivityStreams document
+func writeActivity(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", dnews.ActivityContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// findActor checks that there is a local actor with the given name. That
+// is the site itself, apName, or a user who can write articles, who is
+// returned.
+func findActor(ctx context.Context, db *sql.DB, name string) (*dnews.User, error) {
+	if name == apName {
+		return nil, nil
+	}
+	u, err := dnews.GetUserByNameContext(ctx, db, name)
+	if err != nil {
+		return nil, err
+	}
+	if !u.Can(dnews.PermWriteArticles) {
+		return nil, dnews.NewError(dnews.NotFound, nil, "No author named %q", name)
+	}
+	return u, nil
+}
+
+// localActor returns the document describing the local actor with the
+// given name and the user behind it, nil for the site
+func localActor(ctx context.Context, db *sql.DB, name string) (*dnews.APActor, *dnews.User, error) {
+	u, err := findActor(ctx, db, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := dnews.GetActorKeyContext(ctx, db, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := apActorURL(name)
+	doc := &dnews.APActor{
+		Context:           dnews.ActivityContext,
+		ID:                id,
+		Type:              "Service",
+		PreferredUsername: name,
+		Name:              "Daemon.News",
+		Summary:           "*BSD News and Advocacy",
+		URL:               siteURL("/", nil),
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		PublicKey: dnews.APPublicKey{
+			ID:           apKeyID(name),
+			Owner:        id,
+			PublicKeyPem: key.PublicPEM,
+		},
+	}
+	if u != nil {
+		doc.Type = "Person"
+		doc.Name = strings.TrimSpace(u.FName + " " + u.LName)
+		doc.Summary = "Articles by " + doc.Name + " on Daemon.News"
+	}
+	return doc, u, nil
+}
+
+// apArticle returns a as an Article object
+func apArticle(a *dnews.Article) *dnews.APArticle {
+	html := *a
+	html.HTML()
+	published := a.Date
+	author := apActorURL(a.Author.User)
+
+	o := &dnews.APArticle{
+		ID:           apArticleID(a),
+		Type:         "Article",
+		AttributedTo: author,
+		Name:         a.Title,
+		Content:      string(html.Body),
+		MediaType:    "text/html",
+		URL:          articleURL(a),
+		Published:    &published,
+		To:           []string{dnews.ActivityPublic},
+		Cc:           []string{author + "/followers"},
+	}
+	for _, t := range a.Tags {
+		o.Tag = append(o.Tag, dnews.APTag{Type: "Hashtag", Name: "#" + t.Name, Href: siteURL("/tag/"+t.Name, nil)})
+	}
+	return o
+}
+
+// apCreate is the activity of the author of a writing it
+func apCreate(a *dnews.Article) *dnews.APActivity {
+	o := apArticle(a)
+	return &dnews.APActivity{
+		ID:        o.ID + "#create",
+		Type:      "Create",
+		Actor:     o.AttributedTo,
+		Published: o.Published,
+		To:        o.To,
+		Cc:        o.Cc,
+		Object:    o,
+	}
+}
+
+// apAnnounce is the activity of the site sharing a with its followers
+func apAnnounce(a *dnews.Article) *dnews.APActivity {
+	published := a.Date
+	return &dnews.APActivity{
+		ID:        apArticleID(a) + "#announce",
+		Type:      "Announce",
+		Actor:     apActorURL(apName),
+		Published: &published,
+		To:        []string{dnews.ActivityPublic},
+		Cc:        []string{apActorURL(apName) + "/followers"},
+		Object:    apArticleID(a),
+	}
+}
+
+// signActivityRequest signs req as the local actor with the given name
+func signActivityRequest(ctx context.Context, db *sql.DB, req *http.Request, name string, body []byte) error {
+	key, err := dnews.GetActorKeyContext(ctx, db, name)
+	if err != nil {
+		return err
+	}
+	private, err := key.Private()
+	if err != nil {
+		return err
+	}
+	return dnews.SignRequest(req, apKeyID(name), private, body)
+}
+
+// fetchActor returns the remote actor iri names. The request is signed by
+// the site, some servers answer nothing else.
+func fetchActor(ctx context.Context, db *sql.DB, iri string) (*dnews.APActor, error) {
+	u, err := url.Parse(iri)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an http:// or https:// URL", iri)
+	}
+	u.Fragment = ""
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", dnews.ActivityLDType+", "+dnews.ActivityContentType)
+	req.Header.Set("User-Agent", "dnews/"+version)
+	if err := signActivityRequest(ctx, db, req, apName, nil); err != nil {
+		return nil, err
+	}
+
+	resp, err := apClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+
+	var a dnews.APActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, apMaxBody)).Decode(&a); err != nil {
+		return nil, err
+	}
+	if a.ID == "" || a.Inbox == "" {
+		return nil, fmt.Errorf("%s is not an actor", u)
+	}
+	return &a, nil
+}
+
+// verifyActivity checks the signature of an activity sent to an inbox and
+// returns the actor who signed it
+func verifyActivity(r *http.Request, db *sql.DB, body []byte) (*dnews.APActor, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), apTimeout)
+	defer cancel()
+
+	var signer *dnews.APActor
+	_, err := dnews.VerifyRequest(r, body, func(keyID string) (*rsa.PublicKey, error) {
+		a, err := fetchActor(ctx, db, keyID)
+		if err != nil {
+			return nil, err
+		}
+		if a.PublicKey.ID != keyID || a.PublicKey.Owner != a.ID {
+			return nil, fmt.Errorf("%s is not a key of %s", keyID, a.ID)
+		}
+		signer = a
+		return dnews.ParsePublicKeyPEM(a.PublicKey.PublicKeyPem)
+	})
+	return signer, err
+}
+
+// federate delivers v from the local actor name to the followers of the
+// local actors in to, once per inbox. It returns at once, the deliveries
+// happen in the background.
+func federate(db *sql.DB, name string, v *dnews.APActivity, to ...string) {
+	go func() {
+		l := logger.WithField("actor", name).WithField("activity", v.ID)
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		fs, err := dnews.GetFollowersContext(ctx, db, to...)
+		if err != nil {
+			l.WithError(err).Error("activitypub: listing followers")
+			return
+		}
+		if len(fs) == 0 {
+			return
+		}
+
+		v.Context = dnews.ActivityStreams
+		body, err := json.Marshal(v)
+		if err != nil {
+			l.WithError(err).Error("activitypub: encoding activity")
+			return
+		}
+
+		sent := map[string]bool{}
+		for _, f := range fs {
+			if sent[f.Inbox] {
+				continue
+			}
+			sent[f.Inbox] = true
+			go deliverActivity(db, name, f, body)
+		}
+	}()
+}
+
+// federateArticle tells followers that a was published ("Create"), changed
+// ("Update") or taken down ("Delete"). The author sends the activity, the
+// site shares new articles with its own followers.
+func federateArticle(db *sql.DB, a *dnews.Article, activity string) {
+	author := a.Author.User
+	if author == "" || author == apName {
+		return
+	}
+
+	v := apCreate(a)
+	switch activity {
+	case "Create":
+		federate(db, author, v, author)
+		federate(db, apName, apAnnounce(a), apName)
+		return
+	case "Delete":
+		v.Object = &dnews.APArticle{ID: apArticleID(a), Type: "Tombstone"}
+	}
+	v.Type = activity
+	v.ID = fmt.Sprintf("%s#%s-%d", apArticleID(a), strings.ToLower(activity), time.Now().Unix())
+	federate(db, author, v, author, apName)
+}
+
+// deliverActivity posts body to the inbox of f signed by the local actor
+// name, trying again apTries times. A follower answering 410 Gone is
+// dropped.
+func deliverActivity(db *sql.DB, name string, f *dnews.Follower, body []byte) {
+	l := logger.WithField("actor", name).WithField("inbox", f.Inbox)
+
+	for try := 1; try <= apTries; try++ {
+		err := postActivity(db, name, f.Inbox, body)
+		switch err {
+		case nil:
+			apDeliveries.WithLabelValues("ok").Inc()
+			return
+		case errGone:
+			apDeliveries.WithLabelValues("gone").Inc()
+			ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+			err = dnews.RemoveFollowerContext(ctx, db, f.Actor, f.Follower)
+			cancel()
+			if err != nil {
+				l.WithError(err).Error("activitypub: removing follower")
+			}
+			l.WithField("follower", f.Follower).Info("activitypub: follower is gone")
+			return
+		}
+
+		l = l.WithError(err).WithField("try", try)
+		if try < apTries {
+			apDeliveries.WithLabelValues("retry").Inc()
+			time.Sleep(apRetry)
+		}
+	}
+	apDeliveries.WithLabelValues("failed").Inc()
+	l.Warn("activitypub: delivery given up")
+}
+
+// errGone is returned by postActivity for inboxes that answer 410 Gone
+var errGone = errors.New("gone")
+
+// postActivity makes one signed delivery of body to inbox
+func postActivity(db *sql.DB, name, inbox string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), apTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dnews.ActivityLDType)
+	req.Header.Set("User-Agent", "dnews/"+version)
+	if err := signActivityRequest(ctx, db, req, name, body); err != nil {
+		return err
+	}
+
+	resp, err := apClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusGone:
+		return errGone
+	}
+	return fmt.Errorf("answered %s", resp.Status)
+}
+
+// acceptFollow answers follow, sent by remote to the local actor name
+func acceptFollow(db *sql.DB, name string, remote *dnews.APActor, follow dnews.APActivity) {
+	follow.Context = nil
+	accept := dnews.APActivity{
+		Context: dnews.ActivityStreams,
+		ID:      fmt.Sprintf("%s#accept-%d", apActorURL(name), time.Now().UnixNano()),
+		Type:    "Accept",
+		Actor:   apActorURL(name),
+		To:      []string{remote.ID},
+		Object:  follow,
+	}
+	body, err := json.Marshal(accept)
+	if err != nil {
+		logger.WithError(err).Error("activitypub: encoding accept")
+		return
+	}
+	deliverActivity(db, name, &dnews.Follower{Actor: name, Follower: remote.ID, Inbox: remote.Inbox}, body)
+}
+
+// handleActivity acts on act, sent by remote to the local actor name.
+// Activities other than following are logged and otherwise ignored for now,
+// replies are where comments from the fediverse would come in.
+func handleActivity(r *http.Request, db *sql.DB, name string, remote *dnews.APActor, act dnews.APActivity) error {
+	ctx, cancel := dbContext(r)
+	defer cancel()
+
+	l := reqLog(r).WithField("actor", name).WithField("remote", remote.ID).WithField("type", act.Type)
+	switch act.Type {
+	case "Follow":
+		if dnews.APRef(act.Object) != apActorURL(name) {
+			return dnews.NewError(dnews.Invalid, nil, "The Follow is not for %s", apActorURL(name))
+		}
+		if err := dnews.AddFollowerContext(ctx, db, name, remote.ID, remote.DeliveryInbox()); err != nil {
+			return err
+		}
+		go acceptFollow(db, name, remote, act)
+		l.Info("activitypub: new follower")
+	case "Undo":
+		if dnews.APTypeOf(act.Object) != "Follow" {
+			l.Debug("activitypub: undo ignored")
+			return nil
+		}
+		if err := dnews.RemoveFollowerContext(ctx, db, name, remote.ID); err != nil {
+			return err
+		}
+		l.Info("activitypub: follower left")
+	case "Delete":
+		if dnews.APRef(act.Object) != remote.ID {
+			l.Debug("activitypub: delete ignored")
+			return nil
+		}
+		if err := dnews.RemoveFollowerContext(ctx, db, "", remote.ID); err != nil {
+			return err
+		}
+		l.Info("activitypub: follower deleted")
+	case "Create":
+		o, _ := act.Object.(map[string]interface{})
+		reply, _ := o["inReplyTo"].(string)
+		if !strings.HasPrefix(reply, siteURL("/ap/article/", nil)) {
+			l.Debug("activitypub: create ignored")
+			return nil
+		}
+		l.WithField("object", dnews.APRef(o)).WithField("in_reply_to", reply).Info("activitypub: reply received")
+	default:
+		l.Debug("activitypub: activity ignored")
+	}
+	return nil
+}
+
+// registerActivityPub makes the site, apName, and every author an actor
+// that can be found with WebFinger and followed from the fediverse
+func registerActivityPub(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/.well-known/webfinger", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		res := r.FormValue("resource")
+		name := ""
+		if strings.HasPrefix(res, "acct:") {
+			acct := strings.TrimPrefix(res, "acct:")
+			if i := strings.LastIndex(acct, "@"); i > 0 && strings.EqualFold(acct[i+1:], apHost()) {
+				name = acct[:i]
+			}
+		} else if strings.HasPrefix(res, apActorURL("")) {
+			name = strings.TrimPrefix(res, apActorURL(""))
+		}
+		if name == "" {
+			apiError(w, r, dnews.NewError(dnews.NotFound, nil, "Unknown resource %q", res))
+			return
+		}
+		if _, err := findActor(ctx, db, name); err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jrd+json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"subject": "acct:" + name + "@" + apHost(),
+			"aliases": []string{apActorURL(name)},
+			"links": []map[string]string{
+				{"rel": "self", "type": dnews.ActivityContentType, "href": apActorURL(name)},
+				{"rel": "http://webfinger.net/rel/profile-page", "type": "text/html", "href": siteURL("/", nil)},
+			},
+		})
+	}).Methods("GET")
+
+	ap := router.PathPrefix("/ap").Subrouter()
+
+	ap.HandleFunc("/actor/{name}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		doc, _, err := localActor(ctx, db, mux.Vars(r)["name"])
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		writeActivity(w, http.StatusOK, doc)
+	}).Methods("GET")
+
+	ap.HandleFunc("/actor/{name}/outbox", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		name := mux.Vars(r)["name"]
+		u, err := findActor(ctx, db, name)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		f := dnews.ArticleFilter{Limit: apOutboxSize}
+		if u != nil {
+			f.AuthorID = u.ID
+		}
+		as, total, err := dnews.GetArticlesContext(ctx, db, f)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		items := []*dnews.APActivity{}
+		for _, a := range as {
+			if u != nil {
+				items = append(items, apCreate(a))
+			} else {
+				items = append(items, apAnnounce(a))
+			}
+		}
+		writeActivity(w, http.StatusOK, dnews.APCollection{
+			Context:      dnews.ActivityStreams,
+			ID:           apActorURL(name) + "/outbox",
+			Type:         "OrderedCollection",
+			TotalItems:   total,
+			OrderedItems: items,
+		})
+	}).Methods("GET")
+
+	// Who follows is not shown, only how many.
+	ap.HandleFunc("/actor/{name}/followers", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		name := mux.Vars(r)["name"]
+		if _, err := findActor(ctx, db, name); err != nil {
+			apiError(w, r, err)
+			return
+		}
+		n, err := dnews.CountFollowersContext(ctx, db, name)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		writeActivity(w, http.StatusOK, dnews.APCollection{
+			Context:    dnews.ActivityStreams,
+			ID:         apActorURL(name) + "/followers",
+			Type:       "OrderedCollection",
+			TotalItems: n,
+		})
+	}).Methods("GET")
+
+	ap.HandleFunc("/actor/{name}/inbox", func(w http.ResponseWriter, r *http.Request) {
+		if !apInboxRequests.Allow(clientIP(r)) {
+			apiError(w, r, dnews.NewError(dnews.Limited, nil, "Too many activities, please try again later"))
+			return
+		}
+		name := mux.Vars(r)["name"]
+
+		ctx, cancel := dbContext(r)
+		_, err := findActor(ctx, db, name)
+		cancel()
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, apMaxBody))
+		if err != nil {
+			apiError(w, r, dnews.NewError(dnews.Invalid, err, "The activity cannot be read"))
+			return
+		}
+		var act dnews.APActivity
+		if err := json.Unmarshal(body, &act); err != nil {
+			apiError(w, r, dnews.NewError(dnews.Invalid, err, "The activity is not valid JSON"))
+			return
+		}
+		remote, err := verifyActivity(r, db, body)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		if remote.ID != act.Actor {
+			apiError(w, r, dnews.NewError(dnews.Forbidden, nil, "%s cannot send activities of %s", remote.ID, act.Actor))
+			return
+		}
+
+		if err := handleActivity(r, db, name, remote, act); err != nil {
+			apiError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST")
+
+	ap.HandleFunc("/article/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		a, err := dnews.GetArticleByIDContext(ctx, db, pathID(r))
+		if err == nil && !a.Live {
+			err = dnews.NewError(dnews.NotFound, nil, "No article with id %d", a.ID)
+		}
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		o := apArticle(a)
+		o.Context = dnews.ActivityStreams
+		writeActivity(w, http.StatusOK, o)
+	}).Methods("GET")
+}
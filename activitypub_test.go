@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// testKey is an RSA key pair in the PEM encodings ap_keys holds
+type testKey struct {
+	private    *rsa.PrivateKey
+	privatePEM string
+	publicPEM  string
+}
+
+func newTestKey(t *testing.T) *testKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{
+		private:    k,
+		privatePEM: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})),
+		publicPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})),
+	}
+}
+
+// instance is a fake fediverse server with one actor, alice. Every request
+// to it has to be signed by the local actor whose key is local.
+type instance struct {
+	*httptest.Server
+	t      *testing.T
+	key    *testKey
+	local  *testKey
+	status int
+	inbox  chan dnews.APActivity
+}
+
+func newInstance(t *testing.T, local *testKey) *instance {
+	in := &instance{t: t, key: newTestKey(t), local: local, status: http.StatusAccepted, inbox: make(chan dnews.APActivity, 4)}
+	in.Server = httptest.NewServer(http.HandlerFunc(in.serve))
+	return in
+}
+
+func (in *instance) actorID() string { return in.URL + "/users/alice" }
+
+func (in *instance) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	_, err := dnews.VerifyRequest(r, body, func(keyID string) (*rsa.PublicKey, error) {
+		return &in.local.private.PublicKey, nil
+	})
+	if err != nil {
+		in.t.Errorf("%s %s: %v", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/users/alice":
+		json.NewEncoder(w).Encode(dnews.APActor{
+			ID:    in.actorID(),
+			Type:  "Person",
+			Inbox: in.actorID() + "/inbox",
+			PublicKey: dnews.APPublicKey{
+				ID:           in.actorID() + "#main-key",
+				Owner:        in.actorID(),
+				PublicKeyPem: in.key.publicPEM,
+			},
+		})
+	case r.Method == "POST" && r.URL.Path == "/users/alice/inbox":
+		var act dnews.APActivity
+		if err := json.Unmarshal(body, &act); err != nil {
+			in.t.Error(err)
+		}
+		w.WriteHeader(in.status)
+		in.inbox <- act
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// send posts v from alice to the inbox of the local actor name, signed with
+// key
+func (in *instance) send(router *mux.Router, name string, key *testKey, v interface{}) *httptest.ResponseRecorder {
+	body, err := json.Marshal(v)
+	if err != nil {
+		in.t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/ap/actor/"+name+"/inbox", bytes.NewReader(body))
+	r.Header.Set("Content-Type", dnews.ActivityContentType)
+	if err := dnews.SignRequest(r, in.actorID()+"#main-key", key.private, body); err != nil {
+		in.t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// apFixtures makes beastie an author and gives every local actor key
+func apFixtures(f *fakeDB, key *testKey) {
+	now := time.Now()
+	f.rows("from ap_keys where actor = $1", []driver.Value{key.privatePEM, key.publicPEM, now})
+	f.on("from users where username = $1", func(args []driver.Value) (fakeResult, error) {
+		perms := "{}"
+		switch args[0] {
+		case "beastie":
+			perms = "{" + dnews.PermWriteArticles + "}"
+		case "reader":
+		default:
+			return fakeResult{}, nil
+		}
+		return fakeResult{rows: [][]driver.Value{{int64(1), now, "Beastie", "Daemon", args[0].(string) + "@example.org", args[0], "author", perms, false, true, now, false}}}, nil
+	})
+}
+
+func apRouter(db *sql.DB) *mux.Router {
+	router := mux.NewRouter()
+	registerActivityPub(router, db)
+	return router
+}
+
+func TestWebFinger(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+	apFixtures(f, newTestKey(t))
+	router := apRouter(db)
+
+	for _, tc := range []struct {
+		resource string
+		status   int
+		actor    string
+	}{
+		{"acct:beastie@" + apHost(), http.StatusOK, "beastie"},
+		{"acct:beastie@" + strings.ToUpper(apHost()), http.StatusOK, "beastie"},
+		{"acct:" + apName + "@" + apHost(), http.StatusOK, apName},
+		{apActorURL("beastie"), http.StatusOK, "beastie"},
+		{"acct:beastie@example.org", http.StatusNotFound, ""},
+		{"acct:reader@" + apHost(), http.StatusNotFound, ""},
+		{"acct:nobody@" + apHost(), http.StatusNotFound, ""},
+		{"https://example.org/", http.StatusNotFound, ""},
+	} {
+		r := httptest.NewRequest("GET", "/.well-known/webfinger?resource="+url.QueryEscape(tc.resource), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: got %d, want %d", tc.resource, w.Code, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var jrd struct {
+			Subject string
+			Links   []map[string]string
+		}
+		if err := json.NewDecoder(w.Body).Decode(&jrd); err != nil {
+			t.Fatal(err)
+		}
+		if jrd.Subject != "acct:"+tc.actor+"@"+apHost() {
+			t.Errorf("%s: subject is %q", tc.resource, jrd.Subject)
+		}
+		self := ""
+		for _, l := range jrd.Links {
+			if l["rel"] == "self" && l["type"] == dnews.ActivityContentType {
+				self = l["href"]
+			}
+		}
+		if self != apActorURL(tc.actor) {
+			t.Errorf("%s: self is %q", tc.resource, self)
+		}
+	}
+}
+
+func TestInboxFollowAndUndo(t *testing.T) {
+	defer allowLoopback()()
+	local := newTestKey(t)
+	f, db := newFakeDB(t)
+	defer db.Close()
+	apFixtures(f, local)
+	var followed []driver.Value
+	f.on("insert into ap_followers", func(args []driver.Value) (fakeResult, error) {
+		followed = args
+		return fakeResult{affected: 1}, nil
+	})
+	var unfollowed []driver.Value
+	f.on("delete from ap_followers", func(args []driver.Value) (fakeResult, error) {
+		unfollowed = args
+		return fakeResult{affected: 1}, nil
+	})
+	router := apRouter(db)
+	in := newInstance(t, local)
+	defer in.Close()
+
+	follow := dnews.APActivity{ID: in.actorID() + "#follow", Type: "Follow", Actor: in.actorID(), Object: apActorURL("beastie")}
+	if w := in.send(router, "beastie", in.key, follow); w.Code != http.StatusAccepted {
+		t.Fatalf("Follow: got %d: %s", w.Code, w.Body)
+	}
+	if followed == nil || followed[0] != "beastie" || followed[1] != in.actorID() || followed[2] != in.actorID()+"/inbox" {
+		t.Errorf("follower saved as %v", followed)
+	}
+
+	select {
+	case accept := <-in.inbox:
+		if accept.Type != "Accept" || accept.Actor != apActorURL("beastie") || dnews.APRef(accept.Object) != follow.ID {
+			t.Errorf("got %+v", accept)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Follow was not accepted")
+	}
+
+	undo := dnews.APActivity{Type: "Undo", Actor: in.actorID(), Object: follow}
+	if w := in.send(router, "beastie", in.key, undo); w.Code != http.StatusAccepted {
+		t.Fatalf("Undo: got %d: %s", w.Code, w.Body)
+	}
+	if unfollowed == nil || unfollowed[0] != "beastie" || unfollowed[1] != in.actorID() {
+		t.Errorf("follower removed as %v", unfollowed)
+	}
+}
+
+func TestInboxRejects(t *testing.T) {
+	defer allowLoopback()()
+	local := newTestKey(t)
+	f, db := newFakeDB(t)
+	defer db.Close()
+	apFixtures(f, local)
+	router := apRouter(db)
+	in := newInstance(t, local)
+	defer in.Close()
+
+	follow := func(actor string) dnews.APActivity {
+		return dnews.APActivity{Type: "Follow", Actor: actor, Object: apActorURL("beastie")}
+	}
+
+	// The follow of someone else, signed by alice
+	if w := in.send(router, "beastie", in.key, follow("https://remote.example/users/bob")); w.Code != http.StatusForbidden {
+		t.Errorf("someone else's activity: got %d", w.Code)
+	}
+	// Signed with a key that is not alice's
+	if w := in.send(router, "beastie", newTestKey(t), follow(in.actorID())); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: got %d", w.Code)
+	}
+	// A Follow of another actor
+	bad := follow(in.actorID())
+	bad.Object = apActorURL(apName)
+	if w := in.send(router, "beastie", in.key, bad); w.Code != http.StatusBadRequest {
+		t.Errorf("Follow of another actor: got %d", w.Code)
+	}
+	// Nobody can be followed who does not write
+	if w := in.send(router, "reader", in.key, follow(in.actorID())); w.Code != http.StatusNotFound {
+		t.Errorf("Follow of a reader: got %d", w.Code)
+	}
+
+	// A body that does not match its digest
+	body, _ := json.Marshal(follow(in.actorID()))
+	r := httptest.NewRequest("POST", "/ap/actor/beastie/inbox", bytes.NewReader(body))
+	if err := dnews.SignRequest(r, in.actorID()+"#main-key", in.key.private, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("bad digest: got %d", w.Code)
+	}
+}
+
+func TestInboxRefusesPrivateKeyIDs(t *testing.T) {
+	local := newTestKey(t)
+	f, db := newFakeDB(t)
+	defer db.Close()
+	apFixtures(f, local)
+	router := apRouter(db)
+	in := newInstance(t, local)
+	defer in.Close()
+
+	// Without allowLoopback the key on 127.0.0.1 is not fetched.
+	w := in.send(router, "beastie", in.key, dnews.APActivity{Type: "Follow", Actor: in.actorID(), Object: apActorURL("beastie")})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401", w.Code)
+	}
+}
+
+func TestDeliverActivity(t *testing.T) {
+	defer allowLoopback()()
+	local := newTestKey(t)
+	f, db := newFakeDB(t)
+	defer db.Close()
+	apFixtures(f, local)
+	var removed []driver.Value
+	f.on("delete from ap_followers", func(args []driver.Value) (fakeResult, error) {
+		removed = args
+		return fakeResult{affected: 1}, nil
+	})
+	in := newInstance(t, local)
+	defer in.Close()
+
+	follower := &dnews.Follower{Actor: "beastie", Follower: in.actorID(), Inbox: in.actorID() + "/inbox"}
+	body, _ := json.Marshal(dnews.APActivity{Type: "Create", Actor: apActorURL("beastie")})
+
+	deliverActivity(db, "beastie", follower, body)
+	if act := <-in.inbox; act.Type != "Create" {
+		t.Errorf("delivered %+v", act)
+	}
+	if removed != nil {
+		t.Error("a follower that took the delivery was removed")
+	}
+
+	in.status = http.StatusGone
+	deliverActivity(db, "beastie", follower, body)
+	<-in.inbox
+	if removed == nil || removed[0] != "beastie" || removed[1] != in.actorID() {
+		t.Errorf("gone follower removed as %v", removed)
+	}
+}
+
+func TestFederateOncePerInbox(t *testing.T) {
+	defer allowLoopback()()
+	local := newTestKey(t)
+	f, db := newFakeDB(t)
+	defer db.Close()
+	apFixtures(f, local)
+	in := newInstance(t, local)
+	defer in.Close()
+
+	now := time.Now()
+	shared := in.actorID() + "/inbox"
+	f.rows("from ap_followers where actor = any($1)",
+		[]driver.Value{int64(1), "beastie", in.actorID(), shared, now},
+		[]driver.Value{int64(2), apName, in.actorID(), shared, now})
+
+	federate(db, "beastie", &dnews.APActivity{ID: "x", Type: "Update", Actor: apActorURL("beastie")}, "beastie", apName)
+	select {
+	case act := <-in.inbox:
+		if act.Type != "Update" || act.Context == nil {
+			t.Errorf("delivered %+v", act)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was delivered")
+	}
+	select {
+	case <-in.inbox:
+		t.Error("the shared inbox got the activity twice")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
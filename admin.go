@@ -0,0 +1,676 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// confirmation is the data for confirm.html
+type confirmation struct {
+	Title   string
+	Message string
+	Action  string
+	Cancel  string
+}
+
+// sessionUser returns the logged in user for r, or nil if there is none
+func sessionUser(r *http.Request) *dnews.User {
+	session, err := store.Get(r, "session-name")
+	if err != nil {
+		return nil
+	}
+	u, ok := session.Values["user"].(*dnews.User)
+	if !ok || !u.Authed {
+		return nil
+	}
+	return u
+}
+
+// canViewArticle reports whether the logged in user of r may see a. Drafts
+// are shown to editors and to their author, as in the JSON API.
+func canViewArticle(r *http.Request, a *dnews.Article) bool {
+	if a.Live {
+		return true
+	}
+	u := sessionUser(r)
+	if u == nil {
+		return false
+	}
+	return u.Can(dnews.PermEditArticles) || (u.Can(dnews.PermWriteArticles) && a.AuthorID == u.ID)
+}
+
+// requireUser returns the logged in user. Visitors get the login page and
+// ok is false.
+func requireUser(w http.ResponseWriter, r *http.Request) (u *dnews.User, ok bool) {
+	u = sessionUser(r)
+	if u == nil {
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return nil, false
+		}
+		renderTemplate(w, r, data, "login.html")
+		return nil, false
+	}
+	return u, true
+}
+
+// requirePerm returns the logged in user if their role grants perm.
+// Visitors get the login page, everyone else a permission error, and ok is
+// false.
+func requirePerm(w http.ResponseWriter, r *http.Request, perm string) (u *dnews.User, ok bool) {
+	u, ok = requireUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !u.Can(perm) {
+		reqLog(r).WithField("user_id", u.ID).WithField("permission", perm).Info("permission denied")
+		errorPage(w, r, dnews.NewError(dnews.Forbidden, nil, "Your account is not allowed to do this"))
+		return nil, false
+	}
+	if needsTwoFactor(u) {
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return nil, false
+	}
+	return u, true
+}
+
+// guard only passes requests from users with perm on to h, see requirePerm
+func guard(perm string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requirePerm(w, r, perm); !ok {
+			return
+		}
+		h(w, r)
+	}
+}
+
+// userEditPage is the data for user_edit.html
+type userEditPage struct {
+	Account *dnews.User
+	Roles   dnews.Roles
+}
+
+// pathID returns the numeric {id} of the matched route
+func pathID(r *http.Request) int {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return id
+}
+
+// userFromForm copies the user fields of the posted form into u
+func userFromForm(r *http.Request, u *dnews.User) {
+	u.User = r.FormValue("username")
+	u.FName = r.FormValue("fname")
+	u.LName = r.FormValue("lname")
+	u.Email = r.FormValue("email")
+	u.Role = r.FormValue("role")
+	u.Disabled = r.FormValue("disabled") == "on"
+	u.Verified = r.FormValue("verified") == "on"
+}
+
+func registerUserAdmin(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/user/add", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		var u dnews.User
+		userFromForm(r, &u)
+		u.Pass = r.FormValue("passwd")
+
+		if err := u.Validate(); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if err := dnews.CheckPassword(&u, u.Pass); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		id, err := dnews.InsertUserContext(ctx, db, u)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", *id).Info("user added")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/edit/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		u, err := dnews.GetUserContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		roles, err := dnews.GetRolesContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = userEditPage{Account: u, Roles: roles}
+		renderTemplate(w, r, data, "user_edit.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/user/edit/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		me := sessionUser(r)
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		u, err := dnews.GetUserContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		userFromForm(r, u)
+		if err := u.Validate(); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if u.ID == me.ID && (u.Role != me.Role || u.Disabled) {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "You can not change your own role or disable yourself"))
+			return
+		}
+
+		if err := dnews.UpdateUserContext(ctx, db, *u); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", u.ID).Info("user updated")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/passwd/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		u, err := dnews.GetUserContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		pass := r.FormValue("passwd")
+		if err := dnews.CheckPassword(u, pass); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if pass != r.FormValue("confirm") {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "The passwords do not match"))
+			return
+		}
+
+		if err := dnews.SetUserPasswordContext(ctx, db, u.ID, pass); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", u.ID).Info("user password reset")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/2fa/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.DisableTOTPContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", id).Info("user two-factor authentication reset")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/sessions/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		u, err := dnews.GetUserContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		ss, err := dnews.GetUserSessionsContext(ctx, db, u.ID)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = sessionsPage{Owner: u, Sessions: ss, Current: currentSessionID(r), Admin: true}
+		renderTemplate(w, r, data, "sessions.html")
+	})).Methods("GET")
+
+	// Without a session form value every session of the user ends.
+	router.HandleFunc("/user/sessions/{id:[0-9]+}/end", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		l := reqLog(r).WithField("user_id", id)
+		if sid := r.FormValue("session"); sid != "" {
+			if err := dnews.EndSessionContext(ctx, db, id, sid); err != nil {
+				errorPage(w, r, err)
+				return
+			}
+			l.Info("user session ended")
+		} else {
+			n, err := dnews.EndUserSessionsContext(ctx, db, id)
+			if err != nil {
+				errorPage(w, r, err)
+				return
+			}
+			l.WithField("sessions", n).Info("user logged out everywhere")
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/user/sessions/%d", id), http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/unlock/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		u, err := dnews.GetUserContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if err := dnews.UnlockUserContext(ctx, db, u.ID); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		loginNames.Reset(strings.ToLower(u.User))
+
+		reqLog(r).WithField("user_id", u.ID).Info("user unlocked")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/token/revoke/{id:[0-9]+}", guard(dnews.PermManageUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.RevokeAPITokenContext(ctx, db, 0, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("token_id", id).Info("API token revoked by administrator")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/user/remove/{id:[0-9]+}", guard(dnews.PermDeleteUsers, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		u, err := dnews.GetUserContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = confirmation{
+			Title:   "Remove user",
+			Message: fmt.Sprintf("Really remove %s (%s)? This can not be undone.", u.User, u.Combine()),
+			Action:  fmt.Sprintf("/user/remove/%d", u.ID),
+			Cancel:  "/admin",
+		}
+		renderTemplate(w, r, data, "confirm.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/user/remove/{id:[0-9]+}", guard(dnews.PermDeleteUsers, func(w http.ResponseWriter, r *http.Request) {
+		me := sessionUser(r)
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if id == me.ID {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "You can not remove yourself"))
+			return
+		}
+
+		if err := dnews.DeleteUserContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", id).Info("user removed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+}
+
+func registerTagAdmin(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/tag/add", guard(dnews.PermManageTags, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		name := r.FormValue("name")
+		id, err := dnews.InsertTagContext(ctx, db, name)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("tag_id", *id).Info("tag added")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/tag/edit/{id:[0-9]+}", guard(dnews.PermManageTags, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		t, err := dnews.GetTagContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		all, err := dnews.GetAllTagsContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		var others dnews.Tags
+		for _, o := range all {
+			if o.ID != t.ID {
+				others = append(others, o)
+			}
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = struct {
+			Tag    *dnews.Tag
+			Others dnews.Tags
+		}{t, others}
+		renderTemplate(w, r, data, "tag_edit.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/tag/rename/{id:[0-9]+}", guard(dnews.PermManageTags, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.RenameTagContext(ctx, db, id, r.FormValue("name")); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("tag_id", id).Info("tag renamed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/tag/merge/{id:[0-9]+}", guard(dnews.PermManageTags, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		from := pathID(r)
+		into, err := strconv.Atoi(r.FormValue("into"))
+		if err != nil {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, err, "Pick a tag to merge into"))
+			return
+		}
+
+		if err := dnews.MergeTagsContext(ctx, db, from, into); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("tag_id", from).WithField("into", into).Info("tags merged")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/tag/remove/{id:[0-9]+}", guard(dnews.PermManageTags, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		t, err := dnews.GetTagContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = confirmation{
+			Title:   "Remove tag",
+			Message: fmt.Sprintf("Really remove the tag %s? Articles keep their other tags.", t.Name),
+			Action:  fmt.Sprintf("/tag/remove/%d", t.ID),
+			Cancel:  "/admin",
+		}
+		renderTemplate(w, r, data, "confirm.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/tag/remove/{id:[0-9]+}", guard(dnews.PermManageTags, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.DeleteTagContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("tag_id", id).Info("tag removed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+}
+
+// bugFromForm copies the user group fields of the posted form into b
+func bugFromForm(r *http.Request, b *dnews.Bug) {
+	b.Name = r.FormValue("name")
+	b.Descr = r.FormValue("descr")
+	b.URL = r.FormValue("url")
+	b.Region = r.FormValue("region")
+	b.Location = r.FormValue("location")
+	b.Contact = r.FormValue("contact")
+	b.FeedURL = r.FormValue("feed_url")
+	b.Active = r.FormValue("active") == "on"
+}
+
+func registerBugAdmin(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/bug/add", guard(dnews.PermManageBugs, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		var b dnews.Bug
+		bugFromForm(r, &b)
+
+		id, err := dnews.InsertBugContext(ctx, db, b)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("bug_id", *id).Info("user group added")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/bug/edit/{id:[0-9]+}", guard(dnews.PermManageBugs, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		b, err := dnews.GetBugContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = b
+		renderTemplate(w, r, data, "bug_edit.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/bug/edit/{id:[0-9]+}", guard(dnews.PermManageBugs, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		b, err := dnews.GetBugContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		bugFromForm(r, b)
+		if err := dnews.UpdateBugContext(ctx, db, *b); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("bug_id", b.ID).Info("user group updated")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/bug/remove/{id:[0-9]+}", guard(dnews.PermManageBugs, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		b, err := dnews.GetBugContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = confirmation{
+			Title:   "Remove user group",
+			Message: fmt.Sprintf("Really remove %s? Unticking Active hides it from /advocacy instead.", b.Name),
+			Action:  fmt.Sprintf("/bug/remove/%d", b.ID),
+			Cancel:  "/admin",
+		}
+		renderTemplate(w, r, data, "confirm.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/bug/remove/{id:[0-9]+}", guard(dnews.PermManageBugs, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.DeleteBugContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("bug_id", id).Info("user group removed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+}
+
+// bugSubmissions limits how many groups one address can suggest per day
+var bugSubmissions = newRateLimiter(3, 24*time.Hour)
+
+func registerBugSubmit(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/advocacy/submit", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := requireUser(w, r); !ok {
+			return
+		}
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		renderTemplate(w, r, data, "bug_submit.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/advocacy/submit", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		var b dnews.Bug
+		bugFromForm(r, &b)
+		b.Active = true
+		b.Status = dnews.BugPending
+
+		if err := b.Validate(); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		ip := clientIP(r)
+		if !bugSubmissions.Allow(ip) {
+			errorPage(w, r, dnews.NewError(dnews.Limited, nil, "You have suggested too many groups today, please try again tomorrow"))
+			return
+		}
+
+		id, err := dnews.InsertBugContext(ctx, db, b)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		reqLog(r).WithField("bug_id", *id).WithField("user_id", u.ID).WithField("ip", ip).Info("user group submitted")
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = &b
+		renderTemplate(w, r, data, "bug_submit.html")
+	}).Methods("POST")
+
+	for action, status := range map[string]string{
+		"approve": dnews.BugApproved,
+		"reject":  dnews.BugRejected,
+	} {
+		status := status
+		router.HandleFunc("/bug/"+action+"/{id:[0-9]+}", guard(dnews.PermManageBugs, func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := dbContext(r)
+			defer cancel()
+
+			id := pathID(r)
+			if err := dnews.SetBugStatusContext(ctx, db, id, status); err != nil {
+				errorPage(w, r, err)
+				return
+			}
+
+			reqLog(r).WithField("bug_id", id).WithField("status", status).Info("user group moderated")
+			http.Redirect(w, r, "/admin", http.StatusFound)
+		})).Methods("POST")
+	}
+}
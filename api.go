@@ -0,0 +1,570 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// Page sizes of API listings
+const (
+	apiPerPage    = 20
+	apiMaxPerPage = 100
+)
+
+// apiMaxBody limits the size of JSON request bodies
+const apiMaxBody = 1 << 20
+
+// apiCodes are the machine readable codes of APIError, by kind
+var apiCodes = map[dnews.Kind]string{
+	dnews.Internal:     "internal",
+	dnews.NotFound:     "not_found",
+	dnews.Forbidden:    "forbidden",
+	dnews.Invalid:      "invalid",
+	dnews.Limited:      "limited",
+	dnews.Unauthorized: "unauthorized",
+}
+
+// writeJSON sends v with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// apiError is errorPage for the JSON API
+func apiError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := dnews.KindOf(err)
+	page, ok := errorPages[kind]
+	if !ok {
+		kind, page = dnews.Internal, errorPages[dnews.Internal]
+	}
+
+	l := reqLog(r).WithError(err).WithField("status", page.status)
+	if kind == dnews.Internal {
+		l.Error("internal server error")
+	} else {
+		l.Debug("API request failed")
+	}
+
+	var body dnews.APIError
+	body.Error.Code = apiCodes[kind]
+	body.Error.Message = dnews.MessageOf(err)
+	if body.Error.Message == "" {
+		body.Error.Message = page.message
+	}
+	body.RequestID = dnews.RequestID(r.Context())
+	if kind == dnews.Unauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dnews"`)
+	}
+	writeJSON(w, page.status, body)
+}
+
+// apiCaller is who sent an API request and the token they used
+type apiCaller struct {
+	User  *dnews.User
+	Token *dnews.APIToken
+}
+
+// has reports whether the token of c was given scope, c may be nil
+func (c *apiCaller) has(scope string) bool {
+	return c != nil && c.Token.Has(scope)
+}
+
+// apiAuth returns the caller named by the token in the Authorization
+// header, or nil when there is none
+func apiAuth(r *http.Request, db *sql.DB) (*apiCaller, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, nil
+	}
+	raw := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	t, err := dnews.GetAPITokenContext(ctx, db, raw)
+	if err != nil {
+		if dnews.KindOf(err) == dnews.NotFound {
+			err = dnews.NewError(dnews.Unauthorized, err, "The API token is invalid, expired or revoked")
+		}
+		return nil, err
+	}
+	u, err := dnews.GetUserContext(ctx, db, t.UserID)
+	if err != nil {
+		return nil, err
+	}
+	u.Authed = true
+	return &apiCaller{User: u, Token: t}, nil
+}
+
+// requireAPIToken returns the caller of the request, otherwise it sends
+// the error and ok is false
+func requireAPIToken(w http.ResponseWriter, r *http.Request, db *sql.DB) (c *apiCaller, ok bool) {
+	c, err := apiAuth(r, db)
+	if err == nil && c == nil {
+		err = dnews.NewError(dnews.Unauthorized, nil, "This needs an API token")
+	}
+	if err != nil {
+		apiError(w, r, err)
+		return nil, false
+	}
+	return c, true
+}
+
+// requireAPIPerm returns the caller of the request if their token has
+// scope and their account has perm, otherwise it sends the error and ok is
+// false
+func requireAPIPerm(w http.ResponseWriter, r *http.Request, db *sql.DB, scope, perm string) (c *apiCaller, ok bool) {
+	c, ok = requireAPIToken(w, r, db)
+	if !ok {
+		return nil, false
+	}
+	var err error
+	switch {
+	case !c.has(scope):
+		err = dnews.NewError(dnews.Forbidden, nil, "The API token does not have the %s scope", scope)
+	case !c.User.Can(perm):
+		err = dnews.NewError(dnews.Forbidden, nil, "Your account is not allowed to do this")
+	}
+	if err != nil {
+		apiError(w, r, err)
+		return nil, false
+	}
+	return c, true
+}
+
+// canReadArticle reports whether c may see a, which is everything live
+// and, with the read scope, the drafts their account may see
+func canReadArticle(c *apiCaller, a *dnews.Article) bool {
+	if a.Live {
+		return true
+	}
+	if !c.has(dnews.ScopeRead) {
+		return false
+	}
+	return c.User.Can(dnews.PermEditArticles) || (c.User.Can(dnews.PermWriteArticles) && a.AuthorID == c.User.ID)
+}
+
+// canEditArticle reports whether c may change a. Other people's articles
+// also need the admin scope.
+func canEditArticle(c *apiCaller, a *dnews.Article) bool {
+	if !c.has(dnews.ScopeWriteArticles) {
+		return false
+	}
+	if a.AuthorID == c.User.ID {
+		return c.User.Can(dnews.PermWriteArticles)
+	}
+	return c.has(dnews.ScopeAdmin) && c.User.Can(dnews.PermEditArticles)
+}
+
+// apiMaxPage keeps (page-1)*per_page from overflowing, as an int here and
+// as an offset in the database
+const apiMaxPage = math.MaxInt32 / apiMaxPerPage
+
+// pageParams reads the page and per_page query parameters
+func pageParams(r *http.Request) (page, perPage int, err error) {
+	page, perPage = 1, apiPerPage
+	if v := r.FormValue("page"); v != "" {
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 || page > apiMaxPage {
+			return 0, 0, dnews.NewError(dnews.Invalid, err, "page has to be between 1 and %d", apiMaxPage)
+		}
+	}
+	if v := r.FormValue("per_page"); v != "" {
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > apiMaxPerPage {
+			return 0, 0, dnews.NewError(dnews.Invalid, err, "per_page has to be between 1 and %d", apiMaxPerPage)
+		}
+	}
+	return page, perPage, nil
+}
+
+// pageBounds returns the slice bounds of page in a listing of n items
+func pageBounds(page, perPage, n int) (start, end int) {
+	// Compared before multiplying, a huge page could wrap around.
+	start = n
+	if page-1 <= n/perPage {
+		start = (page - 1) * perPage
+	}
+	if start > n {
+		start = n
+	}
+	end = start + perPage
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// apiArticle converts a, leaving out the markdown unless full is set
+func apiArticle(a *dnews.Article, full bool) *dnews.APIArticle {
+	out := &dnews.APIArticle{
+		ID:     a.ID,
+		Slug:   a.Slug,
+		Title:  a.Title,
+		Date:   a.Date,
+		Live:   a.Live,
+		Author: a.Author.Combine(),
+		Tags:   a.Tags.Join(),
+		Signed: a.Signed,
+	}
+	if out.Tags == nil {
+		out.Tags = []string{}
+	}
+	if full {
+		out.Markdown = string(a.Body)
+		out.Signature = string(a.Signature)
+	}
+	return out
+}
+
+// readArticle decodes an APIArticleInput from the body of r into an article
+func readArticle(w http.ResponseWriter, r *http.Request) (*dnews.Article, *dnews.APIArticleInput, error) {
+	var in dnews.APIArticleInput
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, nil, dnews.NewError(dnews.Invalid, err, "The body has to be a JSON article of at most %d bytes", apiMaxBody)
+	}
+
+	var a dnews.Article
+	if err := a.Load(strings.NewReader(in.Markdown)); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSpace(a.Title) == "" {
+		return nil, nil, dnews.NewError(dnews.Invalid, nil, "The markdown needs a title: line")
+	}
+	if in.Signature == "" {
+		return nil, nil, dnews.NewError(dnews.Invalid, nil, "Articles have to be signed")
+	}
+	a.Signature = []byte(in.Signature)
+	return &a, &in, nil
+}
+
+// verifyArticle checks the signature of a against key
+func verifyArticle(a *dnews.Article, key []byte) error {
+	ok, err := a.Verify(key)
+	if err != nil {
+		return dnews.NewError(dnews.Invalid, err, "The signature or public key could not be read")
+	}
+	if !*ok {
+		return dnews.NewError(dnews.Invalid, nil, "The signature does not match the markdown")
+	}
+	return nil
+}
+
+// csrfExempt are the path prefixes skipCSRF lets through. The API only
+// trusts the token in the Authorization header, never cookies, ActivityPub
+// inboxes trust HTTP signatures and the WebSub hub and Webmention endpoint
+// act for nobody, so forged cross-site requests gain nothing there.
+var csrfExempt = []string{
+	"/api/" + dnews.APIVersion + "/",
+	"/ap/",
+	"/websub",
+	"/webmention",
+}
+
+// skipCSRF sends requests for csrfExempt paths to plain and everything
+// else to protected
+func skipCSRF(protected, plain http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range csrfExempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				plain.ServeHTTP(w, r)
+				return
+			}
+		}
+		protected.ServeHTTP(w, r)
+	})
+}
+
+func registerAPI(router *mux.Router, db *sql.DB) {
+	api := router.PathPrefix("/api/" + dnews.APIVersion).Subrouter()
+
+	api.HandleFunc("/openapi.json", serveOpenAPI).Methods("GET")
+
+	api.HandleFunc("/articles", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		c, err := apiAuth(r, db)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		page, perPage, err := pageParams(r)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		f := dnews.ArticleFilter{Limit: perPage, Offset: (page - 1) * perPage}
+		if c.has(dnews.ScopeRead) {
+			switch {
+			case c.User.Can(dnews.PermEditArticles):
+				f.Drafts = true
+			case c.User.Can(dnews.PermWriteArticles):
+				f.Drafts = true
+				f.DraftsBy = c.User.ID
+			}
+		}
+		as, total, err := dnews.GetArticlesContext(ctx, db, f)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		out := []*dnews.APIArticle{}
+		for _, a := range as {
+			a.Verify(a.Author.Pubkey)
+			out = append(out, apiArticle(a, false))
+		}
+		writeJSON(w, http.StatusOK, dnews.APIPage{Page: page, PerPage: perPage, Total: total, Data: out})
+	}).Methods("GET")
+
+	api.HandleFunc("/articles/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		c, err := apiAuth(r, db)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		a, err := dnews.GetArticleByIDContext(ctx, db, pathID(r))
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		if !canReadArticle(c, a) {
+			apiError(w, r, dnews.NewError(dnews.NotFound, nil, "No article with id %d", a.ID))
+			return
+		}
+
+		a.Verify(a.Author.Pubkey)
+		writeJSON(w, http.StatusOK, apiArticle(a, true))
+	}).Methods("GET")
+
+	api.HandleFunc("/articles", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := requireAPIPerm(w, r, db, dnews.ScopeWriteArticles, dnews.PermWriteArticles)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		a, in, err := readArticle(w, r)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		key, err := dnews.GetPubkeyContext(ctx, db, c.User.ID)
+		if err != nil {
+			if dnews.KindOf(err) == dnews.NotFound {
+				err = dnews.NewError(dnews.Invalid, err, "There is no signify public key on file for your account")
+			}
+			apiError(w, r, err)
+			return
+		}
+		if err := verifyArticle(a, key); err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		// The account posting is the author, whatever the header says.
+		a.Author.Email = c.User.Email
+		a.Live = in.Live
+		if a.Date.IsZero() {
+			a.Date = time.Now()
+		}
+		id, err := dnews.InsertArticleContext(ctx, db, *a, in.CreateTags)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		created, err := dnews.GetArticleByIDContext(ctx, db, *id)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", c.User.ID).WithField("token_id", c.Token.ID).WithField("article_id", *id).Info("article created")
+		created.Signed = true
+		if created.Live {
+			queueWebhook(r, db, dnews.EventArticlePublished, articleURL(created), apiArticle(created, false))
+			pushFeeds(db)
+			federateArticle(db, created, "Create")
+			sendWebmentions(created)
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/%s/articles/%d", dnews.APIVersion, *id))
+		writeJSON(w, http.StatusCreated, apiArticle(created, true))
+	}).Methods("POST")
+
+	api.HandleFunc("/articles/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := requireAPIPerm(w, r, db, dnews.ScopeWriteArticles, dnews.PermWriteArticles)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		old, err := dnews.GetArticleByIDContext(ctx, db, pathID(r))
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		if !canEditArticle(c, old) {
+			apiError(w, r, dnews.NewError(dnews.Forbidden, nil, "Only editors with a token that has the admin scope can change other people's articles"))
+			return
+		}
+
+		a, in, err := readArticle(w, r)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		// Pages check signatures against the author's key, so changes
+		// have to be signed by the author even when an editor sends them.
+		if err := verifyArticle(a, old.Author.Pubkey); err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		a.ID = old.ID
+		if err := dnews.UpdateArticleContext(ctx, db, *a, in.CreateTags); err != nil {
+			apiError(w, r, err)
+			return
+		}
+		updated, err := dnews.GetArticleByIDContext(ctx, db, old.ID)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("user_id", c.User.ID).WithField("token_id", c.Token.ID).WithField("article_id", old.ID).Info("article updated")
+		updated.Signed = true
+		if updated.Live {
+			queueWebhook(r, db, dnews.EventArticleUpdated, articleURL(updated), apiArticle(updated, false))
+			pushFeeds(db)
+			federateArticle(db, updated, "Update")
+			sendWebmentions(updated)
+		}
+		writeJSON(w, http.StatusOK, apiArticle(updated, true))
+	}).Methods("PUT")
+
+	for action, live := range map[string]bool{
+		"publish":   true,
+		"unpublish": false,
+	} {
+		action, live := action, live
+		api.HandleFunc("/articles/{id:[0-9]+}/"+action, func(w http.ResponseWriter, r *http.Request) {
+			c, ok := requireAPIPerm(w, r, db, dnews.ScopeWriteArticles, dnews.PermWriteArticles)
+			if !ok {
+				return
+			}
+			ctx, cancel := dbContext(r)
+			defer cancel()
+
+			a, err := dnews.GetArticleByIDContext(ctx, db, pathID(r))
+			if err != nil {
+				apiError(w, r, err)
+				return
+			}
+			if !canEditArticle(c, a) {
+				apiError(w, r, dnews.NewError(dnews.Forbidden, nil, "Only editors with a token that has the admin scope can %s other people's articles", action))
+				return
+			}
+			wasLive := a.Live
+			if err := dnews.SetArticleLiveContext(ctx, db, a.ID, live); err != nil {
+				apiError(w, r, err)
+				return
+			}
+			a, err = dnews.GetArticleByIDContext(ctx, db, a.ID)
+			if err != nil {
+				apiError(w, r, err)
+				return
+			}
+
+			reqLog(r).WithField("user_id", c.User.ID).WithField("token_id", c.Token.ID).WithField("article_id", a.ID).Info("article " + action + "ed")
+			a.Verify(a.Author.Pubkey)
+			if a.Live && !wasLive {
+				queueWebhook(r, db, dnews.EventArticlePublished, articleURL(a), apiArticle(a, false))
+			}
+			if a.Live != wasLive {
+				pushFeeds(db)
+			}
+			switch {
+			case a.Live && !wasLive:
+				federateArticle(db, a, "Create")
+				sendWebmentions(a)
+			case !a.Live && wasLive:
+				federateArticle(db, a, "Delete")
+			}
+			writeJSON(w, http.StatusOK, apiArticle(a, true))
+		}).Methods("POST")
+	}
+
+	api.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		page, perPage, err := pageParams(r)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		ts, err := dnews.GetAllTagsContext(ctx, db)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		out := []*dnews.APITag{}
+		start, end := pageBounds(page, perPage, len(ts))
+		for _, t := range ts[start:end] {
+			out = append(out, &dnews.APITag{ID: t.ID, Name: t.Name, Created: t.Created})
+		}
+		writeJSON(w, http.StatusOK, dnews.APIPage{Page: page, PerPage: perPage, Total: len(ts), Data: out})
+	}).Methods("GET")
+
+	api.HandleFunc("/bugs", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		page, perPage, err := pageParams(r)
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+		bs, err := dnews.GetBugsContext(ctx, db, dnews.BugFilter{Status: dnews.BugApproved})
+		if err != nil {
+			apiError(w, r, err)
+			return
+		}
+
+		out := []*dnews.APIBug{}
+		start, end := pageBounds(page, perPage, len(*bs))
+		for _, b := range (*bs)[start:end] {
+			out = append(out, &dnews.APIBug{
+				ID:       b.ID,
+				Name:     b.Name,
+				Descr:    b.Descr,
+				URL:      b.URL,
+				Region:   b.Region,
+				Location: b.Location,
+				Active:   b.Active,
+			})
+		}
+		writeJSON(w, http.StatusOK, dnews.APIPage{Page: page, PerPage: perPage, Total: len(*bs), Data: out})
+	}).Methods("GET")
+}
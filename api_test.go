@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+func TestPageBounds(t *testing.T) {
+	for _, tc := range []struct {
+		page, perPage, n int
+		start, end       int
+	}{
+		{1, 20, 0, 0, 0},
+		{1, 20, 5, 0, 5},
+		{1, 2, 5, 0, 2},
+		{3, 2, 5, 4, 5},
+		{4, 2, 5, 5, 5},
+		{apiMaxPage, apiMaxPerPage, 5, 5, 5},
+		// An overflowing start must not reach the slice expression.
+		{math.MaxInt64/2 + 2, 4, 5, 5, 5},
+	} {
+		start, end := pageBounds(tc.page, tc.perPage, tc.n)
+		if start != tc.start || end != tc.end {
+			t.Errorf("pageBounds(%d, %d, %d) = %d, %d, want %d, %d", tc.page, tc.perPage, tc.n, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+func TestCanReadAndEditArticle(t *testing.T) {
+	author := &dnews.User{ID: 1, Perms: []string{dnews.PermWriteArticles}}
+	editor := &dnews.User{ID: 2, Perms: []string{dnews.PermWriteArticles, dnews.PermEditArticles}}
+	reader := &dnews.User{ID: 3}
+	caller := func(u *dnews.User, scopes ...string) *apiCaller {
+		return &apiCaller{User: u, Token: &dnews.APIToken{UserID: u.ID, Scopes: scopes}}
+	}
+	draft := &dnews.Article{AuthorID: 1}
+	live := &dnews.Article{AuthorID: 1, Live: true}
+
+	for _, tc := range []struct {
+		name       string
+		c          *apiCaller
+		a          *dnews.Article
+		read, edit bool
+	}{
+		{"visitor, live", nil, live, true, false},
+		{"visitor, draft", nil, draft, false, false},
+		{"author without scopes", caller(author), draft, false, false},
+		{"author reading", caller(author, dnews.ScopeRead), draft, true, false},
+		{"author writing", caller(author, dnews.ScopeWriteArticles), live, true, true},
+		{"author writing a draft", caller(author, dnews.ScopeWriteArticles), draft, false, true},
+		{"reader with every scope", caller(reader, dnews.Scopes...), draft, false, false},
+		{"editor reading", caller(editor, dnews.ScopeRead), draft, true, false},
+		{"editor writing without admin", caller(editor, dnews.ScopeRead, dnews.ScopeWriteArticles), draft, true, false},
+		{"editor with admin", caller(editor, dnews.ScopeWriteArticles, dnews.ScopeAdmin), live, true, true},
+		{"author with admin", caller(&dnews.User{ID: 4, Perms: author.Perms}, dnews.Scopes...), draft, false, false},
+	} {
+		if got := canReadArticle(tc.c, tc.a); got != tc.read {
+			t.Errorf("%s: canReadArticle = %v, want %v", tc.name, got, tc.read)
+		}
+		if got := canEditArticle(tc.c, tc.a); got != tc.edit {
+			t.Errorf("%s: canEditArticle = %v, want %v", tc.name, got, tc.edit)
+		}
+	}
+}
+
+func TestResolveTagsOnce(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+
+	tags := map[string]int64{"pf": 1}
+	var lookups []string
+	f.on("from tags where name = $1", func(args []driver.Value) (fakeResult, error) {
+		name := args[0].(string)
+		lookups = append(lookups, name)
+		if id, ok := tags[name]; ok {
+			return fakeResult{rows: [][]driver.Value{{id, time.Now(), name}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	f.on("insert into tags", func(args []driver.Value) (fakeResult, error) {
+		name := args[0].(string)
+		tags[name] = int64(len(tags) + 1)
+		return fakeResult{rows: [][]driver.Value{{tags[name]}}}, nil
+	})
+
+	// As read from "tags: pf, zfs, pf, zfs,"
+	ids, err := dnews.ResolveTagsContext(context.Background(), db, []string{"pf", "zfs", "pf", "zfs", ""}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %v, want %v", ids, want)
+	}
+	if want := []string{"pf", "zfs"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("looked up %q, want %q", lookups, want)
+	}
+	if len(tags) != 2 {
+		t.Errorf("tags are %v", tags)
+	}
+}
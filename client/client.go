@@ -0,0 +1,226 @@
+// Package client talks to the JSON API of a dnews server, as described by
+// the openapi.json it serves under /api/v1.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+// Error is a failed request, decoded from the APIError body when the
+// server sent one
+type Error struct {
+	Status    int
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("%s (%s, request %s)", e.Message, e.Code, e.RequestID)
+}
+
+// ArticlePage is a page of the article listing
+type ArticlePage struct {
+	Page    int                 `json:"page"`
+	PerPage int                 `json:"per_page"`
+	Total   int                 `json:"total"`
+	Data    []*dnews.APIArticle `json:"data"`
+}
+
+// TagPage is a page of the tag listing
+type TagPage struct {
+	Page    int             `json:"page"`
+	PerPage int             `json:"per_page"`
+	Total   int             `json:"total"`
+	Data    []*dnews.APITag `json:"data"`
+}
+
+// BugPage is a page of the user group listing
+type BugPage struct {
+	Page    int             `json:"page"`
+	PerPage int             `json:"per_page"`
+	Total   int             `json:"total"`
+	Data    []*dnews.APIBug `json:"data"`
+}
+
+// Client sends requests to one server with one token
+type Client struct {
+	server string
+	token  string
+	// HTTP is used for every request, it can be replaced before use
+	HTTP *http.Client
+}
+
+// New returns a client for the server at base, e.g. https://daemon.news.
+// Tokens are only sent over HTTPS, plain HTTP is allowed for localhost.
+func New(base, token string) (*Client, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1" || u.Hostname() == "::1"):
+	default:
+		return nil, fmt.Errorf("%q is not an https:// URL", base)
+	}
+
+	return &Client{
+		server: strings.TrimRight(u.String(), "/"),
+		token:  token,
+		HTTP:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Server is the base URL requests are sent to
+func (c *Client) Server() string {
+	return c.server
+}
+
+// do sends in as JSON to path below /api/v1 and decodes the answer into
+// out, either may be nil
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.server+"/api/"+dnews.APIVersion+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		e := &Error{Status: resp.StatusCode}
+		var body dnews.APIError
+		if json.NewDecoder(resp.Body).Decode(&body) == nil {
+			e.Code, e.Message, e.RequestID = body.Error.Code, body.Error.Message, body.RequestID
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// pageQuery is the query of listings, zero values are left to the server
+func pageQuery(page, perPage int) string {
+	v := url.Values{}
+	if page > 0 {
+		v.Set("page", fmt.Sprint(page))
+	}
+	if perPage > 0 {
+		v.Set("per_page", fmt.Sprint(perPage))
+	}
+	if len(v) == 0 {
+		return ""
+	}
+	return "?" + v.Encode()
+}
+
+// Articles lists live articles, newest first, and the drafts the token may
+// read
+func (c *Client) Articles(ctx context.Context, page, perPage int) (*ArticlePage, error) {
+	var p ArticlePage
+	if err := c.do(ctx, "GET", "/articles"+pageQuery(page, perPage), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Article returns the article with the given id, markdown and signature
+// included
+func (c *Client) Article(ctx context.Context, id int) (*dnews.APIArticle, error) {
+	var a dnews.APIArticle
+	if err := c.do(ctx, "GET", fmt.Sprintf("/articles/%d", id), nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// CreateArticle adds an article by the owner of the token
+func (c *Client) CreateArticle(ctx context.Context, in dnews.APIArticleInput) (*dnews.APIArticle, error) {
+	var a dnews.APIArticle
+	if err := c.do(ctx, "POST", "/articles", in, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// UpdateArticle replaces the markdown and signature of the article with the
+// given id
+func (c *Client) UpdateArticle(ctx context.Context, id int, in dnews.APIArticleInput) (*dnews.APIArticle, error) {
+	var a dnews.APIArticle
+	if err := c.do(ctx, "PUT", fmt.Sprintf("/articles/%d", id), in, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Publish makes the article with the given id live
+func (c *Client) Publish(ctx context.Context, id int) (*dnews.APIArticle, error) {
+	var a dnews.APIArticle
+	if err := c.do(ctx, "POST", fmt.Sprintf("/articles/%d/publish", id), nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Unpublish turns the article with the given id back into a draft
+func (c *Client) Unpublish(ctx context.Context, id int) (*dnews.APIArticle, error) {
+	var a dnews.APIArticle
+	if err := c.do(ctx, "POST", fmt.Sprintf("/articles/%d/unpublish", id), nil, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Tags lists the tags
+func (c *Client) Tags(ctx context.Context, page, perPage int) (*TagPage, error) {
+	var p TagPage
+	if err := c.do(ctx, "GET", "/tags"+pageQuery(page, perPage), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Bugs lists the approved user groups
+func (c *Client) Bugs(ctx context.Context, page, perPage int) (*BugPage, error) {
+	var p BugPage
+	if err := c.do(ctx, "GET", "/bugs"+pageQuery(page, perPage), nil, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
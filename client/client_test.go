@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+func TestNew(t *testing.T) {
+	for _, tc := range []struct {
+		base string
+		ok   bool
+	}{
+		{"https://daemon.news", true},
+		{"https://daemon.news/", true},
+		{"http://localhost:8080", true},
+		{"http://127.0.0.1:8080", true},
+		{"http://[::1]:8080", true},
+		{"http://daemon.news", false},
+		{"http://localhost.example.com", false},
+		{"ftp://daemon.news", false},
+		{"daemon.news", false},
+		{"https://daemon.news/%zz", false},
+	} {
+		c, err := New(tc.base, "dn_token")
+		if (err == nil) != tc.ok {
+			t.Errorf("New(%q): got error %v, want ok %v", tc.base, err, tc.ok)
+			continue
+		}
+		if err == nil && strings.HasSuffix(c.Server(), "/") {
+			t.Errorf("New(%q): server %q ends in a slash", tc.base, c.Server())
+		}
+	}
+}
+
+// fakeServer answers like a dnews server, echoing back what it was sent:
+// the article id is taken from the path, the title is the markdown
+func fakeServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer dn_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": {"code": "unauthorized", "message": "This needs an API token"}, "request_id": "r1"}`)
+			return
+		}
+		if r.Header.Get("Accept") != "application/json" {
+			t.Errorf("%s %s: Accept is %q", r.Method, r.URL, r.Header.Get("Accept"))
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/"+dnews.APIVersion)
+		switch {
+		case r.Method == "GET" && path == "/articles":
+			fmt.Fprintf(w, `{"page": 2, "per_page": 5, "total": 6, "data": [{"id": 6, "title": %q}]}`, r.URL.RawQuery)
+		case r.Method == "GET" && path == "/articles/404":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": "not_found", "message": "No article with id 404"}, "request_id": "r2"}`)
+		case r.Method == "POST" && path == "/articles", r.Method == "PUT" && path == "/articles/7":
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("%s %s: Content-Type is %q", r.Method, r.URL, ct)
+			}
+			var in dnews.APIArticleInput
+			if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+				t.Error(err)
+			}
+			status := http.StatusOK
+			if r.Method == "POST" {
+				status = http.StatusCreated
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(dnews.APIArticle{ID: 7, Title: in.Markdown, Signature: in.Signature, Live: in.Live})
+		case r.Method == "POST" && path == "/articles/7/publish":
+			fmt.Fprint(w, `{"id": 7, "live": true}`)
+		case r.Method == "GET" && path == "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprint(w, "not json")
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestRoundTrip(t *testing.T) {
+	ts := fakeServer(t)
+	defer ts.Close()
+	c, err := New(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1), "dn_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	p, err := c.Articles(ctx, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Page != 2 || p.Total != 6 || len(p.Data) != 1 || p.Data[0].Title != "page=2&per_page=5" {
+		t.Errorf("Articles: got %+v", p)
+	}
+	if p, err = c.Articles(ctx, 0, 0); err != nil || p.Data[0].Title != "" {
+		t.Errorf("Articles without paging: got %+v, %v", p, err)
+	}
+
+	in := dnews.APIArticleInput{Markdown: "title: Hello", Signature: "sig", Live: true}
+	a, err := c.CreateArticle(ctx, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != 7 || a.Title != in.Markdown || a.Signature != in.Signature || !a.Live {
+		t.Errorf("CreateArticle: got %+v", a)
+	}
+	if a, err = c.UpdateArticle(ctx, 7, in); err != nil || a.Title != in.Markdown {
+		t.Errorf("UpdateArticle: got %+v, %v", a, err)
+	}
+	if a, err = c.Publish(ctx, 7); err != nil || !a.Live {
+		t.Errorf("Publish: got %+v, %v", a, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ts := fakeServer(t)
+	defer ts.Close()
+	c, err := New(ts.URL, "dn_token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	_, err = c.Article(ctx, 404)
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("got %v, want an *Error", err)
+	}
+	if e.Status != http.StatusNotFound || e.Code != "not_found" || e.RequestID != "r2" {
+		t.Errorf("got %+v", e)
+	}
+	if e.Error() != "No article with id 404 (not_found, request r2)" {
+		t.Errorf("message is %q", e.Error())
+	}
+
+	// Without an error body the status is all there is to say.
+	err = c.do(ctx, "GET", "/teapot", nil, nil)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusTeapot || e.Error() != "418 I'm a teapot" {
+		t.Errorf("got %#v", err)
+	}
+
+	anon, err := New(ts.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = anon.Articles(ctx, 0, 0)
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusUnauthorized || e.Code != "unauthorized" {
+		t.Errorf("without a token: got %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+const bugUsage = `usage:
+  dncli bug list [-region REGION] [-active]
+  dncli bug add -name NAME -descr DESCR -url URL [-feed URL] [-region R] [-location L] [-contact C] [-inactive]
+  dncli bug edit ID [-name NAME] [-descr DESCR] [-url URL] [-feed URL] [-region R] [-location L] [-contact C] [-active|-inactive]
+  dncli bug delete ID`
+
+// bugCommand runs the "dncli bug ..." sub commands
+func bugCommand(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		usageExit(bugUsage)
+	}
+
+	fs := flag.NewFlagSet("bug "+args[0], flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(bugUsage) }
+	name := fs.String("name", "", "Name of the group")
+	descr := fs.String("descr", "", "Description")
+	url := fs.String("url", "", "Web site")
+	feed := fs.String("feed", "", "RSS or Atom feed for the planet")
+	region := fs.String("region", "", "Region, e.g. \"US, Colorado\"")
+	location := fs.String("location", "", "Where the group meets")
+	contact := fs.String("contact", "", "Contact person or address")
+	active := fs.Bool("active", false, "Mark the group active (list: only active groups)")
+	inactive := fs.Bool("inactive", false, "Mark the group inactive")
+
+	var err error
+	switch args[0] {
+	case "list":
+		fs.Parse(args[1:])
+		var bs *dnews.Bugs
+		bs, err = dnews.GetBugs(db, dnews.BugFilter{Region: *region, ActiveOnly: *active})
+		if err == nil {
+			for _, b := range *bs {
+				fmt.Printf("%d\t%s\t%s\t%s\tactive=%t\n", b.ID, b.Name, b.Region, b.URL, b.Active)
+			}
+		}
+	case "add":
+		fs.Parse(args[1:])
+		b := dnews.Bug{
+			Name:     *name,
+			Descr:    *descr,
+			URL:      *url,
+			FeedURL:  *feed,
+			Region:   *region,
+			Location: *location,
+			Contact:  *contact,
+			Active:   !*inactive,
+		}
+		var id *int
+		id, err = dnews.InsertBug(db, b)
+		if err == nil {
+			fmt.Printf("Added user group %s (%d)\n", b.Name, *id)
+		}
+	case "edit":
+		if len(args) < 2 {
+			usageExit(bugUsage)
+		}
+		id := bugID(args[1])
+		fs.Parse(args[2:])
+
+		var b *dnews.Bug
+		b, err = dnews.GetBug(db, id)
+		if err != nil {
+			break
+		}
+		// Only touch the fields given on the command line.
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "name":
+				b.Name = *name
+			case "descr":
+				b.Descr = *descr
+			case "url":
+				b.URL = *url
+			case "feed":
+				b.FeedURL = *feed
+			case "region":
+				b.Region = *region
+			case "location":
+				b.Location = *location
+			case "contact":
+				b.Contact = *contact
+			case "active":
+				b.Active = true
+			case "inactive":
+				b.Active = false
+			}
+		})
+		err = dnews.UpdateBug(db, *b)
+		if err == nil {
+			fmt.Printf("Updated user group %s\n", b.Name)
+		}
+	case "delete":
+		if len(args) != 2 {
+			usageExit(bugUsage)
+		}
+		err = dnews.DeleteBug(db, bugID(args[1]))
+		if err == nil {
+			fmt.Printf("Deleted user group %s\n", args[1])
+		}
+	default:
+		usageExit(bugUsage)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func bugID(s string) int {
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		usageExit(bugUsage)
+	}
+	return id
+}
@@ -15,9 +15,30 @@ func main() {
 	//var htmlOut = flag.Bool("html", false, "Output in HTML")
 	var add = flag.Bool("a", false, "Add aticle to DB")
 	var live = flag.Bool("l", false, "Set article to be live")
+	var createTags = flag.Bool("createtags", false, "Create unknown tags instead of rejecting the article")
+	var config = flag.String("config", defaultConfigPath(), "Path to the configuration of remote mode")
 	flag.Parse()
 
+	// Remote mode only talks to the server API, it needs no database.
+	if flag.Arg(0) == "remote" {
+		remoteCommand(*config, flag.Args()[1:])
+		return
+	}
+
 	db, err := dnews.DBConnect()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "tag":
+		tagCommand(db, flag.Args()[1:])
+		return
+	case "bug":
+		bugCommand(db, flag.Args()[1:])
+		return
+	}
 
 	if *mdFile == "" {
 		fmt.Println("please specify file with -mdfile")
@@ -50,7 +71,7 @@ func main() {
 	a.Live = *live
 
 	if *add {
-		id, err := dnews.InsertArticle(db, a)
+		id, err := dnews.InsertArticle(db, a, *createTags)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/DaemonNews/dnews/client"
+	"github.com/DaemonNews/dnews/src"
+)
+
+const remoteUsage = `usage:
+  dncli remote login -server URL -token TOKEN
+  dncli remote list [-drafts] [-page N]
+  dncli remote add -mdfile FILE -sig FILE [-l] [-createtags]
+  dncli remote update ID -mdfile FILE -sig FILE [-createtags]
+  dncli remote publish ID
+  dncli remote unpublish ID
+  dncli remote verify ID [-pubkey FILE]
+
+The server and token are kept in the file named by -config, DNEWS_SERVER
+and DNEWS_TOKEN override them.`
+
+// remoteConfig is what "dncli remote login" saves
+type remoteConfig struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// defaultConfigPath is where the remote configuration is kept unless
+// -config says otherwise
+func defaultConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".dncli.json")
+}
+
+func loadRemoteConfig(path string) (*remoteConfig, error) {
+	var c remoteConfig
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &c); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if s := os.Getenv("DNEWS_SERVER"); s != "" {
+		c.Server = s
+	}
+	if t := os.Getenv("DNEWS_TOKEN"); t != "" {
+		c.Token = t
+	}
+	if c.Server == "" || c.Token == "" {
+		return nil, fmt.Errorf("no server or token, run \"dncli remote login\" first")
+	}
+	return &c, nil
+}
+
+// saveRemoteConfig writes c to path, readable only by the user as it holds
+// the token
+func saveRemoteConfig(path string, c *remoteConfig) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0600)
+}
+
+// readArticleInput loads the markdown and signature files for add and update
+func readArticleInput(mdFile, sigFile string) dnews.APIArticleInput {
+	if mdFile == "" || sigFile == "" {
+		usageExit(remoteUsage)
+	}
+	return dnews.APIArticleInput{
+		Markdown:  string(dnews.LoadFileOrDie(mdFile)),
+		Signature: string(dnews.LoadFileOrDie(sigFile)),
+	}
+}
+
+func printArticle(a *dnews.APIArticle) {
+	state := "draft"
+	if a.Live {
+		state = "live"
+	}
+	fmt.Printf("%d\t%s\t%s\t%s\t%s\n", a.ID, a.Date.Format("2006-01-02"), state, a.Author, a.Title)
+}
+
+// remoteCommand runs the "dncli remote ..." sub commands
+func remoteCommand(configPath string, args []string) {
+	if len(args) == 0 {
+		usageExit(remoteUsage)
+	}
+
+	fs := flag.NewFlagSet("remote "+args[0], flag.ExitOnError)
+	fs.Usage = func() { fmt.Println(remoteUsage) }
+	server := fs.String("server", "", "URL of the dnews server")
+	token := fs.String("token", "", "API token made on the server's /tokens page")
+	mdFile := fs.String("mdfile", "", "Path to markdown file of the article")
+	sig := fs.String("sig", "", "Path to signature of the markdown file")
+	pub := fs.String("pubkey", "", "Path to public key to verify against instead of trusting the server")
+	live := fs.Bool("l", false, "Set article to be live")
+	createTags := fs.Bool("createtags", false, "Create unknown tags instead of rejecting the article")
+	drafts := fs.Bool("drafts", false, "Only list the drafts of the page")
+	page := fs.Int("page", 1, "Page of the listing")
+
+	ctx := context.Background()
+
+	if args[0] == "login" {
+		fs.Parse(args[1:])
+		if *server == "" || *token == "" {
+			usageExit(remoteUsage)
+		}
+		dc, err := client.New(*server, *token)
+		if err == nil {
+			// Listing drafts needs a valid token.
+			_, err = dc.Articles(ctx, 1, 1)
+		}
+		if err == nil {
+			err = saveRemoteConfig(configPath, &remoteConfig{Server: dc.Server(), Token: *token})
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Logged in to %s, saved to %s\n", dc.Server(), configPath)
+		return
+	}
+
+	var dc *client.Client
+	c, err := loadRemoteConfig(configPath)
+	if err == nil {
+		dc, err = client.New(c.Server, c.Token)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		fs.Parse(args[1:])
+		var p *client.ArticlePage
+		p, err = dc.Articles(ctx, *page, 100)
+		if err == nil {
+			for _, a := range p.Data {
+				if !*drafts || !a.Live {
+					printArticle(a)
+				}
+			}
+			if p.Page*p.PerPage < p.Total {
+				fmt.Printf("(page %d, %d articles, use -page %d for more)\n", p.Page, p.Total, p.Page+1)
+			}
+		}
+	case "add":
+		fs.Parse(args[1:])
+		in := readArticleInput(*mdFile, *sig)
+		in.Live, in.CreateTags = *live, *createTags
+		var a *dnews.APIArticle
+		a, err = dc.CreateArticle(ctx, in)
+		if err == nil {
+			fmt.Printf("Added article! (%d)\n", a.ID)
+		}
+	case "update":
+		id := remoteID(args)
+		fs.Parse(args[2:])
+		in := readArticleInput(*mdFile, *sig)
+		in.CreateTags = *createTags
+		var a *dnews.APIArticle
+		a, err = dc.UpdateArticle(ctx, id, in)
+		if err == nil {
+			fmt.Printf("Updated article %d\n", a.ID)
+		}
+	case "publish":
+		id := remoteID(args)
+		_, err = dc.Publish(ctx, id)
+		if err == nil {
+			fmt.Printf("Article %d published\n", id)
+		}
+	case "unpublish":
+		id := remoteID(args)
+		_, err = dc.Unpublish(ctx, id)
+		if err == nil {
+			fmt.Printf("Article %d unpublished\n", id)
+		}
+	case "verify":
+		id := remoteID(args)
+		fs.Parse(args[2:])
+		var a *dnews.APIArticle
+		a, err = dc.Article(ctx, id)
+		if err == nil {
+			err = verifyRemote(a, *pub)
+		}
+	default:
+		usageExit(remoteUsage)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// verifyRemote checks the signature of a against the key in pubFile, or
+// reports what the server found when there is none
+func verifyRemote(a *dnews.APIArticle, pubFile string) error {
+	if pubFile == "" {
+		if !a.Signed {
+			return fmt.Errorf("Signature NOT ok! (checked by the server)")
+		}
+		fmt.Println("Signature OK (checked by the server)")
+		return nil
+	}
+
+	var art dnews.Article
+	if err := art.Load(strings.NewReader(a.Markdown)); err != nil {
+		return err
+	}
+	art.Signature = []byte(a.Signature)
+	ok, err := art.Verify(dnews.LoadFileOrDie(pubFile))
+	if err != nil {
+		return err
+	}
+	if !*ok {
+		return fmt.Errorf("Signature NOT ok!")
+	}
+	fmt.Println("Signature OK")
+	return nil
+}
+
+func remoteID(args []string) int {
+	if len(args) < 2 {
+		usageExit(remoteUsage)
+	}
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		usageExit(remoteUsage)
+	}
+	return id
+}
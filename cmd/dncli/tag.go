@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+const tagUsage = `usage:
+  dncli tag list
+  dncli tag add NAME
+  dncli tag rename OLD NEW
+  dncli tag delete NAME
+  dncli tag merge FROM INTO`
+
+// tagCommand runs the "dncli tag ..." sub commands
+func tagCommand(db *sql.DB, args []string) {
+	if len(args) == 0 {
+		usageExit(tagUsage)
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		var ts dnews.Tags
+		ts, err = dnews.GetAllTags(db)
+		for _, t := range ts {
+			fmt.Printf("%d\t%s\n", t.ID, t.Name)
+		}
+	case "add":
+		needArgs(args, 2, tagUsage)
+		var id *int
+		id, err = dnews.InsertTag(db, args[1])
+		if err == nil {
+			fmt.Printf("Added tag %s (%d)\n", args[1], *id)
+		}
+	case "rename":
+		needArgs(args, 3, tagUsage)
+		t := lookupTag(db, args[1])
+		err = dnews.RenameTag(db, t.ID, args[2])
+		if err == nil {
+			fmt.Printf("Renamed %s to %s\n", args[1], args[2])
+		}
+	case "delete":
+		needArgs(args, 2, tagUsage)
+		t := lookupTag(db, args[1])
+		err = dnews.DeleteTag(db, t.ID)
+		if err == nil {
+			fmt.Printf("Deleted tag %s\n", args[1])
+		}
+	case "merge":
+		needArgs(args, 3, tagUsage)
+		from := lookupTag(db, args[1])
+		into := lookupTag(db, args[2])
+		err = dnews.MergeTags(db, from.ID, into.ID)
+		if err == nil {
+			fmt.Printf("Merged %s into %s\n", args[1], args[2])
+		}
+	default:
+		usageExit(tagUsage)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func lookupTag(db *sql.DB, name string) *dnews.Tag {
+	t, err := dnews.GetTagByName(db, name)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return t
+}
+
+func needArgs(args []string, n int, usage string) {
+	if len(args) != n {
+		usageExit(usage)
+	}
+}
+
+func usageExit(usage string) {
+	fmt.Println(usage)
+	os.Exit(1)
+}
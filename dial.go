@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// privateNets are the networks remote URLs may not point into: this host,
+// private and shared address space, link-local and other special ranges
+var privateNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/3",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// NAT64 (RFC 6052) and 6to4 (RFC 3056) addresses are forwarded to the IPv4
+// address they embed, in the last four bytes and in bytes 2 to 5.
+var (
+	nat64Net     = parseCIDRs("64:ff9b::/96")[0]
+	sixToFourNet = parseCIDRs("2002::/16")[0]
+)
+
+// allowPrivateAddrs lets publicTransport connect anywhere when it is 1.
+// Tests set it to talk to httptest servers on the loopback, while requests
+// of earlier tests may still be dialing, so it is read atomically.
+var allowPrivateAddrs int32
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// publicIP reports whether ip is an address on the internet
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	switch {
+	case nat64Net.Contains(ip):
+		return publicIP(ip[12:16])
+	case sixToFourNet.Contains(ip):
+		return publicIP(ip[2:6])
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic is the Control function of the dialer of publicTransport. It
+// runs after the host name is resolved, so a name pointing at a private
+// address is refused as well.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	if atomic.LoadInt32(&allowPrivateAddrs) == 1 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// publicTransport is used for every request to a URL someone else chose,
+// Webmention sources, ActivityPub actors, WebSub callbacks and user group
+// feeds. It does not go through a proxy, which would dial on its behalf.
+var publicTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublic,
+	}).DialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
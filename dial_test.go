@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"224.0.0.1", false},
+		{"64:ff9b::5db8:d822", true},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b::c0a8:101", false},
+		{"2002:5db8:d822::1", true},
+		{"2002:7f00:1::1", false},
+		{"2002:a00:1::", false},
+		{"2002:a9fe:a9fe:1::1", false},
+	} {
+		if got := publicIP(net.ParseIP(tc.ip)); got != tc.public {
+			t.Errorf("publicIP(%s) = %v, want %v", tc.ip, got, tc.public)
+		}
+	}
+}
+
+func TestPublicTransportRefusesLoopback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request reached the server")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Transport: publicTransport}
+	resp, err := client.Get(ts.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("a loopback address was dialed")
+	}
+}
+
+// allowLoopback lets publicTransport reach httptest servers until the
+// returned function is called
+func allowLoopback() func() {
+	atomic.StoreInt32(&allowPrivateAddrs, 1)
+	return func() { atomic.StoreInt32(&allowPrivateAddrs, 0) }
+}
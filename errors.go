@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/csrf"
+)
+
+// errorPages maps each kind of error to its status and template
+var errorPages = map[dnews.Kind]struct {
+	status   int
+	template string
+	message  string
+}{
+	dnews.NotFound:     {http.StatusNotFound, "not_found.html", "The page you are looking for does not exist."},
+	dnews.Forbidden:    {http.StatusForbidden, "perm_denied.html", "You are not allowed to do that."},
+	dnews.Invalid:      {http.StatusBadRequest, "bad_request.html", "The request could not be understood."},
+	dnews.Limited:      {http.StatusTooManyRequests, "too_many.html", "Too many requests, please try again later."},
+	dnews.Unauthorized: {http.StatusUnauthorized, "perm_denied.html", "Please log in first."},
+	dnews.Internal:     {http.StatusInternalServerError, "server_error.html", "Something went wrong on our end."},
+}
+
+// errorPage is the single place handlers report errors. It logs err with
+// the request id and renders the themed page matching its kind, without
+// exposing internal details to the visitor.
+func errorPage(w http.ResponseWriter, r *http.Request, err error) {
+	kind := dnews.KindOf(err)
+	page, ok := errorPages[kind]
+	if !ok {
+		page = errorPages[dnews.Internal]
+	}
+
+	l := reqLog(r).WithError(err).WithField("status", page.status)
+	if kind == dnews.Internal {
+		l.Error("internal server error")
+	} else {
+		l.Debug("request failed")
+	}
+
+	data, uerr := grabUser(w, r)
+	if uerr != nil {
+		data = &response{User: &dnews.User{}}
+	}
+	data.Error = dnews.MessageOf(err)
+	if data.Error == "" {
+		data.Error = page.message
+	}
+	data.RequestID = dnews.RequestID(r.Context())
+	data.CSRF = map[string]interface{}{
+		csrf.TemplateTag: csrf.TemplateField(r),
+	}
+
+	// Render into a buffer first so a broken template still yields a
+	// response with the right status.
+	var buf bytes.Buffer
+	if terr := templ.ExecuteTemplate(&buf, page.template, data); terr != nil {
+		reqLog(r).WithError(terr).Error("rendering error page")
+		http.Error(w, http.StatusText(page.status), page.status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.status)
+	buf.WriteTo(w)
+}
+
+// notFoundHandler is used for URLs no route matches
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	errorPage(w, r, dnews.NewError(dnews.NotFound, nil, "The page you are looking for does not exist."))
+}
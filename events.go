@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// eventHorizon is how far ahead /events looks
+const eventHorizon = 90 * 24 * time.Hour
+
+// icalHost is used to build stable event UIDs in the calendar feeds
+const icalHost = "daemon.news"
+
+// eventFromForm copies the event fields of the posted form into e. Times
+// are entered as wall clock times in the time zone of the event.
+func eventFromForm(r *http.Request, e *dnews.Event) error {
+	e.Kind = r.FormValue("kind")
+	e.Title = r.FormValue("title")
+	e.Descr = r.FormValue("descr")
+	e.Location = r.FormValue("location")
+	e.URL = r.FormValue("url")
+	e.Recur = r.FormValue("recur")
+	e.BugID, _ = strconv.Atoi(r.FormValue("bugid"))
+
+	e.TZ = strings.TrimSpace(r.FormValue("tz"))
+	if e.TZ == "" {
+		e.TZ = "UTC"
+	}
+	loc, err := time.LoadLocation(e.TZ)
+	if err != nil {
+		return dnews.NewError(dnews.Invalid, err, "Unknown time zone %q", e.TZ)
+	}
+
+	e.Starts, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue("starts"), loc)
+	if err != nil {
+		return dnews.NewError(dnews.Invalid, err, "The start needs a date and time")
+	}
+	e.Ends, err = time.ParseInLocation("2006-01-02T15:04", r.FormValue("ends"), loc)
+	if err != nil {
+		return dnews.NewError(dnews.Invalid, err, "The end needs a date and time")
+	}
+
+	e.RecurUntil = time.Time{}
+	if v := r.FormValue("recur_until"); v != "" {
+		until, err := time.ParseInLocation("2006-01-02", v, loc)
+		if err != nil {
+			return dnews.NewError(dnews.Invalid, err, "%q is not a valid date", v)
+		}
+		// Include meetings on the last day.
+		e.RecurUntil = until.AddDate(0, 0, 1).Add(-time.Second)
+	}
+
+	return nil
+}
+
+// writeICal sends es as a calendar file
+func writeICal(w http.ResponseWriter, r *http.Request, es dnews.Events, name string) {
+	var buf bytes.Buffer
+	if err := es.ICal(&buf, name, icalHost); err != nil {
+		errorPage(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+func registerEvents(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		es, err := dnews.GetEventsContext(ctx, db, dnews.EventFilter{PublicOnly: true})
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		now := time.Now()
+		data.Data = es.Upcoming(now, now.Add(eventHorizon))
+		renderTemplate(w, r, data, "events.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/events.ics", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		es, err := dnews.GetEventsContext(ctx, db, dnews.EventFilter{PublicOnly: true})
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		writeICal(w, r, es, "Daemon.News BSD events")
+	}).Methods("GET")
+
+	router.HandleFunc("/events/bug/{id:[0-9]+}.ics", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		b, err := dnews.GetBugContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if b.Status != dnews.BugApproved || !b.Active {
+			errorPage(w, r, dnews.NewError(dnews.NotFound, nil, "No user group with id %d", b.ID))
+			return
+		}
+
+		es, err := dnews.GetEventsContext(ctx, db, dnews.EventFilter{BugID: b.ID})
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		writeICal(w, r, es, b.Name)
+	}).Methods("GET")
+}
+
+// eventForm is the data for event_edit.html. Event is nil when adding.
+type eventForm struct {
+	Event *dnews.Event
+	Bugs  *dnews.Bugs
+}
+
+func registerEventAdmin(router *mux.Router, db *sql.DB) {
+	// renderForm shows event_edit.html with the groups an event can
+	// belong to
+	renderForm := func(w http.ResponseWriter, r *http.Request, e *dnews.Event) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		bs, err := dnews.GetBugsContext(ctx, db, dnews.BugFilter{Status: dnews.BugApproved})
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = eventForm{Event: e, Bugs: bs}
+		renderTemplate(w, r, data, "event_edit.html")
+	}
+
+	router.HandleFunc("/event/add", guard(dnews.PermManageEvents, func(w http.ResponseWriter, r *http.Request) {
+		renderForm(w, r, nil)
+	})).Methods("GET")
+
+	router.HandleFunc("/event/add", guard(dnews.PermManageEvents, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		var e dnews.Event
+		if err := eventFromForm(r, &e); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		id, err := dnews.InsertEventContext(ctx, db, e)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("event_id", *id).Info("event added")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/event/edit/{id:[0-9]+}", guard(dnews.PermManageEvents, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		e, err := dnews.GetEventContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		renderForm(w, r, e)
+	})).Methods("GET")
+
+	router.HandleFunc("/event/edit/{id:[0-9]+}", guard(dnews.PermManageEvents, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		e, err := dnews.GetEventContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		if err := eventFromForm(r, e); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if err := dnews.UpdateEventContext(ctx, db, *e); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("event_id", e.ID).Info("event updated")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/event/remove/{id:[0-9]+}", guard(dnews.PermManageEvents, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		e, err := dnews.GetEventContext(ctx, db, pathID(r))
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = confirmation{
+			Title:   "Remove event",
+			Message: fmt.Sprintf("Really remove %s and all of its repetitions?", e.Title),
+			Action:  fmt.Sprintf("/event/remove/%d", e.ID),
+			Cancel:  "/admin",
+		}
+		renderTemplate(w, r, data, "confirm.html")
+	})).Methods("GET")
+
+	router.HandleFunc("/event/remove/{id:[0-9]+}", guard(dnews.PermManageEvents, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.DeleteEventContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("event_id", id).Info("event removed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeResult is the answer of a fakeDB to one query: rows for queries,
+// affected for statements
+type fakeResult struct {
+	rows     [][]driver.Value
+	affected int64
+}
+
+// fakeQuery answers queries whose text contains match
+type fakeQuery struct {
+	match  string
+	answer func(args []driver.Value) (fakeResult, error)
+}
+
+// fakeDB is a database/sql driver for handler tests. Every query is
+// answered by the first handler whose match it contains, queries nobody
+// handles fail the test.
+type fakeDB struct {
+	sync.Mutex
+	t       *testing.T
+	queries []fakeQuery
+	seen    []string
+}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = map[string]*fakeDB{}
+)
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// newFakeDB returns a fake and a *sql.DB talking to it, named after the
+// test
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	f := &fakeDB{t: t}
+	fakeDBsMu.Lock()
+	fakeDBs[t.Name()] = f
+	fakeDBsMu.Unlock()
+
+	db, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, db
+}
+
+// on answers queries containing match with answer
+func (f *fakeDB) on(match string, answer func(args []driver.Value) (fakeResult, error)) {
+	f.Lock()
+	defer f.Unlock()
+	f.queries = append(f.queries, fakeQuery{match: match, answer: answer})
+}
+
+// rows answers queries containing match with rows whatever the arguments
+func (f *fakeDB) rows(match string, rows ...[]driver.Value) {
+	f.on(match, func([]driver.Value) (fakeResult, error) {
+		return fakeResult{rows: rows, affected: int64(len(rows))}, nil
+	})
+}
+
+// ran reports whether a query containing match was run
+func (f *fakeDB) ran(match string) bool {
+	f.Lock()
+	defer f.Unlock()
+	for _, q := range f.seen {
+		if strings.Contains(q, match) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) answer(query string, args []driver.NamedValue) (fakeResult, error) {
+	f.Lock()
+	f.seen = append(f.seen, query)
+	var answer func([]driver.Value) (fakeResult, error)
+	for _, q := range f.queries {
+		if strings.Contains(query, q.match) {
+			answer = q.answer
+			break
+		}
+	}
+	f.Unlock()
+
+	if answer == nil {
+		f.t.Errorf("unexpected query: %s", strings.Join(strings.Fields(query), " "))
+		return fakeResult{}, fmt.Errorf("unexpected query")
+	}
+	vs := make([]driver.Value, len(args))
+	for i, a := range args {
+		vs[i] = a.Value
+	}
+	return answer(vs)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	f, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return &fakeConn{f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fakedb does not prepare statements")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rows: res.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+// CheckNamedValue converts arguments the way database/sql does for drivers
+// that do not care, so answers see int64 for every int
+func (c *fakeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	var err error
+	nv.Value, err = driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	return err
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	rows [][]driver.Value
+	i    int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	cols := make([]string, len(r.rows[0]))
+	for i := range cols {
+		cols[i] = fmt.Sprintf("c%d", i)
+	}
+	return cols
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
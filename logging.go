@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/sirupsen/logrus"
+)
+
+var logger = dnews.Log
+
+// setupLogging applies the -loglevel and -logformat flags
+func setupLogging(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(lvl)
+
+	switch format {
+	case "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	case "logfmt":
+		logger.Formatter = &logrus.TextFormatter{DisableColors: true, FullTimestamp: true}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts ids handed to us by a proxy as long as they are
+// short and printable, so they are safe to log and echo back.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// reqLog returns a log entry tagged with the id of r
+func reqLog(r *http.Request) *logrus.Entry {
+	return dnews.Logger(r.Context())
+}
+
+// logRequests assigns every request an id, stores it in the request
+// context and writes one access log entry per request.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(dnews.WithRequestID(r.Context(), id))
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		h.ServeHTTP(rec, r)
+
+		reqLog(r).WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.RequestURI(),
+			"status":   rec.code,
+			"bytes":    rec.bytes,
+			"duration": time.Since(start).String(),
+			"remote":   r.RemoteAddr,
+			"agent":    r.UserAgent(),
+		}).Info("request")
+	})
+}
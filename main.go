@@ -1,21 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
 	"encoding/gob"
 	"flag"
 	"fmt"
 	"html/template"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/DaemonNews/dnews/src"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/feeds"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
@@ -25,15 +30,42 @@ var cookieSecret string
 var crsfSecret string
 var jwtSecret string
 var templ *template.Template
-var store *sessions.CookieStore
+var store *dbStore
 var listen string
 var version string
+var readTimeout time.Duration
+var writeTimeout time.Duration
+var idleTimeout time.Duration
+var shutdownTimeout time.Duration
+var dbTimeout time.Duration
+var tlsCert string
+var tlsKey string
+var redirectListen string
+var metricsListen string
+var hstsMaxAge time.Duration
+var certCheck time.Duration
+var logLevel string
+var trustProxy bool
+var logFormat string
+var planetInterval time.Duration
+var baseURL string
+var mailFrom string
+var smtpAddr string
+var smtpUser string
+var smtpPass string
+var mailDir string
+var require2FA bool
+var checkAPI bool
+var printVersion bool
+var webhookInterval time.Duration
+var apName string
 
 type response struct {
-	Error string
-	User  interface{}
-	Data  interface{}
-	CSRF  map[string]interface{}
+	Error     string
+	RequestID string
+	User      interface{}
+	Data      interface{}
+	CSRF      map[string]interface{}
 }
 
 var funcMap = template.FuncMap{
@@ -56,39 +88,92 @@ var funcMap = template.FuncMap{
 }
 
 func init() {
-	var err error
 	flag.BoolVar(&insecure, "i", false, "Insecure mode")
-	flag.StringVar(&cookieSecret, "cookie", "something-very-secret", "Secret to use for cookie store")
+	flag.StringVar(&cookieSecret, "cookie", "something-very-secret", "Secret to sign session cookies with")
 	flag.StringVar(&crsfSecret, "crsf", "32-byte-long-auth-key", "Secret to use for cookie store")
-	flag.StringVar(&jwtSecret, "jwt", "super secret neat", "Secret to use for jwt")
+	flag.StringVar(&jwtSecret, "jwt", defaultJWTSecret, "Secret to use for jwt")
 	flag.StringVar(&listen, "http", ":8080", "Listen on")
-	ver := flag.Bool("v", false, "Print version and exit")
+	flag.DurationVar(&readTimeout, "readtimeout", 10*time.Second, "Maximum duration for reading a request")
+	flag.DurationVar(&writeTimeout, "writetimeout", 30*time.Second, "Maximum duration for writing a response")
+	flag.DurationVar(&idleTimeout, "idletimeout", 120*time.Second, "Maximum duration to keep idle connections open")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", 30*time.Second, "Time to wait for in-flight requests on shutdown")
+	flag.DurationVar(&dbTimeout, "dbtimeout", 5*time.Second, "Deadline for database calls made by a request")
+	flag.StringVar(&tlsCert, "tlscert", "", "Path to TLS certificate, enables HTTPS")
+	flag.StringVar(&tlsKey, "tlskey", "", "Path to TLS private key")
+	flag.StringVar(&metricsListen, "metricsaddr", "127.0.0.1:9180", "Serve Prometheus metrics on this address, empty to disable")
+	flag.StringVar(&redirectListen, "redirect", "", "Listen for plain HTTP on this address and redirect to HTTPS")
+	flag.DurationVar(&hstsMaxAge, "hsts", 365*24*time.Hour, "HSTS max-age sent over HTTPS, 0 to disable")
+	flag.DurationVar(&certCheck, "certcheck", time.Minute, "How often to check the TLS certificate for changes")
+	flag.BoolVar(&trustProxy, "trustproxy", false, "Take client addresses from X-Forwarded-For")
+	flag.StringVar(&logLevel, "loglevel", "info", "Log level: debug, info, warn or error")
+	flag.StringVar(&logFormat, "logformat", "logfmt", "Log format: logfmt or json")
+	flag.DurationVar(&planetInterval, "planet", time.Hour, "How often to fetch user group feeds, 0 to disable")
+	flag.DurationVar(&webhookInterval, "webhooks", 10*time.Second, "How often to send queued webhook deliveries, 0 to disable")
+	flag.StringVar(&apName, "apname", "news", "ActivityPub name of the site, followed as name@host")
+	flag.StringVar(&baseURL, "baseurl", "https://daemon.news", "Public URL of the site, used for links in mail")
+	flag.StringVar(&mailFrom, "mailfrom", "Daemon.News <daemons@daemon.news>", "Sender of mail from the site")
+	flag.StringVar(&smtpAddr, "smtp", "", "SMTP server (host:port) to send mail through")
+	flag.StringVar(&smtpUser, "smtpuser", "", "SMTP user name")
+	flag.StringVar(&smtpPass, "smtppass", "", "SMTP password")
+	flag.StringVar(&mailDir, "maildir", "", "Write mail to files in this directory instead of sending it")
+	flag.BoolVar(&require2FA, "require2fa", false, "Require editors and administrators to use two-factor authentication")
+	flag.BoolVar(&checkAPI, "checkapi", false, "Check that "+openAPIFile+" matches the API and exit")
+	flag.BoolVar(&printVersion, "v", false, "Print version and exit")
+
+	gob.Register(&dnews.User{})
+}
 
+// setup parses the command line and loads the templates and the API
+// description. It is called by main rather than init, so tests can build
+// the handlers without it.
+func setup() {
+	var err error
 	flag.Parse()
 
-	if *ver {
+	if printVersion {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
-	store = sessions.NewCookieStore([]byte(cookieSecret))
+	if err := setupLogging(logLevel, logFormat); err != nil {
+		logger.Fatal(err)
+	}
+	setupMail()
+
+	if jwtSecret == defaultJWTSecret && !insecure && !checkAPI {
+		logger.Fatal("-jwt is the public default, set a secret of your own or run with -i")
+	}
+
 	templ, err = template.New("dnews").Funcs(funcMap).ParseGlob("templates/*.html")
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 
-	gob.Register(&dnews.User{})
+	openAPI, err = ioutil.ReadFile(openAPIFile)
+	if err != nil {
+		logger.WithError(err).Warn("serving no API description")
+	}
 }
 
 func renderTemplate(w http.ResponseWriter, r *http.Request, d *response, t string) {
 	d.CSRF = map[string]interface{}{
 		csrf.TemplateTag: csrf.TemplateField(r),
 	}
-	err := templ.ExecuteTemplate(w, t, d)
+	var buf bytes.Buffer
+	start := time.Now()
+	err := templ.ExecuteTemplate(&buf, t, d)
+	renderDuration.WithLabelValues(t).Observe(time.Since(start).Seconds())
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		errorPage(w, r, err)
 		return
 	}
+	buf.WriteTo(w)
+}
+
+// dbContext returns a context for database calls made on behalf of r. It is
+// cancelled when the client goes away or after dbTimeout, whichever is first.
+func dbContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), dbTimeout)
 }
 
 func grabUser(w http.ResponseWriter, r *http.Request) (*response, error) {
@@ -103,8 +188,6 @@ func grabUser(w http.ResponseWriter, r *http.Request) (*response, error) {
 
 	if !ok {
 		uVal = &dnews.User{}
-		session.Values["user"] = &uVal
-		session.Save(r, w)
 	}
 
 	var data = response{}
@@ -112,14 +195,76 @@ func grabUser(w http.ResponseWriter, r *http.Request) (*response, error) {
 	return &data, nil
 }
 
+// renderFeed returns feed as "atom" or "rss"
+func renderFeed(feed *feeds.Feed, feedType string) (string, error) {
+	switch feedType {
+	case "atom":
+		return feed.ToAtom()
+	case "rss":
+		return feed.ToRss()
+	}
+	return "", dnews.NewError(dnews.NotFound, nil, "Unknown feed type %q", feedType)
+}
+
+// writeFeed sends feed as "atom" or "rss"
+func writeFeed(w http.ResponseWriter, r *http.Request, feed *feeds.Feed, feedType string) {
+	out, err := renderFeed(feed, feedType)
+	if err != nil {
+		errorPage(w, r, err)
+		return
+	}
+	fmt.Fprint(w, out)
+}
+
+// articleFeed is the feed of the newest articles
+func articleFeed(ctx context.Context, db *sql.DB) (*feeds.Feed, error) {
+	now := time.Now()
+	feed := &feeds.Feed{
+		Title:       "Daemon.News",
+		Link:        &feeds.Link{Href: "https://daemon.news"},
+		Description: "*BSD News and Advocacy",
+		Author:      &feeds.Author{Name: "The Daemon News Team", Email: "daemons@daemon.news"},
+		Created:     now,
+		Copyright:   "This work is copyright © Daemon.News",
+	}
+
+	a, err := dnews.GetNArticlesContext(ctx, db, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	feed.Items = []*feeds.Item{}
+
+	for _, article := range a {
+		f := feeds.Item{}
+		f.Title = article.Title
+		f.Description = string(article.Body)
+		f.Link = &feeds.Link{Href: fmt.Sprintf("http://daemon.news/article/%s", article.Slug)}
+		f.Author = &feeds.Author{Name: article.Author.FName, Email: article.Author.Email}
+		f.Created = article.Date
+
+		feed.Items = append(feed.Items, &f)
+	}
+
+	return feed, nil
+}
+
 func main() {
+	setup()
+
 	db, err := dnews.DBConnect()
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal(err)
 	}
 	defer db.Close()
+	registerDBMetrics(db)
+
+	useTLS := tlsCert != "" || tlsKey != ""
+	store = newDBStore(db, useTLS, []byte(cookieSecret))
 
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	registerHealth(router, db)
 	router.PathPrefix("/public/").Handler(
 		http.StripPrefix("/public/",
 			http.FileServer(http.Dir("public"))))
@@ -127,7 +272,7 @@ func main() {
 	router.HandleFunc("/feeds", func(w http.ResponseWriter, r *http.Request) {
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 		renderTemplate(w, r, data, "feeds.html")
@@ -135,7 +280,7 @@ func main() {
 	router.HandleFunc("/ml", func(w http.ResponseWriter, r *http.Request) {
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 		renderTemplate(w, r, data, "ml.html")
@@ -143,22 +288,25 @@ func main() {
 	router.HandleFunc("/archives", func(w http.ResponseWriter, r *http.Request) {
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 		renderTemplate(w, r, data, "archives.html")
 	})
 	router.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		query := r.FormValue("search")
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Can't get user: %s", err.Error()), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		a, err := dnews.SearchArticles(db, query, 100)
+		a, err := dnews.SearchArticlesContext(ctx, db, query, 100)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
@@ -168,90 +316,72 @@ func main() {
 	})
 
 	router.HandleFunc("/feed/{type}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		vars := mux.Vars(r)
 		feedType := vars["type"]
-		now := time.Now()
-		feed := &feeds.Feed{
-			Title:       "Daemon.News",
-			Link:        &feeds.Link{Href: "https://daemon.news"},
-			Description: "*BSD News and Advocacy",
-			Author:      &feeds.Author{Name: "The Daemon News Team", Email: "daemons@daemon.news"},
-			Created:     now,
-			Copyright:   "This work is copyright © Daemon.News",
-		}
-
-		a, err := dnews.GetNArticles(db, 10)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if feedType != "atom" && feedType != "rss" {
+			errorPage(w, r, dnews.NewError(dnews.NotFound, nil, "Unknown feed type %q", feedType))
 			return
 		}
 
-		feed.Items = []*feeds.Item{}
-
-		for _, article := range a {
-			f := feeds.Item{}
-			f.Title = article.Title
-			f.Description = string(article.Body)
-			f.Link = &feeds.Link{Href: fmt.Sprintf("http://daemon.news/article/%s", article.Slug)}
-			f.Author = &feeds.Author{Name: article.Author.FName, Email: article.Author.Email}
-			f.Created = article.Date
-
-			feed.Items = append(feed.Items, &f)
-		}
-
-		switch feedType {
-		case "atom":
-			atom, err := feed.ToAtom()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprintf(w, atom)
-		case "rss":
-			rss, err := feed.ToRss()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			fmt.Fprintf(w, rss)
-		default:
-			http.Error(w, "Invalid feed type!", http.StatusInternalServerError)
+		feed, err := articleFeed(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
 			return
 		}
 
+		webSubLinks(w, feedTopic(feedType))
+		writeFeed(w, r, feed, feedType)
 	})
 	router.HandleFunc("/tag/{tag:[a-zA-Z0-9-]+}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		vars := mux.Vars(r)
 		tag := vars["tag"]
 
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		articles, err := dnews.GetArticlesByTag(db, tag)
+		articles, err := dnews.GetArticlesByTagContext(ctx, db, tag)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
 		data.Data = articles
 		renderTemplate(w, r, data, "index.html")
 
-	})
+	}).Methods("GET")
 	router.HandleFunc("/article/{slug:[a-zA-Z0-9-]+}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		vars := mux.Vars(r)
 		slug := vars["slug"]
 
-		article, err := dnews.GetArticle(db, slug)
+		article, err := dnews.GetArticleContext(ctx, db, slug)
+		if err == nil && !canViewArticle(r, article) {
+			err = dnews.NewError(dnews.NotFound, nil, "No article named %q", slug)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
+		article.Mentions, err = dnews.GetWebmentionsContext(ctx, db, dnews.WebmentionFilter{ArticleID: article.ID, Status: dnews.MentionApproved})
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		webmentionLink(w)
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 		data.Data = article
@@ -259,20 +389,29 @@ func main() {
 
 	})
 	router.HandleFunc("/article/raw/{slug:[a-zA-Z0-9-]+}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		vars := mux.Vars(r)
 		slug := vars["slug"]
 
-		article, err := dnews.GetRawArticle(db, slug)
+		article, err := dnews.GetRawArticleContext(ctx, db, slug)
+		if err == nil && !canViewArticle(r, article) {
+			err = dnews.NewError(dnews.NotFound, nil, "No article named %q", slug)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 		fmt.Fprintf(w, "%s", article.Body)
 	})
 	router.HandleFunc("/login/post", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		session, err := store.Get(r, "session-name")
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
@@ -281,175 +420,212 @@ func main() {
 
 		if user == "" && passwd == "" {
 			http.Redirect(w, r, "/", http.StatusFound)
-		} else {
-			u, err := dnews.Auth(db, user, passwd)
+			return
+		}
 
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		// Unknown names back off like real accounts do in Auth, so
+		// lockouts do not reveal which accounts exist.
+		ip := clientIP(r)
+		name := strings.ToLower(user)
+		if loginIPs.Wait(ip) > 0 || loginNames.Wait(name) > 0 {
+			loginAttempts.WithLabelValues("locked").Inc()
+			errorPage(w, r, dnews.ErrLockedOut)
+			return
+		}
 
-			if u.Authed {
-				session.Values["user"] = u
-				session.Save(r, w)
-				http.Redirect(w, r, "/", http.StatusFound)
+		u, err := dnews.AuthContext(ctx, db, user, passwd)
+		if err != nil {
+			switch dnews.KindOf(err) {
+			case dnews.Forbidden:
+				loginAttempts.WithLabelValues("failed").Inc()
+				loginIPs.Fail(ip)
+				loginNames.Fail(name)
+				reqLog(r).WithField("ip", ip).WithField("user", user).Info("failed login")
+			case dnews.Limited:
+				loginAttempts.WithLabelValues("locked").Inc()
 			}
+			errorPage(w, r, err)
+			return
+		}
+
+		if err := store.Renew(r, session); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		// The backoff of the name is kept until the code is right too,
+		// so guessing codes is as slow as guessing passwords.
+		if u.TOTP {
+			startSecondFactor(w, r, session, u)
+			return
+		}
+		loginAttempts.WithLabelValues("ok").Inc()
+		loginNames.Reset(name)
+		session.Values["user"] = u
+		if err := session.Save(r, w); err != nil {
+			errorPage(w, r, err)
+			return
 		}
+		http.Redirect(w, r, "/", http.StatusFound)
 	})
 	router.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
 		renderTemplate(w, r, data, "login.html")
 	})
+	registerAPI(router, db)
+	registerWebSub(router, db)
+	registerActivityPub(router, db)
+	registerWebmention(router, db)
 	router.HandleFunc("/api/{type}/{action}", func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		typ := vars["type"]
 		action := vars["action"]
 
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Not Authorized!", http.StatusUnauthorized)
+		if _, ok := requireAPIToken(w, r, db); !ok {
 			return
 		}
-		token, err := jwt.Parse(authHeader, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
 
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+		switch typ {
+		default:
+			http.Error(w, "Invalid API Requests!", http.StatusNotImplemented)
 			return
-		}
-
-		if token.Valid {
-			switch typ {
-			default:
-				http.Error(w, "Invalid API Requests!", http.StatusNotImplemented)
-				return
-			case "status":
-				if action == "ok" {
-					fmt.Fprint(w, "OK")
-				}
-
+		case "status":
+			if action == "ok" {
+				fmt.Fprint(w, "OK")
 			}
+
 		}
 	})
 
+	// Tokens used to be minted here, they are managed on /tokens now.
 	router.HandleFunc("/api/gentoken", func(w http.ResponseWriter, r *http.Request) {
-		session, err := store.Get(r, "session-name")
+		http.Redirect(w, r, "/tokens", http.StatusMovedPermanently)
+	})
+
+	router.HandleFunc("/admin", guard(dnews.PermAdminPage, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		uVal := session.Values["user"]
-		var u, ok = uVal.(*dnews.User)
-		if !ok {
-			uVal = &dnews.User{}
-			session.Values["user"] = &uVal
-			session.Save(r, w)
+		t, err := dnews.GetAllTagsContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
 		}
 
-		var data = &response{}
-		data.User = &u
-
-		if ok && u.Admin {
-			// Check our token field even if we haven't set it before
-			token, err := jwt.Parse(u.Token, func(token *jwt.Token) (interface{}, error) {
-				return []byte(jwtSecret), nil
-			})
-
-			if err != nil {
-				if ve, ok := err.(*jwt.ValidationError); ok {
-					if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-						data.Error = "Invalid token"
-					} else if ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
-						data.Error = "Previous token expired"
-					} else {
-						data.Error = err.Error()
-					}
-				}
-			}
+		us, err := dnews.GetAllUsersContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
 
-			if !token.Valid {
-				token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-					"eml": u.Email,
-					// 168 = 7 days
-					"exp": time.Now().Add(time.Hour * 168).Unix(),
-					"nbf": time.Now().Unix(),
-				})
-
-				tokenString, err := token.SignedString([]byte(jwtSecret))
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		bs, err := dnews.GetBugsContext(ctx, db, dnews.BugFilter{Status: dnews.BugApproved})
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
 
-				u.Token = tokenString
-				session.Values["user"] = &u
-				session.Save(r, w)
-			}
-			data.Data = u.Token
-			renderTemplate(w, r, data, "token.html")
+		pending, err := dnews.GetBugsContext(ctx, db, dnews.BugFilter{Status: dnews.BugPending})
+		if err != nil {
+			errorPage(w, r, err)
+			return
 		}
-	})
 
-	router.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
-		session, err := store.Get(r, "session-name")
+		es, err := dnews.GetEventsContext(ctx, db, dnews.EventFilter{})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		uVal := session.Values["user"]
-		var u, ok = uVal.(*dnews.User)
-		if !ok {
-			uVal = &dnews.User{}
-			session.Values["user"] = &uVal
-			session.Save(r, w)
+		locked, err := dnews.GetLockedUsersContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
 		}
 
-		var data = &response{}
-		data.User = &u
+		roles, err := dnews.GetRolesContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
 
-		if ok {
-			if u.Admin {
-				t, err := dnews.GetAllTags(db)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		tokens, err := dnews.GetAPITokensContext(ctx, db, 0)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
 
-				us, err := dnews.GetAllUsers(db)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		hooks, err := dnews.GetWebhooksContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
 
-				data.Data = struct {
-					*dnews.Tags
-					*dnews.Users
-				}{
-					&t,
-					&us,
-				}
+		deliveries, err := dnews.GetWebhookDeliveriesContext(ctx, db, 50)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
 
-				renderTemplate(w, r, data, "admin.html")
-			} else {
-				renderTemplate(w, r, data, "perm_denied.html")
-			}
-		} else {
-			renderTemplate(w, r, data, "login.html")
+		mentions, err := dnews.GetWebmentionsContext(ctx, db, dnews.WebmentionFilter{Status: dnews.MentionPending})
+		if err != nil {
+			errorPage(w, r, err)
+			return
 		}
 
-	})
+		data.Data = struct {
+			*dnews.Tags
+			*dnews.Users
+			*dnews.Bugs
+			Pending    *dnews.Bugs
+			Events     dnews.Events
+			Locked     dnews.Users
+			Roles      dnews.Roles
+			Tokens     dnews.APITokens
+			Webhooks   dnews.Webhooks
+			Deliveries dnews.WebhookDeliveries
+			HookEvents []string
+			Mentions   dnews.Webmentions
+		}{
+			&t,
+			&us,
+			bs,
+			pending,
+			es,
+			locked,
+			roles,
+			tokens,
+			hooks,
+			deliveries,
+			dnews.WebhookEvents,
+			mentions,
+		}
+
+		renderTemplate(w, r, data, "admin.html")
+	}))
+	registerUserAdmin(router, db)
+	registerTagAdmin(router, db)
+	registerWebhookAdmin(router, db)
+	registerBugAdmin(router, db)
+	registerBugSubmit(router, db)
+	registerEventAdmin(router, db)
+	registerEvents(router, db)
+	registerPlanet(router, db)
+	registerAccount(router, db)
+	registerTwoFactor(router, db)
 	router.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
 		session, err := store.Get(r, "session-name")
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
@@ -461,32 +637,53 @@ func main() {
 
 	})
 	router.HandleFunc("/advocacy", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		bugs, err := dnews.GetBugs(db)
+		region := r.FormValue("region")
+		bugs, err := dnews.GetBugsContext(ctx, db, dnews.BugFilter{
+			Region:     region,
+			Status:     dnews.BugApproved,
+			ActiveOnly: true,
+		})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		data.Data = &bugs
+		regions, err := dnews.GetBugRegionsContext(ctx, db)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data.Data = struct {
+			Bugs    *dnews.Bugs
+			Regions []string
+			Region  string
+		}{bugs, regions, region}
 
 		renderTemplate(w, r, data, "advocacy.html")
 	})
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
 		data, err := grabUser(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
-		a, err := dnews.GetNArticles(db, 10)
+		a, err := dnews.GetNArticlesContext(ctx, db, 10)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			errorPage(w, r, err)
 			return
 		}
 
@@ -494,15 +691,124 @@ func main() {
 		renderTemplate(w, r, data, "index.html")
 	})
 
-	loggedRouter := handlers.LoggingHandler(os.Stdout, router)
+	// A description that differs from the API only fails -checkapi, the
+	// site itself keeps working.
+	if err := checkAPIContract(router, openAPI); err != nil {
+		if checkAPI {
+			logger.Fatal(err)
+		}
+		logger.WithError(err).Warn("the API description is out of date")
+	}
+	if checkAPI {
+		fmt.Printf("%s matches the API\n", openAPIFile)
+		return
+	}
 
+	// background jobs run until shutdown
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go runSessionPrune(bgCtx, db, time.Hour)
+	if planetInterval > 0 {
+		go runPlanet(bgCtx, db, planetInterval)
+	}
+	if webhookInterval > 0 {
+		go runWebhooks(bgCtx, db, webhookInterval)
+	}
+	go runWebSubPrune(bgCtx, db, time.Hour)
+
+	var handler http.Handler = checkSessions(db, instrument(router))
+	var protected http.Handler
 	if insecure {
-		log.Fatal(http.ListenAndServe(listen,
-			csrf.Protect([]byte("32-byte-long-auth-key"),
-				csrf.Secure(false))(loggedRouter)))
+		protected = csrf.Protect([]byte("32-byte-long-auth-key"),
+			csrf.Secure(false))(handler)
 	} else {
-		log.Fatal(http.ListenAndServe(listen,
-			csrf.Protect([]byte(crsfSecret))(loggedRouter)))
+		protected = csrf.Protect([]byte(crsfSecret))(handler)
+	}
+	handler = skipCSRF(protected, handler)
+	handler = logRequests(handler)
 
+	if useTLS && hstsMaxAge > 0 {
+		handler = hstsHandler(hstsMaxAge, handler)
 	}
+
+	srv := &http.Server{
+		Addr:         listen,
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+	servers := []*http.Server{srv}
+
+	if metricsListen != "" {
+		ms := metricsServer(metricsListen)
+		servers = append(servers, ms)
+
+		go func() {
+			if err := ms.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Fatal(err)
+			}
+		}()
+	}
+
+	if useTLS {
+		certs, err := newCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		go certs.watch(certCheck)
+
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+
+		if redirectListen != "" {
+			redir := &http.Server{
+				Addr:         redirectListen,
+				Handler:      redirectHandler(listen),
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				IdleTimeout:  idleTimeout,
+			}
+			servers = append(servers, redir)
+
+			go func() {
+				if err := redir.ListenAndServe(); err != http.ErrServerClosed {
+					logger.Fatal(err)
+				}
+			}()
+		}
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+		sig := <-sigs
+
+		logger.WithField("signal", sig.String()).Info("shutting down")
+		atomic.StoreInt32(&ready, 0)
+		stopBackground()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		for _, s := range servers {
+			if err := s.Shutdown(ctx); err != nil {
+				logger.WithError(err).Error("shutdown")
+			}
+		}
+		close(idle)
+	}()
+
+	if useTLS {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+
+	<-idle
 }
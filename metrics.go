@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// There are no cache hit metrics because dnews has no caches: every page,
+// feed and API response is built from the database on each request. Add a
+// hits/misses counter pair here together with the first cache.
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dnews",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dnews",
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	renderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dnews",
+		Name:      "render_duration_seconds",
+		Help:      "Time spent executing each template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"template"})
+
+	loginAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dnews",
+		Name:      "login_attempts_total",
+		Help:      "Password logins by result: ok, failed or locked.",
+	}, []string{"result"})
+
+	verifyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "dnews",
+		Name:      "signature_verify_duration_seconds",
+		Help:      "Time spent verifying article signatures.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05},
+	})
+)
+
+// ready is cleared once shutdown begins so /readyz takes us out of rotation
+// before connections are drained.
+var ready int32 = 1
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, renderDuration, loginAttempts, verifyDuration)
+
+	dnews.ObserveVerify = func(d time.Duration) {
+		verifyDuration.Observe(d.Seconds())
+	}
+}
+
+// registerDBMetrics exposes the connection pool statistics of db
+func registerDBMetrics(db *sql.DB) {
+	gauge := func(name, help string, f func(sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "dnews",
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			return f(db.Stats())
+		})
+	}
+	counter := func(name, help string, f func(sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "dnews",
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			return f(db.Stats())
+		})
+	}
+
+	prometheus.MustRegister(
+		gauge("open_connections", "Established connections, in use and idle.",
+			func(s sql.DBStats) float64 { return float64(s.OpenConnections) }),
+		gauge("in_use_connections", "Connections currently in use.",
+			func(s sql.DBStats) float64 { return float64(s.InUse) }),
+		gauge("idle_connections", "Idle connections.",
+			func(s sql.DBStats) float64 { return float64(s.Idle) }),
+		counter("wait_count_total", "Connections waited for.",
+			func(s sql.DBStats) float64 { return float64(s.WaitCount) }),
+		counter("wait_duration_seconds_total", "Time blocked waiting for a connection.",
+			func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }),
+	)
+}
+
+// statusRecorder remembers the status code and size of the response
+// written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+// Flush passes through to the wrapped writer, so streaming handlers keep
+// working behind the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the wrapped writer. The status of a hijacked
+// connection is recorded as 101 Switching Protocols.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	s.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// instrument records request counts and latencies, labelled with the path
+// template of the matching route rather than the raw URL to keep the number
+// of series bounded.
+func instrument(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		router.ServeHTTP(rec, r)
+
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.code)).Inc()
+	})
+}
+
+// metricsServer serves /metrics on its own address, which is meant to be
+// reachable by the monitoring only. The counters tell a lot about logins
+// and errors.
+func metricsServer(addr string) *http.Server {
+	m := http.NewServeMux()
+	m.Handle("/metrics", promhttp.Handler())
+	return &http.Server{
+		Addr:         addr,
+		Handler:      m,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+}
+
+// pingDB answers 503 and returns false when the database can not be reached
+func pingDB(w http.ResponseWriter, r *http.Request, db *sql.DB, check string) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), dbTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		reqLog(r).WithError(err).Warn(check + ": database unreachable")
+		http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+func registerHealth(router *mux.Router, db *sql.DB) {
+	// healthz says the process is up and can reach the database
+	router.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !pingDB(w, r, db, "healthz") {
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+
+	// readyz additionally fails once shutdown has begun
+	router.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if !pingDB(w, r, db, "readyz") {
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+}
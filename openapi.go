@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// openAPIFile describes the JSON API, it is served as is and checked
+// against the handlers by checkAPIContract
+const openAPIFile = "openapi.json"
+
+// openAPI is the content of openAPIFile, read at start up. It is empty when
+// the file could not be read.
+var openAPI []byte
+
+// openAPIDoc is the part of the OpenAPI document checkAPIContract reads
+type openAPIDoc struct {
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPISchema struct {
+	Required   []string                 `json:"required"`
+	Properties map[string]openAPISchema `json:"properties"`
+	Enum       []string                 `json:"enum"`
+}
+
+// openAPISchemas names the type every schema of the document is encoded from
+var openAPISchemas = map[string]interface{}{
+	"Article":      dnews.APIArticle{},
+	"ArticleInput": dnews.APIArticleInput{},
+	"Tag":          dnews.APITag{},
+	"Bug":          dnews.APIBug{},
+	"ArticlePage":  dnews.APIPage{},
+	"TagPage":      dnews.APIPage{},
+	"BugPage":      dnews.APIPage{},
+	"Error":        dnews.APIError{},
+}
+
+var httpMethods = map[string]bool{"get": true, "put": true, "post": true, "delete": true, "patch": true}
+
+// routeVarRE matches the pattern of a mux route variable, {id:[0-9]+}
+var routeVarRE = regexp.MustCompile(`{([^:}]+):[^}]*}`)
+
+// jsonFields returns the names t is encoded with by encoding/json
+func jsonFields(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// checkSchema compares the properties of s with the fields of t
+func checkSchema(name string, s openAPISchema, t reflect.Type) []string {
+	var errs []string
+	fields := map[string]bool{}
+	for _, f := range jsonFields(t) {
+		fields[f] = true
+		if _, ok := s.Properties[f]; !ok {
+			errs = append(errs, fmt.Sprintf("schema %s lacks property %q of %s", name, f, t))
+		}
+	}
+	for p := range s.Properties {
+		if !fields[p] {
+			errs = append(errs, fmt.Sprintf("schema %s has property %q that %s does not", name, p, t))
+		}
+	}
+	for _, p := range s.Required {
+		if !fields[p] {
+			errs = append(errs, fmt.Sprintf("schema %s requires %q that %s does not have", name, p, t))
+		}
+	}
+	return errs
+}
+
+// checkAPIContract makes sure every route of the JSON API in router is in
+// doc and the other way around, and that the schemas match the types the
+// handlers encode
+func checkAPIContract(router *mux.Router, doc []byte) error {
+	var d openAPIDoc
+	if err := json.Unmarshal(doc, &d); err != nil {
+		return fmt.Errorf("%s: %v", openAPIFile, err)
+	}
+	if len(d.Servers) != 1 || d.Servers[0].URL != "/api/"+dnews.APIVersion {
+		return fmt.Errorf("%s: the only server has to be /api/%s", openAPIFile, dnews.APIVersion)
+	}
+	base := d.Servers[0].URL
+
+	documented := map[string]bool{}
+	for path, item := range d.Paths {
+		for m := range item {
+			if httpMethods[m] {
+				documented[strings.ToUpper(m)+" "+base+path] = true
+			}
+		}
+	}
+
+	var errs []string
+	served := map[string]bool{}
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, base+"/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path = routeVarRE.ReplaceAllString(path, "{$1}")
+		for _, m := range methods {
+			op := m + " " + path
+			served[op] = true
+			if !documented[op] {
+				errs = append(errs, op+" is not documented")
+			}
+		}
+		return nil
+	})
+	for op := range documented {
+		if !served[op] {
+			errs = append(errs, op+" is documented but not served")
+		}
+	}
+
+	for name, s := range d.Components.Schemas {
+		v, ok := openAPISchemas[name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("schema %s has no Go type", name))
+			continue
+		}
+		errs = append(errs, checkSchema(name, s, reflect.TypeOf(v))...)
+	}
+	errs = append(errs, checkSchema("Error.error", d.Components.Schemas["Error"].Properties["error"], reflect.TypeOf(dnews.APIError{}.Error))...)
+	for name := range openAPISchemas {
+		if _, ok := d.Components.Schemas[name]; !ok {
+			errs = append(errs, fmt.Sprintf("schema %s is missing", name))
+		}
+	}
+
+	codes := map[string]bool{}
+	for _, c := range apiCodes {
+		codes[c] = true
+	}
+	enum := d.Components.Schemas["Error"].Properties["error"].Properties["code"].Enum
+	for _, c := range enum {
+		if !codes[c] {
+			errs = append(errs, fmt.Sprintf("error code %q is documented but never sent", c))
+		}
+		delete(codes, c)
+	}
+	for c := range codes {
+		errs = append(errs, fmt.Sprintf("error code %q is not documented", c))
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("%s does not match the API:\n  %s", openAPIFile, strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// serveOpenAPI sends the OpenAPI document
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if len(openAPI) == 0 {
+		apiError(w, r, dnews.NewError(dnews.NotFound, nil, "There is no API description"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(openAPI)
+}
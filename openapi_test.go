@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// loadOpenAPI reads openapi.json into openAPI and returns it decoded
+func loadOpenAPI(t *testing.T) map[string]interface{} {
+	t.Helper()
+	b, err := ioutil.ReadFile(openAPIFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openAPI = b
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// apiRouter returns a router serving only the JSON API
+func apiRouter(db *sql.DB) *mux.Router {
+	router := mux.NewRouter()
+	registerAPI(router, db)
+	return router
+}
+
+// lookup follows a JSON pointer like #/components/schemas/Article
+func lookup(doc map[string]interface{}, ref string) (map[string]interface{}, error) {
+	var cur interface{} = doc
+	for _, p := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: %s is not an object", ref, p)
+		}
+		cur = m[p]
+	}
+	m, ok := cur.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", ref)
+	}
+	return m, nil
+}
+
+// deref returns the object n refers to, or n itself
+func deref(doc, n map[string]interface{}) (map[string]interface{}, error) {
+	for {
+		ref, ok := n["$ref"].(string)
+		if !ok {
+			return n, nil
+		}
+		var err error
+		if n, err = lookup(doc, ref); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// responseSchema returns the JSON schema documented for answering method on
+// the path template path with status
+func responseSchema(doc map[string]interface{}, path, method string, status int) (map[string]interface{}, error) {
+	paths, _ := doc["paths"].(map[string]interface{})
+	item, ok := paths[path].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not documented", path)
+	}
+	op, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not documented", method, path)
+	}
+	responses, _ := op["responses"].(map[string]interface{})
+	resp, ok := responses[strconv.Itoa(status)].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s does not document status %d", method, path, status)
+	}
+	resp, err := deref(doc, resp)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := resp["content"].(map[string]interface{})
+	js, _ := content["application/json"].(map[string]interface{})
+	schema, ok := js["schema"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s %d has no JSON schema", method, path, status)
+	}
+	return schema, nil
+}
+
+// validate checks v, decoded from JSON, against schema. It knows the parts
+// of JSON schema openapi.json uses.
+func validate(doc, schema map[string]interface{}, v interface{}, at string) []string {
+	schema, err := deref(doc, schema)
+	if err != nil {
+		return []string{at + ": " + err.Error()}
+	}
+
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch schema["type"] {
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			fail("%v is not an object", v)
+			return errs
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if _, ok := o[r.(string)]; !ok {
+				fail("lacks required %q", r)
+			}
+		}
+		for k, pv := range o {
+			ps, ok := props[k].(map[string]interface{})
+			if !ok {
+				if props != nil {
+					fail("has undocumented property %q", k)
+				}
+				continue
+			}
+			errs = append(errs, validate(doc, ps, pv, at+"."+k)...)
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			fail("%v is not an array", v)
+			return errs
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, iv := range a {
+			errs = append(errs, validate(doc, items, iv, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			fail("%v is not a string", v)
+			return errs
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				fail("%q is not a date-time", s)
+			}
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			if !found {
+				fail("%q is not one of %v", s, enum)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			fail("%v is not an integer", v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("%v is not a boolean", v)
+		}
+	}
+	return errs
+}
+
+func TestAPIContract(t *testing.T) {
+	loadOpenAPI(t)
+	if err := checkAPIContract(apiRouter(nil), openAPI); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signedArticle returns the article in test/1.md, its signature and the
+// public key it verifies against
+func signedArticle(t *testing.T) (markdown, sig, pub string) {
+	t.Helper()
+	var files [3]string
+	for i, ext := range []string{"md", "sig", "pub"} {
+		b, err := ioutil.ReadFile("test/1." + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[i] = string(b)
+	}
+	return files[0], files[1], files[2]
+}
+
+// apiFixtures fills f with an editor, a live article by someone else and a
+// draft of the editor. Authors have pub as their public key. New articles
+// get the id of the draft, so they are read back as it.
+func apiFixtures(f *fakeDB, pub string) {
+	now := time.Date(2017, 3, 22, 7, 0, 0, 0, time.UTC)
+	article := func(id int64, live bool, authorID int64) []driver.Value {
+		return []driver.Value{id, fmt.Sprintf("article-%d", id), now, live, "An article", "title: An article\n\nBody", "", authorID,
+			"beastie@example.org", "Beastie", "Daemon", "beastie", pub}
+	}
+
+	f.on("where articles.id = $1", func(args []driver.Value) (fakeResult, error) {
+		switch args[0] {
+		case int64(1):
+			return fakeResult{rows: [][]driver.Value{article(1, true, 2)}}, nil
+		case int64(2):
+			return fakeResult{rows: [][]driver.Value{article(2, false, 1)}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	f.rows("select count(*) from articles", []driver.Value{int64(1)})
+	f.rows("limit $4 offset $5", article(1, true, 2))
+	f.rows("INSERT INTO articles", []driver.Value{int64(2)})
+	f.rows("update articles set", []driver.Value{})
+	f.rows("delete from article_tags", []driver.Value{})
+	f.rows("insert into article_tags", []driver.Value{})
+	f.rows("from article_tags", []driver.Value{int64(1), "openbsd"}, []driver.Value{int64(2), "pf"})
+	f.rows("from tags where name = $1", []driver.Value{int64(1), now, "openbsd"})
+	f.rows("select id, created, name from tags",
+		[]driver.Value{int64(1), now, "openbsd"},
+		[]driver.Value{int64(2), now, "pf"},
+		[]driver.Value{int64(3), now, "zfs"})
+	f.rows("from bugs", []driver.Value{int64(1), now, "NYC*BUG", "New York City BSD User Group", "https://www.nycbug.org", "North America", "New York", "", true, dnews.BugApproved, ""})
+	f.on("update api_tokens", func(args []driver.Value) (fakeResult, error) {
+		switch args[0] {
+		case hashToken("dn_editor"):
+			return fakeResult{rows: [][]driver.Value{{int64(1), int64(1), "editor", "tooling", "{read}", now, nil, nil}}}, nil
+		case hashToken("dn_writer"):
+			return fakeResult{rows: [][]driver.Value{{int64(2), int64(1), "writer", "dncli", "{read,write:articles}", now, nil, nil}}}, nil
+		}
+		return fakeResult{}, nil
+	})
+	f.rows("from users where id = $1", []driver.Value{int64(1), now, "Ed", "Itor", "editor@example.org", "editor", "author",
+		"{" + dnews.PermWriteArticles + "}", false, true, now, false})
+	f.rows("from users where email = $1", []driver.Value{int64(1)})
+	f.rows("from pubkeys", []driver.Value{pub})
+	f.rows("insert into webhook_deliveries")
+}
+
+// hashToken is how the database is asked for an API token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAPIResponses(t *testing.T) {
+	doc := loadOpenAPI(t)
+	f, db := newFakeDB(t)
+	defer db.Close()
+	markdown, sig, pub := signedArticle(t)
+	apiFixtures(f, pub)
+	router := apiRouter(db)
+	base := "/api/" + dnews.APIVersion
+
+	input := func(markdown string, live bool) string {
+		b, err := json.Marshal(dnews.APIArticleInput{Markdown: markdown, Signature: sig, Live: live, CreateTags: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	signed, draft, forged := input(markdown, true), input(markdown, false), input(markdown+"\n", true)
+
+	for _, tc := range []struct {
+		method, path, token string
+		body                string
+		status              int
+	}{
+		{"GET", "/openapi.json", "", "", http.StatusOK},
+		{"GET", "/articles", "", "", http.StatusOK},
+		{"GET", "/articles?page=2&per_page=5", "", "", http.StatusOK},
+		{"GET", "/articles?page=0", "", "", http.StatusBadRequest},
+		{"GET", "/articles?page=21474837", "", "", http.StatusBadRequest},
+		{"GET", "/articles?per_page=1000", "", "", http.StatusBadRequest},
+		{"GET", "/articles", "dn_revoked", "", http.StatusUnauthorized},
+		{"GET", "/articles/1", "", "", http.StatusOK},
+		{"GET", "/articles/2", "", "", http.StatusNotFound},
+		{"GET", "/articles/2", "dn_editor", "", http.StatusOK},
+		{"GET", "/articles/3", "", "", http.StatusNotFound},
+		{"POST", "/articles", "", `{}`, http.StatusUnauthorized},
+		{"POST", "/articles", "dn_editor", `{}`, http.StatusForbidden},
+		{"POST", "/articles", "dn_writer", `{}`, http.StatusBadRequest},
+		{"POST", "/articles", "dn_writer", forged, http.StatusBadRequest},
+		{"POST", "/articles", "dn_writer", signed, http.StatusCreated},
+		{"PUT", "/articles/1", "", `{}`, http.StatusUnauthorized},
+		{"PUT", "/articles/1", "dn_writer", signed, http.StatusForbidden},
+		{"PUT", "/articles/2", "dn_writer", forged, http.StatusBadRequest},
+		{"PUT", "/articles/2", "dn_writer", draft, http.StatusOK},
+		{"POST", "/articles/1/publish", "", "", http.StatusUnauthorized},
+		{"POST", "/articles/1/publish", "dn_writer", "", http.StatusForbidden},
+		{"POST", "/articles/2/publish", "dn_writer", "", http.StatusOK},
+		{"POST", "/articles/1/unpublish", "", "", http.StatusUnauthorized},
+		{"POST", "/articles/2/unpublish", "dn_writer", "", http.StatusOK},
+		{"GET", "/tags", "", "", http.StatusOK},
+		{"GET", "/tags?page=2&per_page=2", "", "", http.StatusOK},
+		{"GET", "/tags?page=x", "", "", http.StatusBadRequest},
+		{"GET", "/tags?page=4611686018427387904", "", "", http.StatusBadRequest},
+		{"GET", "/bugs", "", "", http.StatusOK},
+		{"GET", "/bugs?per_page=0", "", "", http.StatusBadRequest},
+		{"GET", "/bugs?page=21474836&per_page=100", "", "", http.StatusOK},
+	} {
+		name := tc.method + " " + tc.path
+		r := httptest.NewRequest(tc.method, base+tc.path, strings.NewReader(tc.body))
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d: %s", name, w.Code, tc.status, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: Content-Type is %q", name, ct)
+		}
+
+		var match mux.RouteMatch
+		if !router.Match(r, &match) {
+			t.Errorf("%s: no route", name)
+			continue
+		}
+		tpl, _ := match.Route.GetPathTemplate()
+		tpl = routeVarRE.ReplaceAllString(strings.TrimPrefix(tpl, base), "{$1}")
+		schema, err := responseSchema(doc, tpl, tc.method, w.Code)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for _, e := range validate(doc, schema, v, "body") {
+			t.Errorf("%s: %s", name, e)
+		}
+	}
+
+	if !f.ran("INSERT INTO articles") || !f.ran("update articles set title") {
+		t.Error("the signed article was not saved")
+	}
+	// The article is read back as the draft, which webhooks do not hear of.
+	if f.ran("insert into webhook_deliveries") {
+		t.Error("a webhook was queued for a draft")
+	}
+}
+
+func TestAPIPayloadsMatchSchemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+	a := &dnews.Article{ID: 1, Slug: "hello", Title: "Hello", Date: time.Now(), Body: []byte("title: Hello"), Signature: []byte("sig")}
+
+	for _, tc := range []struct {
+		schema string
+		v      interface{}
+	}{
+		{"Article", apiArticle(a, true)},
+		{"Article", apiArticle(a, false)},
+		{"ArticleInput", dnews.APIArticleInput{Markdown: "title: Hello", Signature: "sig", Live: true, CreateTags: true}},
+		{"ArticlePage", dnews.APIPage{Page: 1, PerPage: 20, Total: 1, Data: []*dnews.APIArticle{apiArticle(a, false)}}},
+		{"TagPage", dnews.APIPage{Page: 1, PerPage: 20, Data: []*dnews.APITag{{ID: 1, Name: "pf", Created: time.Now()}}}},
+		{"BugPage", dnews.APIPage{Page: 1, PerPage: 20, Data: []*dnews.APIBug{{ID: 1, Name: "NYC*BUG"}}}},
+	} {
+		b, err := json.Marshal(tc.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{}
+		if err := json.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		schema := map[string]interface{}{"$ref": "#/components/schemas/" + tc.schema}
+		for _, e := range validate(doc, schema, v, tc.schema) {
+			t.Error(e)
+		}
+	}
+}
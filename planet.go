@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/feeds"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var planetFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "dnews",
+	Name:      "planet_fetches_total",
+	Help:      "User group feed fetches by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(planetFetches)
+}
+
+// runPlanet polls the feeds of all active, approved user groups every
+// interval until ctx is done
+func runPlanet(ctx context.Context, db *sql.DB, interval time.Duration) {
+	client := &http.Client{Timeout: 30 * time.Second, Transport: publicTransport}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		fetchPlanet(ctx, db, client)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// fetchPlanet does one round of fetching. A broken feed is logged and
+// skipped so it can not hold up the others.
+func fetchPlanet(ctx context.Context, db *sql.DB, client *http.Client) {
+	dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	bs, err := dnews.GetBugsContext(dctx, db, dnews.BugFilter{
+		Status:     dnews.BugApproved,
+		ActiveOnly: true,
+		WithFeed:   true,
+	})
+	cancel()
+	if err != nil {
+		logger.WithError(err).Error("planet: listing feeds")
+		return
+	}
+
+	for _, b := range *bs {
+		if ctx.Err() != nil {
+			return
+		}
+		l := logger.WithField("bug_id", b.ID).WithField("feed", b.FeedURL)
+
+		es, err := dnews.FetchFeed(ctx, client, b.FeedURL)
+		if err != nil {
+			planetFetches.WithLabelValues("error").Inc()
+			l.WithError(err).Warn("planet: fetching feed")
+			continue
+		}
+
+		dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		n, err := dnews.InsertEntriesContext(dctx, db, b.ID, es)
+		cancel()
+		if err != nil {
+			planetFetches.WithLabelValues("error").Inc()
+			l.WithError(err).Error("planet: storing entries")
+			continue
+		}
+
+		planetFetches.WithLabelValues("ok").Inc()
+		l.WithField("new", n).Debug("planet: fetched feed")
+	}
+}
+
+func registerPlanet(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/planet", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		es, err := dnews.GetEntriesContext(ctx, db, 50)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		data.Data = es
+		renderTemplate(w, r, data, "planet.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/planet/{type:atom|rss}", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		es, err := dnews.GetEntriesContext(ctx, db, 50)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		feed := &feeds.Feed{
+			Title:       "Planet Daemon.News",
+			Link:        &feeds.Link{Href: "https://daemon.news/planet"},
+			Description: "Posts from BSD user groups",
+			Author:      &feeds.Author{Name: "The Daemon News Team", Email: "daemons@daemon.news"},
+			Created:     time.Now(),
+		}
+
+		for _, e := range es {
+			f := feeds.Item{}
+			f.Id = fmt.Sprintf("planet-%d@daemon.news", e.ID)
+			f.Title = fmt.Sprintf("%s: %s", e.BugName, e.Title)
+			f.Description = string(e.Content)
+			f.Link = &feeds.Link{Href: e.Link}
+			f.Author = &feeds.Author{Name: e.Author}
+			f.Created = e.Published
+
+			feed.Items = append(feed.Items, &f)
+		}
+
+		writeFeed(w, r, feed, mux.Vars(r)["type"])
+	}).Methods("GET")
+}
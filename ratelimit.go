@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+)
+
+// rateLimiter allows at most limit events per key within a sliding window.
+// State is kept in memory, so limits reset when the server restarts.
+type rateLimiter struct {
+	sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit
+func (l *rateLimiter) Allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	recent := l.prune(key, now)
+	if len(recent) >= l.limit {
+		l.hits[key] = recent
+		return false
+	}
+	l.hits[key] = append(recent, now)
+
+	// Keep the map from growing without bound on busy servers.
+	if len(l.hits) > 10000 {
+		for k := range l.hits {
+			if len(l.prune(k, now)) == 0 {
+				delete(l.hits, k)
+			}
+		}
+	}
+
+	return true
+}
+
+// prune returns the events of key that are still inside the window
+func (l *rateLimiter) prune(key string, now time.Time) []time.Time {
+	hs := l.hits[key]
+	i := 0
+	for i < len(hs) && now.Sub(hs[i]) > l.window {
+		i++
+	}
+	return hs[i:]
+}
+
+// loginIPs and loginNames slow down password guessing on /login/post
+var (
+	loginIPs   = newBackoff(20, 30*time.Second, time.Hour)
+	loginNames = newBackoff(dnews.LockoutFree, dnews.LockoutBase, dnews.LockoutMax)
+)
+
+// clientIP returns the address of the visitor. X-Forwarded-For is only
+// honoured with -trustproxy, as anyone can set it otherwise.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			parts := strings.Split(fwd, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// backoff locks a key out after free failures in a row, for base at first
+// and twice as long after every further failure, up to max. Keys are
+// forgotten once they have been quiet for max.
+type backoff struct {
+	sync.Mutex
+	free    int
+	base    time.Duration
+	max     time.Duration
+	strikes map[string]*strike
+}
+
+type strike struct {
+	n     int
+	last  time.Time
+	until time.Time
+}
+
+func newBackoff(free int, base, max time.Duration) *backoff {
+	return &backoff{
+		free:    free,
+		base:    base,
+		max:     max,
+		strikes: make(map[string]*strike),
+	}
+}
+
+// Wait returns how long key is still locked out, or 0
+func (b *backoff) Wait(key string) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.strikes[key]
+	if !ok {
+		return 0
+	}
+	if d := time.Until(s.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Fail records a failure for key
+func (b *backoff) Fail(key string) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	s, ok := b.strikes[key]
+	if !ok || now.Sub(s.last) > b.max {
+		s = &strike{}
+		b.strikes[key] = s
+	}
+	s.n++
+	s.last = now
+	if s.n >= b.free {
+		// Doubled step by step, a shift would overflow long before a
+		// key stops failing.
+		d := b.base
+		for i := s.n - b.free; i > 0 && d < b.max; i-- {
+			d *= 2
+		}
+		if d > b.max {
+			d = b.max
+		}
+		s.until = now.Add(d)
+	}
+
+	if len(b.strikes) > 10000 {
+		for k, s := range b.strikes {
+			if now.Sub(s.last) > b.max {
+				delete(b.strikes, k)
+			}
+		}
+	}
+}
+
+// Reset forgets the failures of key
+func (b *backoff) Reset(key string) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.strikes, key)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("a") {
+			t.Fatalf("event %d refused", i+1)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("fourth event allowed")
+	}
+	if !l.Allow("b") {
+		t.Error("another key was limited")
+	}
+
+	// Once the window has passed the key is allowed again.
+	for i := range l.hits["a"] {
+		l.hits["a"][i] = l.hits["a"][i].Add(-2 * time.Hour)
+	}
+	if !l.Allow("a") {
+		t.Error("event after the window refused")
+	}
+}
+
+func TestBackoffSchedule(t *testing.T) {
+	b := newBackoff(3, time.Minute, time.Hour)
+	for n := 1; n <= 64; n++ {
+		b.Fail("beastie")
+
+		var want time.Duration
+		switch {
+		case n < 3:
+			want = 0
+		case n-3 < 6:
+			want = time.Minute << uint(n-3)
+		default:
+			want = time.Hour
+		}
+		got := b.Wait("beastie")
+		if got > want || got < want-time.Second {
+			t.Errorf("after %d failures: locked for %v, want %v", n, got, want)
+		}
+	}
+
+	if d := b.Wait("puffy"); d != 0 {
+		t.Errorf("another key is locked for %v", d)
+	}
+	b.Reset("beastie")
+	if d := b.Wait("beastie"); d != 0 {
+		t.Errorf("locked for %v after a reset", d)
+	}
+}
+
+func TestBackoffForgets(t *testing.T) {
+	b := newBackoff(2, time.Minute, time.Hour)
+	b.Fail("beastie")
+	b.strikes["beastie"].last = time.Now().Add(-2 * time.Hour)
+	b.Fail("beastie")
+	if d := b.Wait("beastie"); d != 0 {
+		t.Errorf("an old failure counted, locked for %v", d)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(old bool) { trustProxy = old }(trustProxy)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	trustProxy = false
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("without -trustproxy got %s", ip)
+	}
+	trustProxy = true
+	if ip := clientIP(r); ip != "198.51.100.7" {
+		t.Errorf("with -trustproxy got %s", ip)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"net/http"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionMaxAge is how long a session lives without being saved again
+const sessionMaxAge = 30 * 24 * time.Hour
+
+// dbStore is a sessions.Store that keeps the session values in the database.
+// The cookie only carries a signed random key, so a session can be ended on
+// the server and nothing about the user is trusted from the client.
+type dbStore struct {
+	db      *sql.DB
+	codecs  []securecookie.Codec
+	options *sessions.Options
+}
+
+// newDBStore returns a store for db. secure marks the cookie HTTPS only and
+// is set when the server speaks TLS itself.
+func newDBStore(db *sql.DB, secure bool, keyPairs ...[]byte) *dbStore {
+	return &dbStore{
+		db:     db,
+		codecs: securecookie.CodecsFromPairs(keyPairs...),
+		options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(sessionMaxAge.Seconds()),
+			HttpOnly: true,
+			Secure:   secure,
+		},
+	}
+}
+
+// Get returns the session for name, loading it once per request
+func (s *dbStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session named by the cookie of r. Unknown, expired or
+// forged cookies start an empty session.
+func (s *dbStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	var key string
+	if err := securecookie.DecodeMulti(name, c.Value, &key, s.codecs...); err != nil {
+		return session, nil
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	se, err := dnews.GetSessionContext(ctx, s.db, key)
+	if err != nil {
+		if dnews.KindOf(err) == dnews.NotFound {
+			return session, nil
+		}
+		return session, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(se.Data)).Decode(&session.Values); err != nil {
+		reqLog(r).WithError(err).Warn("discarding undecodable session")
+		return session, nil
+	}
+
+	// Seen is only kept to the minute, to spare a write on every request.
+	if time.Since(se.Seen) > time.Minute {
+		if err := dnews.TouchSessionContext(ctx, s.db, key); err != nil {
+			reqLog(r).WithError(err).Warn("touching session")
+		}
+	}
+
+	session.ID = key
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes session to the database and sets the cookie. A negative
+// MaxAge or empty values remove the session instead.
+func (s *dbStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx, cancel := dbContext(r)
+	defer cancel()
+
+	if session.Options.MaxAge < 0 || len(session.Values) == 0 {
+		if session.ID == "" {
+			return nil
+		}
+		if err := dnews.DeleteSessionContext(ctx, s.db, session.ID); err != nil {
+			return err
+		}
+		opts := *s.options
+		opts.MaxAge = -1
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", &opts))
+		return nil
+	}
+
+	if session.ID == "" {
+		key, err := dnews.NewSessionKey()
+		if err != nil {
+			return err
+		}
+		session.ID = key
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	se := &dnews.Session{
+		Data:    buf.Bytes(),
+		Expires: time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second),
+		IP:      clientIP(r),
+		Agent:   r.UserAgent(),
+	}
+	if u, ok := session.Values["user"].(*dnews.User); ok && u.Authed {
+		se.UserID = u.ID
+	}
+	if err := dnews.SaveSessionContext(ctx, s.db, session.ID, se); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew drops the stored copy of session so the next Save stores it under
+// a fresh key. Call it when someone logs in, so a key planted before the
+// login can not be used to ride along.
+func (s *dbStore) Renew(r *http.Request, session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	ctx, cancel := dbContext(r)
+	defer cancel()
+
+	if err := dnews.DeleteSessionContext(ctx, s.db, session.ID); err != nil {
+		return err
+	}
+	session.ID = ""
+	return nil
+}
+
+// runSessionPrune removes expired sessions every interval until ctx is done
+func runSessionPrune(ctx context.Context, db *sql.DB, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		n, err := dnews.PruneSessionsContext(dctx, db)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Error("pruning sessions")
+		} else if n > 0 {
+			logger.WithField("sessions", n).Debug("pruned expired sessions")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/sessions"
+)
+
+// sessionTable keeps the sessions table of a fakeDB in memory, keyed by
+// session id
+type sessionTable struct {
+	sync.Mutex
+	rows map[string][]driver.Value
+}
+
+func newSessionTable(f *fakeDB) *sessionTable {
+	st := &sessionTable{rows: map[string][]driver.Value{}}
+	f.on("insert into sessions", func(args []driver.Value) (fakeResult, error) {
+		st.Lock()
+		defer st.Unlock()
+		now := time.Now()
+		// id, userid, data, created, seen, expires, ip, agent
+		st.rows[args[0].(string)] = []driver.Value{args[0], args[1], args[2], now, now, args[3], args[4], args[5]}
+		return fakeResult{affected: 1}, nil
+	})
+	// Registered before the select, whose match the delete contains.
+	f.on("delete from sessions", func(args []driver.Value) (fakeResult, error) {
+		st.Lock()
+		defer st.Unlock()
+		delete(st.rows, args[0].(string))
+		return fakeResult{affected: 1}, nil
+	})
+	f.on("from sessions where id = $1", func(args []driver.Value) (fakeResult, error) {
+		st.Lock()
+		defer st.Unlock()
+		row, ok := st.rows[args[0].(string)]
+		if !ok || !row[5].(time.Time).After(time.Now()) {
+			return fakeResult{}, nil
+		}
+		return fakeResult{rows: [][]driver.Value{row}}, nil
+	})
+	f.on("update sessions set seen", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+	return st
+}
+
+func (st *sessionTable) len() int {
+	st.Lock()
+	defer st.Unlock()
+	return len(st.rows)
+}
+
+// sessionCookie returns the cookie named name set on w
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder, name string) *http.Cookie {
+	t.Helper()
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("no %s cookie was set", name)
+	return nil
+}
+
+// requestWith returns a request carrying c
+func requestWith(c *http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	if c != nil {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestDBStoreRoundTrip(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+	st := newSessionTable(f)
+	s := newDBStore(db, true, []byte("a signing key of 32 bytes length"))
+
+	session, err := s.New(requestWith(nil), "session-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatal("a request without a cookie got a stored session")
+	}
+	session.Values["user"] = &dnews.User{ID: 7, User: "beastie", Authed: true}
+
+	w := httptest.NewRecorder()
+	if err := s.Save(requestWith(nil), w, session); err != nil {
+		t.Fatal(err)
+	}
+	c := sessionCookie(t, w, "session-name")
+	if !c.Secure || !c.HttpOnly {
+		t.Errorf("cookie is not Secure and HttpOnly: %+v", c)
+	}
+	if st.len() != 1 {
+		t.Fatalf("%d sessions stored, want 1", st.len())
+	}
+	row, ok := st.rows[dnews.SessionID(session.ID)]
+	if !ok {
+		t.Fatal("the session is not stored under the hash of its key")
+	}
+	if row[1] != int64(7) {
+		t.Errorf("stored for user %v, want 7", row[1])
+	}
+
+	again, err := s.New(requestWith(c), "session-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.IsNew || again.ID != session.ID {
+		t.Fatalf("the cookie did not load the session")
+	}
+	u, ok := again.Values["user"].(*dnews.User)
+	if !ok || u.ID != 7 || !u.Authed {
+		t.Errorf("got user %+v", again.Values["user"])
+	}
+}
+
+func TestDBStoreRefusesForgedCookies(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+	newSessionTable(f)
+	s := newDBStore(db, false, []byte("a signing key of 32 bytes length"))
+	other := newDBStore(db, false, []byte("another key, also 32 bytes long!"))
+
+	session, _ := other.New(requestWith(nil), "session-name")
+	session.Values["user"] = &dnews.User{ID: 1, Authed: true}
+	w := httptest.NewRecorder()
+	if err := other.Save(requestWith(nil), w, session); err != nil {
+		t.Fatal(err)
+	}
+	c := sessionCookie(t, w, "session-name")
+	if c.Secure {
+		t.Error("cookie is Secure without TLS")
+	}
+
+	for name, c := range map[string]*http.Cookie{
+		"other key": c,
+		"bare key":  {Name: "session-name", Value: session.ID},
+		"garbage":   {Name: "session-name", Value: "x"},
+	} {
+		got, err := s.New(requestWith(c), "session-name")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !got.IsNew || len(got.Values) != 0 {
+			t.Errorf("%s: the session was loaded", name)
+		}
+	}
+}
+
+func TestDBStoreLogoutAndRenew(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+	st := newSessionTable(f)
+	s := newDBStore(db, false, []byte("a signing key of 32 bytes length"))
+
+	save := func(session *sessions.Session) *http.Cookie {
+		w := httptest.NewRecorder()
+		if err := s.Save(requestWith(nil), w, session); err != nil {
+			t.Fatal(err)
+		}
+		return sessionCookie(t, w, "session-name")
+	}
+
+	session, _ := s.New(requestWith(nil), "session-name")
+	session.Values["flash"] = "hello"
+	c := save(session)
+	old := session.ID
+
+	// Logging in moves the values to a new key, the old cookie is dead.
+	if err := s.Renew(requestWith(c), session); err != nil {
+		t.Fatal(err)
+	}
+	renewed := save(session)
+	if session.ID == old {
+		t.Fatal("Renew kept the session key")
+	}
+	if got, _ := s.New(requestWith(c), "session-name"); !got.IsNew {
+		t.Error("the cookie from before Renew still works")
+	}
+	if got, _ := s.New(requestWith(renewed), "session-name"); got.Values["flash"] != "hello" {
+		t.Error("Renew lost the values")
+	}
+
+	// Logging out removes the row and the cookie.
+	session.Options.MaxAge = -1
+	gone := save(session)
+	if gone.MaxAge >= 0 {
+		t.Errorf("cookie not removed: %+v", gone)
+	}
+	if st.len() != 0 {
+		t.Errorf("%d sessions left after logout", st.len())
+	}
+	if got, _ := s.New(requestWith(renewed), "session-name"); !got.IsNew {
+		t.Error("the session works after logout")
+	}
+}
@@ -1,11 +1,25 @@
 create extension if not exists pg_trm;
 create extension if not exists pgcrypto;
 
+drop table if exists planet;
+drop table if exists events;
 drop table if exists bugs;
 drop table if exists tags;
 drop table if exists article_tags;
 drop table if exists pubkeys cascade;
+drop table if exists password_resets;
+drop table if exists sessions;
+drop table if exists api_tokens;
+drop table if exists webhook_deliveries;
+drop table if exists webhooks;
+drop table if exists websub_subscriptions;
+drop table if exists ap_followers;
+drop table if exists ap_keys;
+drop table if exists webmentions;
+drop table if exists recovery_codes;
 drop table if exists users cascade;
+drop table if exists permissions;
+drop table if exists roles;
 drop table if exists articles cascade;
 drop table if exists comments;
 
@@ -14,14 +28,54 @@ create table bugs (
 	created timestamp with time zone default now(),
 	name text not null,
 	descr text not null,
-	url text not null
+	url text not null,
+	region text default '' not null,
+	location text default '' not null,
+	contact text default '' not null,
+	active bool default true not null,
+	status text default 'approved' not null check (status in ('pending', 'approved', 'rejected')),
+	feed_url text default '' not null
 );
 
-insert into bugs (name, descr, url) values ('Colorado BSD Users Group', '*BSD user group in colerful Colorado!', 'https://cobug.org');
-insert into bugs (name, descr, url) values ('New York City BSD User Group', 'NYC*BUG (pronounced "nice bug") is the *BSD user group serving the metropolitan NYC area!', 'https://www.nycbug.org/');
-insert into bugs (name, descr, url) values ('Capital District BSD User Group', 'Capital District *BSD User Group serving the NY Captial District (Albany, Troy, Schenectedy) area!', 'https://cdbug.org');
-insert into bugs (name, descr, url) values ('Knoxville BSD User Group', 'Knoxville BSD User Group serving Knoxville TN and the surrounding areas!', 'https://knoxbug.org');
-insert into bugs (name, descr, url) values ('Chicago BSD User Group', 'Chicago BSD User Group serving the Chicago area!', 'https://chibug.org');
+insert into bugs (name, descr, url, region, location) values ('Colorado BSD Users Group', '*BSD user group in colerful Colorado!', 'https://cobug.org', 'US, Colorado', 'Denver, CO');
+insert into bugs (name, descr, url, region, location) values ('New York City BSD User Group', 'NYC*BUG (pronounced "nice bug") is the *BSD user group serving the metropolitan NYC area!', 'https://www.nycbug.org/', 'US, New York', 'New York, NY');
+insert into bugs (name, descr, url, region, location) values ('Capital District BSD User Group', 'Capital District *BSD User Group serving the NY Captial District (Albany, Troy, Schenectedy) area!', 'https://cdbug.org', 'US, New York', 'Albany, NY');
+insert into bugs (name, descr, url, region, location) values ('Knoxville BSD User Group', 'Knoxville BSD User Group serving Knoxville TN and the surrounding areas!', 'https://knoxbug.org', 'US, Tennessee', 'Knoxville, TN');
+insert into bugs (name, descr, url, region, location) values ('Chicago BSD User Group', 'Chicago BSD User Group serving the Chicago area!', 'https://chibug.org', 'US, Illinois', 'Chicago, IL');
+
+create table planet (
+	id serial unique,
+	bugid int not null references bugs (id) on delete cascade,
+	guid text not null,
+	title text not null,
+	link text default '' not null,
+	author text default '' not null,
+	content text default '' not null,
+	published timestamp with time zone not null,
+	fetched timestamp with time zone default now(),
+	unique (bugid, guid)
+);
+
+create index planet_published on planet (published);
+
+create table events (
+	id serial unique,
+	created timestamp with time zone default now(),
+	bugid int references bugs (id) on delete cascade,
+	kind text default 'meeting' not null check (kind in ('meeting', 'conference')),
+	title text not null,
+	descr text default '' not null,
+	location text default '' not null,
+	url text default '' not null,
+	starts timestamp with time zone not null,
+	ends timestamp with time zone not null,
+	tz text default 'UTC' not null,
+	recur text default '' not null check (recur in ('', 'weekly', 'monthly')),
+	recur_until timestamp with time zone
+);
+
+insert into events (kind, title, descr, url, location, starts, ends, tz) values ('conference', 'BSDCan', 'The technical conference for people working on and with 4.4BSD based operating systems.', 'https://www.bsdcan.org/', 'Ottawa, Canada', '2017-06-07 09:00-04', '2017-06-10 18:00-04', 'America/Toronto');
+insert into events (kind, title, descr, url, location, starts, ends, tz) values ('conference', 'EuroBSDCon', 'The premier European conference on the open source BSD operating systems.', 'https://eurobsdcon.org', 'Paris, France', '2017-09-21 09:00+02', '2017-09-24 18:00+02', 'Europe/Paris');
 
 create table tags (
 	id serial unique,
@@ -31,9 +85,44 @@ create table tags (
 
 create table article_tags (
 	articleid int,
-	tagid int
+	tagid int,
+	primary key (articleid, tagid)
+);
+
+create table roles (
+	name text primary key,
+	rank int unique not null,
+	descr text not null
 );
 
+insert into roles (name, rank, descr) values ('reader', 0, 'Reads the site and submits user groups');
+insert into roles (name, rank, descr) values ('commenter', 1, 'Can also comment on articles');
+insert into roles (name, rank, descr) values ('author', 2, 'Can also write and publish their own articles');
+insert into roles (name, rank, descr) values ('editor', 3, 'Can also edit any article and look after tags, user groups and events');
+insert into roles (name, rank, descr) values ('admin', 4, 'Can do everything, including managing accounts');
+
+create table permissions (
+	role text not null references roles (name) on update cascade on delete cascade,
+	permission text not null,
+	primary key (role, permission)
+);
+
+insert into permissions (role, permission) values ('commenter', 'comment');
+insert into permissions (role, permission) values ('author', 'comment');
+insert into permissions (role, permission) values ('author', 'articles:write');
+insert into permissions (role, permission) values ('editor', 'comment');
+insert into permissions (role, permission) values ('editor', 'articles:write');
+insert into permissions (role, permission) values ('editor', 'articles:edit');
+insert into permissions (role, permission) values ('editor', 'tags:manage');
+insert into permissions (role, permission) values ('editor', 'bugs:manage');
+insert into permissions (role, permission) values ('editor', 'events:manage');
+insert into permissions (role, permission) values ('editor', 'admin:view');
+insert into permissions (role, permission) values ('editor', 'mentions:moderate');
+insert into permissions (role, permission) select 'admin', permission from permissions where role = 'editor';
+insert into permissions (role, permission) values ('admin', 'users:manage');
+insert into permissions (role, permission) values ('admin', 'users:delete');
+insert into permissions (role, permission) values ('admin', 'webhooks:manage');
+
 create table users (
 	id serial unique,
 	created timestamp with time zone default now(),
@@ -42,7 +131,107 @@ create table users (
 	email text not null,
 	hash text not null,
 	username text unique not null,
-	admin bool default false not null
+	role text default 'reader' not null references roles (name) on update cascade,
+	disabled bool default false not null,
+	verified bool default true not null,
+	pass_changed timestamp with time zone default now() not null,
+	totp_secret text default '' not null,
+	totp_last bigint default 0 not null,
+	failed_logins int default 0 not null,
+	locked_until timestamp with time zone
+);
+
+create unique index users_email on users (lower(email));
+
+create table recovery_codes (
+	id serial unique,
+	userid int not null references users (id) on delete cascade,
+	hash text not null
+);
+
+create table sessions (
+	id text primary key,
+	userid int references users (id) on delete cascade,
+	data bytea not null,
+	created timestamp with time zone default now() not null,
+	seen timestamp with time zone default now() not null,
+	expires timestamp with time zone not null,
+	ip text default '' not null,
+	agent text default '' not null
+);
+
+create index sessions_userid on sessions (userid);
+
+create table api_tokens (
+	id serial unique,
+	created timestamp with time zone default now() not null,
+	userid int not null references users (id) on delete cascade,
+	name text not null,
+	hash text unique not null,
+	scopes text[] not null,
+	last_used timestamp with time zone,
+	expires timestamp with time zone,
+	unique (userid, name)
+);
+
+create table webhooks (
+	id serial unique,
+	created timestamp with time zone default now() not null,
+	url text not null,
+	descr text default '' not null,
+	secret text not null,
+	events text[] not null,
+	active bool default true not null
+);
+
+create table webhook_deliveries (
+	id serial unique,
+	webhookid int not null references webhooks (id) on delete cascade,
+	event text not null,
+	payload bytea not null,
+	created timestamp with time zone default now() not null,
+	attempts int default 0 not null,
+	next_attempt timestamp with time zone default now() not null,
+	delivered timestamp with time zone,
+	failed bool default false not null,
+	last_status int default 0 not null,
+	last_error text default '' not null
+);
+
+create index webhook_deliveries_due on webhook_deliveries (next_attempt) where delivered is null and not failed;
+
+create table websub_subscriptions (
+	id serial unique,
+	topic text not null,
+	callback text not null,
+	secret text default '' not null,
+	created timestamp with time zone default now() not null,
+	expires timestamp with time zone not null,
+	unique (topic, callback)
+);
+
+create table ap_keys (
+	actor text primary key,
+	private_key text not null,
+	public_key text not null,
+	created timestamp with time zone default now() not null
+);
+
+create table ap_followers (
+	id serial unique,
+	actor text not null,
+	follower text not null,
+	inbox text not null,
+	created timestamp with time zone default now() not null,
+	unique (actor, follower)
+);
+
+create table password_resets (
+	id serial unique,
+	created timestamp with time zone default now(),
+	userid int not null references users (id) on delete cascade,
+	hash text unique not null,
+	expires timestamp with time zone not null
 );
 
 create table pubkeys (
@@ -95,6 +284,18 @@ CREATE TRIGGER tsvectorupdate BEFORE INSERT OR UPDATE
     ON articles FOR EACH ROW EXECUTE PROCEDURE articles_ts_trigger();
 
 
+create table webmentions (
+	id serial unique,
+	articleid int references articles (id) on delete cascade not null,
+	source text not null,
+	target text not null,
+	title text default '' not null,
+	status text default 'pending' not null check (status in ('pending', 'approved', 'rejected')),
+	created timestamp with time zone default now() not null,
+	verified timestamp with time zone default now() not null,
+	unique (source, target)
+);
+
 create table comments (
 	id serial unique,
 	created timestamp with time zone default now(),
@@ -109,8 +310,8 @@ create or replace function hash(pass text) returns text as $$
 	select crypt(pass, gen_salt('bf', 10));	
 $$ language sql;
 
-insert into users (fname, lname, username, hash, email, admin) values ('Charlie', 'Root', 'root', hash('omgSnakes'), 'root@localhost', true);
-insert into users (fname, lname, username, hash, email) values ('Aaron', 'Bieber', 'aaron', hash('omgSnakes'), 'aaron@daemon.news');
+insert into users (fname, lname, username, hash, email, role) values ('Charlie', 'Root', 'root', hash('omgSnakes'), 'root@localhost', 'admin');
+insert into users (fname, lname, username, hash, email, role) values ('Aaron', 'Bieber', 'aaron', hash('omgSnakes'), 'aaron@daemon.news', 'author');
 insert into pubkeys (userid, key) values (2, 'untrusted comment: signify public key
 RWSYzBxZQY5obtJcBPKBQHzy6EpyV/D5VpDB58f1Hrn4NqaC1Jo2fSz9');
 insert into tags (name) values ('OpenBSD');
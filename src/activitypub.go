@@ -0,0 +1,355 @@
+package dnews
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ActivityPub media types and well known IRIs
+const (
+	ActivityContentType = "application/activity+json"
+	ActivityLDType      = `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+	ActivityStreams     = "https://www.w3.org/ns/activitystreams"
+	ActivitySecurity    = "https://w3id.org/security/v1"
+	ActivityPublic      = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+// SignatureMaxAge is how far the Date of a signed request may be off
+const SignatureMaxAge = 12 * time.Hour
+
+// ActivityContext is the @context of documents describing actors
+var ActivityContext = []string{ActivityStreams, ActivitySecurity}
+
+// APActor describes an actor. It is served for the local actors and read
+// from remote ones, which is where Endpoints come from.
+type APActor struct {
+	Context           interface{}  `json:"@context,omitempty"`
+	ID                string       `json:"id"`
+	Type              string       `json:"type"`
+	PreferredUsername string       `json:"preferredUsername"`
+	Name              string       `json:"name,omitempty"`
+	Summary           string       `json:"summary,omitempty"`
+	URL               string       `json:"url,omitempty"`
+	Inbox             string       `json:"inbox"`
+	Outbox            string       `json:"outbox,omitempty"`
+	Followers         string       `json:"followers,omitempty"`
+	Endpoints         *APEndpoints `json:"endpoints,omitempty"`
+	PublicKey         APPublicKey  `json:"publicKey"`
+}
+
+// APEndpoints are the optional endpoints of an actor
+type APEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+// APPublicKey is the key an actor signs its requests with
+type APPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// DeliveryInbox is where activities for a are sent, its shared inbox when
+// it has one
+func (a *APActor) DeliveryInbox() string {
+	if a.Endpoints != nil && a.Endpoints.SharedInbox != "" {
+		return a.Endpoints.SharedInbox
+	}
+	return a.Inbox
+}
+
+// APArticle is an article as an ActivityStreams object
+type APArticle struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	AttributedTo string      `json:"attributedTo,omitempty"`
+	Name         string      `json:"name,omitempty"`
+	Content      string      `json:"content,omitempty"`
+	MediaType    string      `json:"mediaType,omitempty"`
+	URL          string      `json:"url,omitempty"`
+	Published    *time.Time  `json:"published,omitempty"`
+	To           []string    `json:"to,omitempty"`
+	Cc           []string    `json:"cc,omitempty"`
+	Tag          []APTag     `json:"tag,omitempty"`
+}
+
+// APTag is a hashtag of an APArticle
+type APTag struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Href string `json:"href,omitempty"`
+}
+
+// APActivity is an activity. Object is an IRI or an embedded object, on
+// received activities it is what encoding/json makes of either.
+type APActivity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Published *time.Time  `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object,omitempty"`
+}
+
+// APCollection is an ordered collection, OrderedItems is left out where
+// only the size is shown
+type APCollection struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	TotalItems   int         `json:"totalItems"`
+	OrderedItems interface{} `json:"orderedItems,omitempty"`
+}
+
+// APRef returns the id of an object that is given as an IRI or embedded
+func APRef(o interface{}) string {
+	switch v := o.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		id, _ := v["id"].(string)
+		return id
+	}
+	return ""
+}
+
+// APTypeOf returns the type of an embedded object, "" for an IRI
+func APTypeOf(o interface{}) string {
+	if m, ok := o.(map[string]interface{}); ok {
+		t, _ := m["type"].(string)
+		return t
+	}
+	return ""
+}
+
+// ActorKey is the key pair a local actor signs its requests with
+type ActorKey struct {
+	Actor      string
+	PrivatePEM string
+	PublicPEM  string
+	Created    time.Time
+}
+
+// Private returns the parsed private key of k
+func (k *ActorKey) Private() (*rsa.PrivateKey, error) {
+	b, _ := pem.Decode([]byte(k.PrivatePEM))
+	if b == nil {
+		return nil, fmt.Errorf("no PEM data in the key of %s", k.Actor)
+	}
+	return x509.ParsePKCS1PrivateKey(b.Bytes)
+}
+
+// newActorKey returns a new PEM encoded RSA key pair
+func newActorKey() (private string, public string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	private = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	public = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	return private, public, nil
+}
+
+// ParsePublicKeyPEM reads the publicKeyPem of an actor
+func ParsePublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	b, _ := pem.Decode([]byte(s))
+	if b == nil {
+		return nil, fmt.Errorf("no PEM data in public key")
+	}
+	if b.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(b.Bytes)
+	}
+	k, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := k.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+	return pub, nil
+}
+
+// Follower is a remote actor following a local one
+type Follower struct {
+	ID int
+	// Actor is the name of the local actor
+	Actor    string
+	Follower string
+	// Inbox is where activities for the follower are sent
+	Inbox   string
+	Created time.Time
+}
+
+// Followers is a collection of Follower
+type Followers []*Follower
+
+// signedHeaders are signed by SignRequest, digest only when there is a
+// body
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// bodyDigest returns the Digest header of body
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// signingString builds the string an HTTP signature over headers is made
+// of
+func signingString(r *http.Request, headers []string) (string, error) {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		var v string
+		switch h {
+		case "(request-target)":
+			v = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			v = r.Host
+			if v == "" {
+				v = r.URL.Host
+			}
+		default:
+			vs, ok := r.Header[http.CanonicalHeaderKey(h)]
+			if !ok {
+				return "", fmt.Errorf("signed header %q is missing", h)
+			}
+			v = strings.Join(vs, ", ")
+		}
+		lines = append(lines, h+": "+v)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// SignRequest adds the Date, Digest and Signature headers remote servers
+// check, signed with key as keyID. body is the body of r, nil for GET.
+func SignRequest(r *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	headers := signedHeaders[:3]
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if body != nil {
+		r.Header.Set("Digest", bodyDigest(body))
+		headers = signedHeaders
+	}
+
+	s, err := signingString(r, headers)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// parseSignature splits a Signature header into its parameters
+func parseSignature(h string) map[string]string {
+	params := map[string]string{}
+	for h != "" {
+		eq := strings.Index(h, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(h[:eq]))
+		h = strings.TrimSpace(h[eq+1:])
+		var value string
+		if strings.HasPrefix(h, `"`) {
+			end := strings.Index(h[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, h = h[1:end+1], h[end+2:]
+		} else {
+			end := strings.Index(h, ",")
+			if end < 0 {
+				end = len(h)
+			}
+			value, h = h[:end], h[end:]
+		}
+		params[name] = value
+		h = strings.TrimPrefix(strings.TrimSpace(h), ",")
+	}
+	return params
+}
+
+// VerifyRequest checks the HTTP signature of r, whose body has been read
+// into body. key looks up the public key named by the keyId of the
+// signature. The signature has to cover the request target, host, date
+// and, for bodies, a matching digest. It returns the keyId.
+func VerifyRequest(r *http.Request, body []byte, key func(keyID string) (*rsa.PublicKey, error)) (string, error) {
+	params := parseSignature(r.Header.Get("Signature"))
+	keyID, sig := params["keyid"], params["signature"]
+	if keyID == "" || sig == "" {
+		return "", NewError(Unauthorized, nil, "The request is not signed")
+	}
+	if alg := params["algorithm"]; alg != "" && alg != "rsa-sha256" && alg != "hs2019" {
+		return "", NewError(Unauthorized, nil, "Signature algorithm %q is not supported", alg)
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	covered := map[string]bool{}
+	for _, h := range headers {
+		covered[h] = true
+	}
+	need := signedHeaders[:3]
+	if len(body) > 0 {
+		need = signedHeaders
+	}
+	for _, h := range need {
+		if !covered[h] {
+			return "", NewError(Unauthorized, nil, "The signature has to cover %s", strings.Join(need, ", "))
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return "", NewError(Unauthorized, err, "The Date header is missing or malformed")
+	}
+	if d := time.Since(date); d > SignatureMaxAge || d < -SignatureMaxAge {
+		return "", NewError(Unauthorized, nil, "The Date of the request is too far off")
+	}
+	if len(body) > 0 && r.Header.Get("Digest") != bodyDigest(body) {
+		return "", NewError(Unauthorized, nil, "The Digest does not match the body")
+	}
+
+	s, err := signingString(r, headers)
+	if err != nil {
+		return "", NewError(Unauthorized, err, "The signature cannot be checked")
+	}
+	raw, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", NewError(Unauthorized, err, "The signature is not base64")
+	}
+	pub, err := key(keyID)
+	if err != nil {
+		return "", NewError(Unauthorized, err, "The key %q cannot be fetched", keyID)
+	}
+	sum := sha256.Sum256([]byte(s))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], raw); err != nil {
+		return "", NewError(Unauthorized, err, "The signature does not verify")
+	}
+	return keyID, nil
+}
@@ -0,0 +1,166 @@
+package dnews
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testActorKey returns a parsed key pair made by newActorKey
+func testActorKey(t *testing.T) (*rsa.PrivateKey, *rsa.PublicKey) {
+	t.Helper()
+	private, public, err := newActorKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := (&ActorKey{Actor: "test", PrivatePEM: private}).Private()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKeyPEM(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+const testKeyID = "https://remote.example/users/alice#main-key"
+
+// signedPost returns an inbox delivery of body signed with key
+func signedPost(t *testing.T, key *rsa.PrivateKey, body []byte) *http.Request {
+	t.Helper()
+	r, err := http.NewRequest("POST", "https://daemon.news/ap/actor/news/inbox", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignRequest(r, testKeyID, key, body); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// keyOf returns a key lookup that only knows testKeyID
+func keyOf(pub *rsa.PublicKey) func(string) (*rsa.PublicKey, error) {
+	return func(keyID string) (*rsa.PublicKey, error) {
+		if keyID != testKeyID {
+			return nil, fmt.Errorf("unknown key %s", keyID)
+		}
+		return pub, nil
+	}
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	priv, pub := testActorKey(t)
+	body := []byte(`{"type":"Follow"}`)
+
+	r := signedPost(t, priv, body)
+	if !strings.Contains(r.Header.Get("Signature"), `headers="(request-target) host date digest"`) {
+		t.Errorf("Signature is %q", r.Header.Get("Signature"))
+	}
+	keyID, err := VerifyRequest(r, body, keyOf(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != testKeyID {
+		t.Errorf("got key %q", keyID)
+	}
+
+	// Fetches have no body and no digest.
+	get, _ := http.NewRequest("GET", "https://remote.example/users/alice", nil)
+	if err := SignRequest(get, testKeyID, priv, nil); err != nil {
+		t.Fatal(err)
+	}
+	if get.Header.Get("Digest") != "" {
+		t.Error("a GET got a Digest")
+	}
+	if _, err := VerifyRequest(get, nil, keyOf(pub)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyRequestRejects(t *testing.T) {
+	priv, pub := testActorKey(t)
+	_, otherPub := testActorKey(t)
+	body := []byte(`{"type":"Follow"}`)
+
+	for _, tc := range []struct {
+		name   string
+		change func(r *http.Request) []byte
+		key    *rsa.PublicKey
+		want   string
+	}{
+		{"unsigned", func(r *http.Request) []byte {
+			r.Header.Del("Signature")
+			return body
+		}, pub, "not signed"},
+		{"stale date", func(r *http.Request) []byte {
+			r.Header.Set("Date", time.Now().Add(-SignatureMaxAge-time.Minute).UTC().Format(http.TimeFormat))
+			return body
+		}, pub, "too far off"},
+		{"future date", func(r *http.Request) []byte {
+			r.Header.Set("Date", time.Now().Add(SignatureMaxAge+time.Minute).UTC().Format(http.TimeFormat))
+			return body
+		}, pub, "too far off"},
+		{"changed date", func(r *http.Request) []byte {
+			r.Header.Set("Date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+			return body
+		}, pub, "does not verify"},
+		{"other body", func(r *http.Request) []byte {
+			return []byte(`{"type":"Undo"}`)
+		}, pub, "Digest does not match"},
+		{"bad digest", func(r *http.Request) []byte {
+			r.Header.Set("Digest", "SHA-256=AAAA")
+			return body
+		}, pub, "Digest does not match"},
+		{"digest not signed", func(r *http.Request) []byte {
+			r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), " digest", "", 1))
+			return body
+		}, pub, "has to cover"},
+		{"other path", func(r *http.Request) []byte {
+			r.URL.Path = "/ap/actor/beastie/inbox"
+			return body
+		}, pub, "does not verify"},
+		{"other key", func(r *http.Request) []byte { return body }, otherPub, "does not verify"},
+		{"unknown key", func(r *http.Request) []byte {
+			r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), testKeyID, "https://remote.example/users/bob#main-key", 1))
+			return body
+		}, pub, "cannot be fetched"},
+		{"hmac", func(r *http.Request) []byte {
+			r.Header.Set("Signature", strings.Replace(r.Header.Get("Signature"), "rsa-sha256", "hmac-sha256", 1))
+			return body
+		}, pub, "not supported"},
+	} {
+		r := signedPost(t, priv, body)
+		got := tc.change(r)
+		_, err := VerifyRequest(r, got, keyOf(tc.key))
+		if err == nil {
+			t.Errorf("%s: accepted", tc.name)
+			continue
+		}
+		if KindOf(err) != Unauthorized || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	got := parseSignature(`keyId="https://a.example/u#k", algorithm=rsa-sha256,headers="date",signature="ab=="`)
+	want := map[string]string{
+		"keyid":     "https://a.example/u#k",
+		"algorithm": "rsa-sha256",
+		"headers":   "date",
+		"signature": "ab==",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %q, want %q", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package dnews
+
+import "time"
+
+// APIVersion is the version of the JSON API served under /api/v1
+const APIVersion = "v1"
+
+// APIArticle is an article as sent and returned by the JSON API. Markdown
+// and Signature are left out of listings.
+type APIArticle struct {
+	ID        int       `json:"id"`
+	Slug      string    `json:"slug"`
+	Title     string    `json:"title"`
+	Date      time.Time `json:"date"`
+	Live      bool      `json:"live"`
+	Author    string    `json:"author"`
+	Tags      []string  `json:"tags"`
+	Signed    bool      `json:"signed"`
+	Markdown  string    `json:"markdown,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// APIArticleInput is the body of requests creating or updating an article.
+// Title, date and tags come from the header lines of Markdown, Signature is
+// the signify signature of Markdown made with the author's key.
+type APIArticleInput struct {
+	Markdown   string `json:"markdown"`
+	Signature  string `json:"signature"`
+	Live       bool   `json:"live,omitempty"`
+	CreateTags bool   `json:"create_tags,omitempty"`
+}
+
+// APITag is a tag as returned by the JSON API
+type APITag struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// APIBug is an approved user group as returned by the JSON API
+type APIBug struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Descr    string `json:"description"`
+	URL      string `json:"url"`
+	Region   string `json:"region"`
+	Location string `json:"location"`
+	Active   bool   `json:"active"`
+}
+
+// APIPage wraps every listing of the JSON API
+type APIPage struct {
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+	Data    interface{} `json:"data"`
+}
+
+// APIError is the body of every failed JSON API request
+type APIError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
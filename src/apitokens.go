@@ -0,0 +1,90 @@
+package dnews
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be limited to. A scope never grants more than
+// the role of the token's owner does.
+const (
+	// ScopeRead lets the token read through the API, drafts included
+	ScopeRead = "read"
+	// ScopeWriteArticles lets the token create, change and publish the
+	// owner's own articles
+	ScopeWriteArticles = "write:articles"
+	// ScopeAdmin lets the token use the owner's editor and administrator
+	// permissions, like changing other people's articles
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists every scope in the order they are shown
+var Scopes = []string{ScopeRead, ScopeWriteArticles, ScopeAdmin}
+
+// APITokenPrefix starts every API token so they are easy to spot in
+// configuration files and logs
+const APITokenPrefix = "dn_"
+
+// APIToken is a named key for the JSON API. Only the hash of the token is
+// kept, it is shown once when created.
+type APIToken struct {
+	ID       int
+	UserID   int
+	UserName string
+	Name     string
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+	// Expires is zero for tokens that are good until revoked
+	Expires time.Time
+}
+
+// APITokens is a collection of APIToken
+type APITokens []*APIToken
+
+// Has reports whether t was given scope
+func (t *APIToken) Has(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckScopes makes sure scopes is a non empty list of known scopes
+func CheckScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return NewError(Invalid, nil, "A token needs at least one scope")
+	}
+	for _, s := range scopes {
+		known := false
+		for _, k := range Scopes {
+			known = known || s == k
+		}
+		if !known {
+			return NewError(Invalid, nil, "%q is not a scope, use one of %s", s, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+// newAPIToken returns a random API token and the hash stored for it
+func newAPIToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = APITokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashAPIToken(token), nil
+}
+
+// hashAPIToken returns what is stored for token
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,77 @@
+package dnews
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashAPIToken(t *testing.T) {
+	// sha256 of "dn_test", hex encoded
+	const want = "01f6e7cfae06b31e386648b4a06996c029a7020b7c4dac0007b71f547d6e1285"
+	if got := hashAPIToken("dn_test"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestNewAPIToken(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		token, hash, err := newAPIToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(token, APITokenPrefix) || len(token) != len(APITokenPrefix)+43 {
+			t.Errorf("token %q is not dn_ and 32 random bytes", token)
+		}
+		if hash != hashAPIToken(token) {
+			t.Errorf("hash of %q does not match", token)
+		}
+		if strings.Contains(hash, token) {
+			t.Error("the token is stored in the clear")
+		}
+		if seen[token] {
+			t.Errorf("token %q handed out twice", token)
+		}
+		seen[token] = true
+	}
+}
+
+func TestAPITokenHas(t *testing.T) {
+	tok := &APIToken{Scopes: []string{ScopeRead, ScopeWriteArticles}}
+	for scope, want := range map[string]bool{
+		ScopeRead:          true,
+		ScopeWriteArticles: true,
+		ScopeAdmin:         false,
+		"":                 false,
+		"READ":             false,
+	} {
+		if got := tok.Has(scope); got != want {
+			t.Errorf("Has(%q) = %v, want %v", scope, got, want)
+		}
+	}
+	if (&APIToken{}).Has(ScopeRead) {
+		t.Error("a token without scopes has read")
+	}
+}
+
+func TestCheckScopes(t *testing.T) {
+	for _, tc := range []struct {
+		scopes []string
+		ok     bool
+	}{
+		{nil, false},
+		{[]string{}, false},
+		{[]string{ScopeRead}, true},
+		{Scopes, true},
+		{[]string{ScopeRead, "write"}, false},
+		{[]string{"admin "}, false},
+	} {
+		err := CheckScopes(tc.scopes)
+		if (err == nil) != tc.ok {
+			t.Errorf("CheckScopes(%q) = %v", tc.scopes, err)
+		}
+		if err != nil && KindOf(err) != Invalid {
+			t.Errorf("CheckScopes(%q) failed with kind %v", tc.scopes, KindOf(err))
+		}
+	}
+}
@@ -2,9 +2,9 @@ package dnews
 
 import (
 	//	"database/sql"
-	"bufio"
 	"bytes"
-	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
@@ -15,6 +15,7 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/russross/blackfriday"
+	"github.com/sirupsen/logrus"
 )
 
 // AuthorRE is a regex to grab our Authors
@@ -29,6 +30,10 @@ var DateRE = regexp.MustCompile(`^date:\s(.*)$`)
 // TagRE matches the tags for a given article
 var TagRE = regexp.MustCompile(`^tags:\s(.*)$`)
 
+// ObserveVerify, when set, is called with the time taken by every signature
+// verification
+var ObserveVerify func(time.Duration)
+
 // Tag represents a specific tag for an article
 type Tag struct {
 	ID      int
@@ -36,6 +41,16 @@ type Tag struct {
 	Name    string
 }
 
+var tagNameRE = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// ValidTagName checks that name can be used in a /tag/ URL
+func ValidTagName(name string) error {
+	if !tagNameRE.MatchString(name) {
+		return NewError(Invalid, nil, "%q is not a valid tag name, use letters, digits and dashes", name)
+	}
+	return nil
+}
+
 // Tags are a collection of Tag
 type Tags []*Tag
 
@@ -54,6 +69,9 @@ type Article struct {
 	Headline  []byte
 	Rank      float64
 	Tags      Tags
+	// Mentions are the approved Webmentions of the article, only loaded
+	// for its page
+	Mentions Webmentions
 }
 
 // Join returns a concat'd string of Tag names
@@ -71,6 +89,12 @@ func (t *Tags) String() string {
 
 // Verify validates the signature of an article
 func (a *Article) Verify(pub []byte) (*bool, error) {
+	if ObserveVerify != nil {
+		defer func(start time.Time) {
+			ObserveVerify(time.Since(start))
+		}(time.Now())
+	}
+
 	_, pcontent, err := signify.ReadFile(bytes.NewReader(pub))
 	_, scontent, err := signify.ReadFile(bytes.NewReader([]byte(a.Signature)))
 
@@ -97,26 +121,45 @@ func (a *Article) LoadFromFile(p string) error {
 	if err != nil {
 		return err
 	}
-	scanner := bufio.NewScanner(file)
+	defer file.Close()
+
+	if err := a.Load(file); err != nil {
+		return err
+	}
+
+	Log.WithFields(logrus.Fields{
+		"file":   p,
+		"author": a.Author.Combine(),
+		"title":  a.Title,
+		"date":   a.Date,
+		"tags":   a.Tags.String(),
+	}).Info("loaded article")
+
+	return nil
+}
+
+// Load reads an article in markdown from r. The author, title, date and
+// tags are taken from its header lines, the body is kept byte for byte so
+// its signature can be checked.
+func (a *Article) Load(r io.Reader) error {
+	body, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	a.Body = body
 
-	for scanner.Scan() {
-		var line = scanner.Bytes()
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
 		if AuthorRE.Match(line) {
 			aline := AuthorRE.ReplaceAllString(string(line), "$1")
 			a.Author.Parse(aline)
-			fmt.Printf("Author: %s %s (%s)\n", a.Author.FName, a.Author.LName, a.Author.Email)
 		}
 		if TitleRE.Match(line) {
 			a.Title = TitleRE.ReplaceAllString(string(line), "$1")
-			fmt.Printf("Title: %s\n", a.Title)
 		}
 		if DateRE.Match(line) {
 			d := DateRE.ReplaceAllString(string(line), "$1")
 			a.Date, _ = time.Parse(time.RFC1123, d)
-			fmt.Printf("Date: %s\n", a.Date)
 		}
 
 		if TagRE.Match(line) {
@@ -126,16 +169,9 @@ func (a *Article) LoadFromFile(p string) error {
 				t.Name = strings.TrimSpace(tag)
 				a.Tags = append(a.Tags, &t)
 			}
-			fmt.Printf("Tags: %s\n", a.Tags.Join())
 		}
-
-		a.Body = append(a.Body, line...)
-		a.Body = append(a.Body, 10)
 	}
 
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -154,4 +190,15 @@ func (a *Article) HTML() {
 // Articles represent a collection of a set of Article
 type Articles []*Article
 
+// ArticleFilter selects articles for GetArticles. Only live articles are
+// returned unless Drafts is set, DraftsBy then limits the drafts to those
+// of one author. AuthorID limits all articles to those of one author.
+type ArticleFilter struct {
+	Drafts   bool
+	DraftsBy int
+	AuthorID int
+	Limit    int
+	Offset   int
+}
+
 //func (a *Articles) GetSynopsis
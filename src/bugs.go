@@ -1,16 +1,65 @@
 package dnews
 
 import (
+	"net/url"
+	"strings"
 	"time"
 )
 
+// Moderation states of a Bug. Only approved groups are shown to visitors.
+const (
+	BugPending  = "pending"
+	BugApproved = "approved"
+	BugRejected = "rejected"
+)
+
 // Bug is the structure of a BSD User Group
 type Bug struct {
-	ID      int
-	Created time.Time
-	Name    string
-	Descr   string
-	URL     string
+	ID       int
+	Created  time.Time
+	Name     string
+	Descr    string
+	URL      string
+	Region   string
+	Location string
+	Contact  string
+	Active   bool
+	Status   string
+	FeedURL  string
+}
+
+// Validate checks that b has a name, a description and a usable URL
+func (b *Bug) Validate() error {
+	if strings.TrimSpace(b.Name) == "" || len(b.Name) > 200 {
+		return NewError(Invalid, nil, "A name of at most 200 characters is required")
+	}
+	if strings.TrimSpace(b.Descr) == "" || len(b.Descr) > 2000 {
+		return NewError(Invalid, nil, "A description of at most 2000 characters is required")
+	}
+	if len(b.Region) > 200 || len(b.Location) > 200 || len(b.Contact) > 200 {
+		return NewError(Invalid, nil, "Region, location and contact are limited to 200 characters")
+	}
+	if !validHTTPURL(b.URL) {
+		return NewError(Invalid, nil, "%q is not a valid http or https URL", b.URL)
+	}
+	if b.FeedURL != "" && !validHTTPURL(b.FeedURL) {
+		return NewError(Invalid, nil, "%q is not a valid http or https feed URL", b.FeedURL)
+	}
+	return nil
+}
+
+// validHTTPURL reports whether s is an absolute http or https URL
+func validHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// BugFilter narrows down the results of GetBugs. Zero values match everything.
+type BugFilter struct {
+	Region     string
+	Status     string
+	ActiveOnly bool
+	WithFeed   bool
 }
 
 // Bugs are a collection of bug!
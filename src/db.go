@@ -1,8 +1,10 @@
 package dnews
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"strings"
+	"time"
 
 	// postgresql
 	"github.com/lib/pq"
@@ -17,39 +19,147 @@ func DBConnect() (*sql.DB, error) {
 	return sql.Open("postgres", cstr.ToString())
 }
 
-// Auth checks a user's username / password for login
+// Lockout policy applied by Auth: after LockoutFree failed logins in a row
+// an account is locked for LockoutBase, doubling with every further
+// failure up to LockoutMax.
+const (
+	LockoutFree = 5
+	LockoutBase = time.Minute
+	LockoutMax  = time.Hour
+)
+
+// ErrBadLogin is returned by Auth for unknown users, wrong passwords and
+// disabled accounts alike, so callers can not tell them apart
+var ErrBadLogin = NewError(Forbidden, nil, "Invalid user name or password")
+
+// ErrLockedOut is returned by Auth for accounts locked after too many
+// failed logins
+var ErrLockedOut = NewError(Limited, nil, "Too many failed logins, please try again later")
+
+// ErrTaken is returned by RegisterUser when the user name or email address
+// already belongs to an account
+var ErrTaken = NewError(Invalid, nil, "The user name or email address is already taken")
+
+// Auth checks a user's username / password for login. Failed attempts
+// count towards locking the account, see LockoutFree.
 func Auth(db *sql.DB, u string, p string) (*User, error) {
+	return AuthContext(context.Background(), db, u, p)
+}
+
+// AuthContext is Auth with a context
+func AuthContext(ctx context.Context, db *sql.DB, u string, p string) (*User, error) {
 	var user = &User{}
+	var locked bool
 
-	err := db.QueryRow(`select id, created, fname, lname, email, username, (hash = crypt($1, hash)) as authed, admin from users where username = $2`, p, u).Scan(&user.ID, &user.Created, &user.FName, &user.LName, &user.Email, &user.User, &user.Authed, &user.Admin)
+	err := db.QueryRowContext(ctx, `select id, created, fname, lname, email, username, (hash = crypt($1, hash)) as authed, role, `+userPerms+`, verified, pass_changed, totp_secret <> '', coalesce(locked_until > now(), false) from users where username = $2 and not disabled`, p, u).Scan(&user.ID, &user.Created, &user.FName, &user.LName, &user.Email, &user.User, &user.Authed, &user.Role, pq.Array(&user.Perms), &user.Verified, &user.PassChanged, &user.TOTP, &locked)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			// Spend as long as a real check would, so response times do
+			// not give away which user names exist.
+			db.ExecContext(ctx, `select crypt($1, gen_salt('bf', 10))`, p)
+			return nil, ErrBadLogin
+		}
 		return nil, err
 	}
 
+	if locked {
+		return nil, ErrLockedOut
+	}
+
+	if !user.Authed {
+		if err := failLogin(ctx, db, user.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrBadLogin
+	}
+
+	// With two-factor authentication the login is not done yet,
+	// CheckTOTP clears the failures once the code is right.
+	if !user.TOTP {
+		_, err = db.ExecContext(ctx, `update users set failed_logins = 0, locked_until = null where id = $1 and failed_logins > 0`, user.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only say so once the password checked out, so this does not tell
+	// strangers which accounts exist.
+	if user.Authed && !user.Verified {
+		return nil, NewError(Forbidden, nil, "Please confirm your email address before logging in")
+	}
+
 	return user, nil
 }
 
-// GetRawArticle returns the raw markdown for a given article
+// execer is a *sql.DB or a *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// lockoutDoublings is how often LockoutBase doubles before it reaches
+// LockoutMax. failLogin caps the exponent there, so power() does not
+// overflow after a long run of failures.
+func lockoutDoublings() int {
+	n := 0
+	for d := LockoutBase; d < LockoutMax; d *= 2 {
+		n++
+	}
+	return n
+}
+
+// failLogin counts a failed login of the user with the given id and locks
+// the account once there were too many
+func failLogin(ctx context.Context, e execer, id int) error {
+	_, err := e.ExecContext(ctx, `
+		update users set
+		failed_logins = failed_logins + 1,
+		locked_until = case
+			when failed_logins + 1 >= $2 then now() + least($3 * power(2, least(failed_logins + 1 - $2, $5)), $4) * interval '1 second'
+			else locked_until
+		end
+		where id = $1
+		`, id, LockoutFree, LockoutBase.Seconds(), LockoutMax.Seconds(), lockoutDoublings())
+	return err
+}
+
+// GetRawArticle returns the raw markdown for a given article, live or not
 func GetRawArticle(db *sql.DB, slug string) (*Article, error) {
-	var a = Article{}
-	err := db.QueryRow(`
-SELECT
- body
-from articles
-where
-  slug = $1
-`, slug).Scan(&a.Body)
+	return GetRawArticleContext(context.Background(), db, slug)
+}
+
+// GetRawArticleContext is GetRawArticle with a context
+func GetRawArticleContext(ctx context.Context, db *sql.DB, slug string) (*Article, error) {
+	a, err := scanArticle(db.QueryRowContext(ctx, `
+		select `+articleColumns+`
+		from articles
+		join users on (articles.authorid = users.id)
+		where articles.slug = $1`, slug))
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "No article named %q", slug)
 	}
 
-	return &a, nil
+	return a, nil
+}
+
+// GetBugs grabs the bugs in the db matching f, ordered by region and name
+func GetBugs(db *sql.DB, f BugFilter) (*Bugs, error) {
+	return GetBugsContext(context.Background(), db, f)
 }
 
-// GetBugs grabs all the bugs in the db
-func GetBugs(db *sql.DB) (*Bugs, error) {
+// GetBugsContext is GetBugs with a context
+func GetBugsContext(ctx context.Context, db *sql.DB, f BugFilter) (*Bugs, error) {
 	var bs = Bugs{}
-	rows, err := db.Query(`select * from bugs`)
+	rows, err := db.QueryContext(ctx, `
+		select
+		id, created, name, descr, url, region, location, contact, active, status, feed_url
+		from bugs
+		where
+		($1 = '' or region = $1) and
+		($2 = '' or status = $2) and
+		(not $3 or active) and
+		(not $4 or feed_url <> '')
+		order by region, name
+		`, f.Region, f.Status, f.ActiveOnly, f.WithFeed)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +168,10 @@ func GetBugs(db *sql.DB) (*Bugs, error) {
 
 	for rows.Next() {
 		var b = Bug{}
-		rows.Scan(&b.ID, &b.Created, &b.Name, &b.Descr, &b.URL)
+		err := rows.Scan(&b.ID, &b.Created, &b.Name, &b.Descr, &b.URL, &b.Region, &b.Location, &b.Contact, &b.Active, &b.Status, &b.FeedURL)
+		if err != nil {
+			return nil, err
+		}
 
 		bs = append(bs, &b)
 	}
@@ -66,127 +179,174 @@ func GetBugs(db *sql.DB) (*Bugs, error) {
 	return &bs, nil
 }
 
-// GetArticle returns the raw markdown for a given article
-func GetArticle(db *sql.DB, slug string) (*Article, error) {
-	var a = Article{}
-	err := db.QueryRow(`
-SELECT
- articles.id,
- slug,
- published,
- title,
- body,
- key,
- email,
- fname,
- lname,
- sig
-from articles
-join users on
-  (articles.authorid = users.id)
-join pubkeys on
-  (pubkeys.userid = users.id)
-where
-  articles.slug = $1
-`, slug).Scan(&a.ID, &a.Slug, &a.Date, &a.Title, &a.Body, &a.Author.Pubkey, &a.Author.Email, &a.Author.FName, &a.Author.LName, &a.Signature)
+// GetBugRegions returns the distinct regions of active, approved bugs
+func GetBugRegions(db *sql.DB) ([]string, error) {
+	return GetBugRegionsContext(context.Background(), db)
+}
+
+// GetBugRegionsContext is GetBugRegions with a context
+func GetBugRegionsContext(ctx context.Context, db *sql.DB) ([]string, error) {
+	var regions []string
+	rows, err := db.QueryContext(ctx, `select distinct region from bugs where active and status = 'approved' and region <> '' order by region`)
 	if err != nil {
 		return nil, err
 	}
 
-	t, err := GetTags(db, a.ID)
-	if err != nil {
-		return nil, err
+	defer rows.Close()
+
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		regions = append(regions, r)
 	}
 
-	a.Tags = t
-	a.HTML()
+	return regions, nil
+}
 
-	return &a, nil
+// GetBug returns the bug with the given id
+func GetBug(db *sql.DB, id int) (*Bug, error) {
+	return GetBugContext(context.Background(), db, id)
 }
 
-// GetTagIDS takes a list of tag names and returns a set of tag ids
-func GetTagIDS(db *sql.DB, s []string) (tagIDS []int, err error) {
-	sql := `
-select
-  id
-from tags
-where
-  name = ANY($1)
-`
-	rows, err := db.Query(sql, pq.Array(s))
+// GetBugContext is GetBug with a context
+func GetBugContext(ctx context.Context, db *sql.DB, id int) (*Bug, error) {
+	var b = Bug{}
+	err := db.QueryRowContext(ctx, `select id, created, name, descr, url, region, location, contact, active, status, feed_url from bugs where id = $1`, id).Scan(&b.ID, &b.Created, &b.Name, &b.Descr, &b.URL, &b.Region, &b.Location, &b.Contact, &b.Active, &b.Status, &b.FeedURL)
 	if err != nil {
+		return nil, notFound(err, "No user group with id %d", id)
+	}
+
+	return &b, nil
+}
+
+// InsertBug adds a new bug. Bugs without a Status are approved.
+func InsertBug(db *sql.DB, b Bug) (*int, error) {
+	return InsertBugContext(context.Background(), db, b)
+}
+
+// InsertBugContext is InsertBug with a context
+func InsertBugContext(ctx context.Context, db *sql.DB, b Bug) (*int, error) {
+	if err := b.Validate(); err != nil {
 		return nil, err
 	}
 
-	defer rows.Close()
+	if b.Status == "" {
+		b.Status = BugApproved
+	}
 
-	for rows.Next() {
-		var i int
-		rows.Scan(&i)
-		tagIDS = append(tagIDS, i)
+	var id int
+	err := db.QueryRowContext(ctx, `insert into bugs (name, descr, url, region, location, contact, active, status, feed_url) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`, b.Name, b.Descr, b.URL, b.Region, b.Location, b.Contact, b.Active, b.Status, b.FeedURL).Scan(&id)
+	if err != nil {
+		return nil, err
 	}
 
-	return tagIDS, nil
+	return &id, nil
 }
 
-// GetAllTags returns all the tags in the DB
-func GetAllTags(db *sql.DB) (Tags, error) {
-	var ts = Tags{}
-	rows, err := db.Query(`select id, created, name from tags`)
+// UpdateBug saves every field of b
+func UpdateBug(db *sql.DB, b Bug) error {
+	return UpdateBugContext(context.Background(), db, b)
+}
+
+// UpdateBugContext is UpdateBug with a context
+func UpdateBugContext(ctx context.Context, db *sql.DB, b Bug) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `update bugs set name = $1, descr = $2, url = $3, region = $4, location = $5, contact = $6, active = $7, feed_url = $8 where id = $9`, b.Name, b.Descr, b.URL, b.Region, b.Location, b.Contact, b.Active, b.FeedURL, b.ID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer rows.Close()
+	return rowAffected(res, "No user group with id %d", b.ID)
+}
 
-	for rows.Next() {
-		var t = Tag{}
-		err := rows.Scan(&t.ID, &t.Created, &t.Name)
-		if err != nil {
-			return nil, err
-		}
-		ts = append(ts, &t)
+// SetBugStatus moves a bug through moderation, see BugPending and friends
+func SetBugStatus(db *sql.DB, id int, status string) error {
+	return SetBugStatusContext(context.Background(), db, id, status)
+}
+
+// SetBugStatusContext is SetBugStatus with a context
+func SetBugStatusContext(ctx context.Context, db *sql.DB, id int, status string) error {
+	switch status {
+	case BugPending, BugApproved, BugRejected:
+	default:
+		return NewError(Invalid, nil, "Unknown status %q", status)
 	}
 
-	return ts, nil
+	res, err := db.ExecContext(ctx, `update bugs set status = $1 where id = $2`, status, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No user group with id %d", id)
 }
 
-// GetAllUsers gets all the users in the DB
-func GetAllUsers(db *sql.DB) (Users, error) {
-	var us = Users{}
+// DeleteBug removes the bug with the given id
+func DeleteBug(db *sql.DB, id int) error {
+	return DeleteBugContext(context.Background(), db, id)
+}
 
-	rows, err := db.Query(`select id, created, fname, lname, email, username, admin from users`)
+// DeleteBugContext is DeleteBug with a context
+func DeleteBugContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `delete from bugs where id = $1`, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer rows.Close()
+	return rowAffected(res, "No user group with id %d", id)
+}
 
-	for rows.Next() {
-		var u = User{}
-		err := rows.Scan(&u.ID, &u.Created, &u.FName, &u.LName, &u.Email, &u.User, &u.Admin)
-		if err != nil {
-			return nil, err
-		}
-		us = append(us, &u)
+// eventColumns are the columns scanEvent expects, in order
+const eventColumns = `e.id, e.created, e.bugid, coalesce(b.name, ''), e.kind, e.title, e.descr, e.location, e.url, e.starts, e.ends, e.tz, e.recur, e.recur_until`
+
+// scanEvent reads a row selected with eventColumns
+func scanEvent(row interface {
+	Scan(...interface{}) error
+}) (*Event, error) {
+	var e = Event{}
+	var bugID sql.NullInt64
+	var until pq.NullTime
+	err := row.Scan(&e.ID, &e.Created, &bugID, &e.BugName, &e.Kind, &e.Title, &e.Descr, &e.Location, &e.URL, &e.Starts, &e.Ends, &e.TZ, &e.Recur, &until)
+	if err != nil {
+		return nil, err
 	}
+	e.BugID = int(bugID.Int64)
+	e.RecurUntil = until.Time
 
-	return us, nil
+	return &e, nil
 }
 
-// GetTags returns tags for a given article
-func GetTags(db *sql.DB, id int) (Tags, error) {
-	var ts = Tags{}
-	rows, err := db.Query(`
-		select
-		tags.id,
-		tags.name
-		from article_tags
-		join tags on
-		(article_tags.tagid = tags.id)
+// nullID maps the zero id to NULL for optional references
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) pq.NullTime {
+	return pq.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// GetEvents grabs the events matching f, ordered by start
+func GetEvents(db *sql.DB, f EventFilter) (Events, error) {
+	return GetEventsContext(context.Background(), db, f)
+}
+
+// GetEventsContext is GetEvents with a context
+func GetEventsContext(ctx context.Context, db *sql.DB, f EventFilter) (Events, error) {
+	var es = Events{}
+	rows, err := db.QueryContext(ctx, `
+		select `+eventColumns+`
+		from events e
+		left join bugs b on (e.bugid = b.id)
 		where
-		articleid = $1
-		`, id)
+		($1 = 0 or e.bugid = $1) and
+		(not $2 or e.bugid is null or (b.active and b.status = 'approved'))
+		order by e.starts
+		`, f.BugID, f.PublicOnly)
 	if err != nil {
 		return nil, err
 	}
@@ -194,164 +354,131 @@ func GetTags(db *sql.DB, id int) (Tags, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var t = Tag{}
-		err := rows.Scan(&t.ID, &t.Name)
+		e, err := scanEvent(rows)
 		if err != nil {
 			return nil, err
 		}
-		ts = append(ts, &t)
+
+		es = append(es, e)
 	}
-	return ts, nil
+
+	return es, nil
 }
 
-// GetUserIDByEmail takes a users email and returns a User that is associated with it
-func GetUserIDByEmail(db *sql.DB, e string) (id *int, err error) {
-	err = db.QueryRow(`
-select id from users where email = $1
-`, e).Scan(&id)
+// GetEvent returns the event with the given id
+func GetEvent(db *sql.DB, id int) (*Event, error) {
+	return GetEventContext(context.Background(), db, id)
+}
+
+// GetEventContext is GetEvent with a context
+func GetEventContext(ctx context.Context, db *sql.DB, id int) (*Event, error) {
+	e, err := scanEvent(db.QueryRowContext(ctx, `select `+eventColumns+` from events e left join bugs b on (e.bugid = b.id) where e.id = $1`, id))
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "No event with id %d", id)
 	}
 
-	return id, nil
+	return e, nil
 }
 
-// GetArticlesByTag tags a tag and returns all the matching articles
-func GetArticlesByTag(db *sql.DB, t string) (Articles, error) {
-	var as = Articles{}
-	rows, err := db.Query(`
-		SELECT
-		articles.id,
-		slug,
-		published,
-		title,
-		body,
-		key,
-		email,
-		fname,
-		lname,
-		sig
-		from articles
-		join users on
-		(articles.authorid = users.id)
-		join pubkeys on
-		(pubkeys.userid = users.id)
-		join article_tags on
-		(article_tags.articleid = articles.id)
-		join tags on
-		(article_tags.tagid = tags.id)
-		where
-		live = true and
-		tags.name = $1
-		order by published desc
-		`, t)
+// InsertEvent adds a new event
+func InsertEvent(db *sql.DB, e Event) (*int, error) {
+	return InsertEventContext(context.Background(), db, e)
+}
+
+// InsertEventContext is InsertEvent with a context
+func InsertEventContext(ctx context.Context, db *sql.DB, e Event) (*int, error) {
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+
+	var id int
+	err := db.QueryRowContext(ctx, `insert into events (bugid, kind, title, descr, location, url, starts, ends, tz, recur, recur_until) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) returning id`, nullID(e.BugID), e.Kind, e.Title, e.Descr, e.Location, e.URL, e.Starts, e.Ends, e.TZ, e.Recur, nullTime(e.RecurUntil)).Scan(&id)
 	if err != nil {
+		if isViolation(err, "foreign_key_violation") {
+			return nil, NewError(Invalid, err, "No user group with id %d", e.BugID)
+		}
 		return nil, err
 	}
 
-	defer rows.Close()
+	return &id, nil
+}
 
-	for rows.Next() {
-		var a = Article{}
-		err := rows.Scan(&a.ID, &a.Slug, &a.Date, &a.Title, &a.Body, &a.Author.Pubkey, &a.Author.Email, &a.Author.FName, &a.Author.LName, &a.Signature)
-		if err != nil {
-			return nil, err
-		}
-		t, err := GetTags(db, a.ID)
-		if err != nil {
-			return nil, err
+// UpdateEvent saves every field of e
+func UpdateEvent(db *sql.DB, e Event) error {
+	return UpdateEventContext(context.Background(), db, e)
+}
+
+// UpdateEventContext is UpdateEvent with a context
+func UpdateEventContext(ctx context.Context, db *sql.DB, e Event) error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `update events set bugid = $1, kind = $2, title = $3, descr = $4, location = $5, url = $6, starts = $7, ends = $8, tz = $9, recur = $10, recur_until = $11 where id = $12`, nullID(e.BugID), e.Kind, e.Title, e.Descr, e.Location, e.URL, e.Starts, e.Ends, e.TZ, e.Recur, nullTime(e.RecurUntil), e.ID)
+	if err != nil {
+		if isViolation(err, "foreign_key_violation") {
+			return NewError(Invalid, err, "No user group with id %d", e.BugID)
 		}
-		a.Tags = t
-		a.Verify(a.Author.Pubkey)
-		a.HTML()
-		as = append(as, &a)
+		return err
 	}
 
-	return as, nil
+	return rowAffected(res, "No event with id %d", e.ID)
 }
 
-// GetNArticles returns N most recent articles from the DB
-func GetNArticles(db *sql.DB, n int) (Articles, error) {
-	var as = Articles{}
+// DeleteEvent removes the event with the given id
+func DeleteEvent(db *sql.DB, id int) error {
+	return DeleteEventContext(context.Background(), db, id)
+}
 
-	rows, err := db.Query(`
-		SELECT
-		articles.id,
-		slug,
-		published,
-		title,
-		body,
-		key,
-		email,
-		fname,
-		lname,
-		sig
-		from articles
-		join users on
-		(articles.authorid = users.id)
-		join pubkeys on
-		(pubkeys.userid = users.id)
-		where
-		live = true
-		order by published desc
-		limit $1
-		`, n)
+// DeleteEventContext is DeleteEvent with a context
+func DeleteEventContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `delete from events where id = $1`, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defer rows.Close()
+	return rowAffected(res, "No event with id %d", id)
+}
 
-	for rows.Next() {
-		var a = Article{}
-		err := rows.Scan(&a.ID, &a.Slug, &a.Date, &a.Title, &a.Body, &a.Author.Pubkey, &a.Author.Email, &a.Author.FName, &a.Author.LName, &a.Signature)
+// InsertEntries stores the entries fetched from the feed of a bug, skipping
+// the ones already known by GUID. It returns how many were new.
+func InsertEntries(db *sql.DB, bugID int, es Entries) (int, error) {
+	return InsertEntriesContext(context.Background(), db, bugID, es)
+}
+
+// InsertEntriesContext is InsertEntries with a context
+func InsertEntriesContext(ctx context.Context, db *sql.DB, bugID int, es Entries) (int, error) {
+	n := 0
+	for _, e := range es {
+		res, err := db.ExecContext(ctx, `insert into planet (bugid, guid, title, link, author, content, published) values ($1, $2, $3, $4, $5, $6, $7) on conflict (bugid, guid) do nothing`, bugID, e.GUID, e.Title, e.Link, e.Author, string(e.Content), e.Published)
 		if err != nil {
-			return nil, err
+			return n, err
 		}
-		t, err := GetTags(db, a.ID)
-		if err != nil {
-			return nil, err
+		if c, err := res.RowsAffected(); err == nil {
+			n += int(c)
 		}
-		a.Tags = t
-		a.Verify(a.Author.Pubkey)
-		a.HTML()
-		as = append(as, &a)
 	}
 
-	return as, nil
+	return n, nil
 }
 
-// SearchArticles uses pg's TS stuff to query all the articles for passed in values
-func SearchArticles(db *sql.DB, query string, limit int) (Articles, error) {
-	var as = Articles{}
-	rows, err := db.Query(`
-		SELECT
-		aid as id,
-		slug,
-		published,
-		title,
-		body,
-		key,
-		email,
-		fname,
-		lname,
-		sig,
-		ts_headline(body, q) as headline,
-		rank
-		FROM (
-			SELECT
-			*,
-			articles.id as aid,
-			ts_rank_cd(tsv, q) as rank
-			FROM articles
-			join users on
-			(articles.authorid = users.id)
-			join pubkeys on
-			(pubkeys.userid = users.id), plainto_tsquery($1) q
-			WHERE tsv @@ q
-			ORDER BY rank DESC
-			LIMIT $2) AS foo;
-		`, query, limit)
+// GetEntries returns the newest n planet entries of active, approved bugs
+func GetEntries(db *sql.DB, n int) (Entries, error) {
+	return GetEntriesContext(context.Background(), db, n)
+}
+
+// GetEntriesContext is GetEntries with a context
+func GetEntriesContext(ctx context.Context, db *sql.DB, n int) (Entries, error) {
+	var es = Entries{}
+	rows, err := db.QueryContext(ctx, `
+		select
+		p.id, p.bugid, b.name, b.url, p.guid, p.title, p.link, p.author, p.content, p.published
+		from planet p
+		join bugs b on (p.bugid = b.id)
+		where b.active and b.status = 'approved'
+		order by p.published desc
+		limit $1
+		`, n)
 	if err != nil {
 		return nil, err
 	}
@@ -359,58 +486,1856 @@ func SearchArticles(db *sql.DB, query string, limit int) (Articles, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var a = Article{}
-		err := rows.Scan(&a.ID, &a.Slug, &a.Date, &a.Title, &a.Body, &a.Author.Pubkey, &a.Author.Email, &a.Author.FName, &a.Author.LName, &a.Signature, &a.Headline, &a.Rank)
+		var e = Entry{}
+		err := rows.Scan(&e.ID, &e.BugID, &e.BugName, &e.BugURL, &e.GUID, &e.Title, &e.Link, &e.Author, &e.Content, &e.Published)
 		if err != nil {
 			return nil, err
 		}
 
-		a.Verify(a.Author.Pubkey)
-		a.HTML()
-
-		as = append(as, &a)
+		es = append(es, &e)
 	}
 
-	return as, nil
+	return es, nil
 }
 
-// InsertUser takes a User and inserts them into the database
-func InsertUser(db *sql.DB, u User) (*int, error) {
-	var id int
-	err := db.QueryRow(`INSERT INTO users (fname, lname, email, username, hash) values ($1, $2, $3, (select hash($4)))`, u.FName, u.LName, u.Email, u.User, u.Pass).Scan(&id)
-	if err != nil {
-		return nil, err
-	}
-	return &id, nil
+// GetArticle returns the raw markdown for a given article, live or not
+func GetArticle(db *sql.DB, slug string) (*Article, error) {
+	return GetArticleContext(context.Background(), db, slug)
 }
 
-// InsertArticle takes an Article and inserts it into the db, it will verify the Author exists
-// prior to inserting
-func InsertArticle(db *sql.DB, a Article) (*int, error) {
-	var id int
-	uid, err := AssignUser(db, a.Author.Email)
+// GetArticleContext is GetArticle with a context
+func GetArticleContext(ctx context.Context, db *sql.DB, slug string) (*Article, error) {
+	a, err := scanArticle(db.QueryRowContext(ctx, `
+		select `+articleColumns+`
+		from articles
+		join users on (articles.authorid = users.id)
+		where articles.slug = $1`, slug))
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "No article named %q", slug)
 	}
 
-	a.AuthorID = *uid
-
-	fmt.Printf("AuthorID: %d\n", a.AuthorID)
-
-	err = db.QueryRow(`INSERT INTO articles (title, body, created, live, sig, authorid) values ($1, $2, $3, $4, $5, $6) returning id`, a.Title, a.Body, a.Date, a.Live, a.Signature, a.AuthorID).Scan(&id)
+	a.Tags, err = GetTagsContext(ctx, db, a.ID)
 	if err != nil {
 		return nil, err
 	}
 
-	a.ID = id
+	a.HTML()
 
-	tags, err := GetTagIDS(db, a.Tags.Join())
-	if err != nil {
-		return nil, err
-	}
+	return a, nil
+}
 
-	err = AssignTags(db, tags, a.ID)
+// articleColumns are read by scanArticle. The newest public key of the
+// author is used to check the signature.
+const articleColumns = `
+	articles.id, slug, published, live, title, body, coalesce(sig, ''), authorid,
+	email, fname, lname, username,
+	coalesce((select key from pubkeys where pubkeys.userid = users.id order by pubkeys.id desc limit 1), '')`
+
+// scanArticle reads a row selected with articleColumns, followed by the
+// columns scanned into extra
+func scanArticle(row interface {
+	Scan(...interface{}) error
+}, extra ...interface{}) (*Article, error) {
+	var a = Article{}
+	var sig, key string
+	dest := []interface{}{&a.ID, &a.Slug, &a.Date, &a.Live, &a.Title, &a.Body, &sig, &a.AuthorID, &a.Author.Email, &a.Author.FName, &a.Author.LName, &a.Author.User, &key}
+	err := row.Scan(append(dest, extra...)...)
+	a.Author.ID = a.AuthorID
+	a.Signature = []byte(sig)
+	a.Author.Pubkey = []byte(key)
+	return &a, err
+}
+
+// GetArticles returns the raw markdown of the articles matching f, newest
+// first, and how many match in total
+func GetArticles(db *sql.DB, f ArticleFilter) (Articles, int, error) {
+	return GetArticlesContext(context.Background(), db, f)
+}
+
+// GetArticlesContext is GetArticles with a context
+func GetArticlesContext(ctx context.Context, db *sql.DB, f ArticleFilter) (Articles, int, error) {
+	var as = Articles{}
+	where := `where (live or ($1 and ($2 = 0 or authorid = $2))) and ($3 = 0 or authorid = $3)`
+
+	var total int
+	err := db.QueryRowContext(ctx, `select count(*) from articles `+where, f.Drafts, f.DraftsBy, f.AuthorID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		select `+articleColumns+`
+		from articles
+		join users on (articles.authorid = users.id)
+		`+where+`
+		order by published desc, articles.id desc
+		limit $4 offset $5`, f.Drafts, f.DraftsBy, f.AuthorID, f.Limit, f.Offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanArticle(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		as = append(as, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for _, a := range as {
+		a.Tags, err = GetTagsContext(ctx, db, a.ID)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return as, total, nil
+}
+
+// GetArticleByID returns the raw markdown of the article with the given id,
+// live or not
+func GetArticleByID(db *sql.DB, id int) (*Article, error) {
+	return GetArticleByIDContext(context.Background(), db, id)
+}
+
+// GetArticleByIDContext is GetArticleByID with a context
+func GetArticleByIDContext(ctx context.Context, db *sql.DB, id int) (*Article, error) {
+	a, err := scanArticle(db.QueryRowContext(ctx, `
+		select `+articleColumns+`
+		from articles
+		join users on (articles.authorid = users.id)
+		where articles.id = $1`, id))
+	if err != nil {
+		return nil, notFound(err, "No article with id %d", id)
+	}
+
+	a.Tags, err = GetTagsContext(ctx, db, a.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// UpdateArticle replaces the title, body, signature and tags of the article
+// with the id of a. Unknown tags are handled as in InsertArticle.
+func UpdateArticle(db *sql.DB, a Article, createTags bool) error {
+	return UpdateArticleContext(context.Background(), db, a, createTags)
+}
+
+// UpdateArticleContext is UpdateArticle with a context
+func UpdateArticleContext(ctx context.Context, db *sql.DB, a Article, createTags bool) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	tags, err := resolveTags(ctx, txn, a.Tags.Join(), createTags)
+	if err != nil {
+		return err
+	}
+
+	res, err := txn.ExecContext(ctx, `update articles set title = $1, body = $2, sig = $3, edited = now() where id = $4`, a.Title, a.Body, a.Signature, a.ID)
+	if err != nil {
+		return err
+	}
+	if err := rowAffected(res, "No article with id %d", a.ID); err != nil {
+		return err
+	}
+
+	if _, err := txn.ExecContext(ctx, `delete from article_tags where articleid = $1`, a.ID); err != nil {
+		return err
+	}
+	for _, tid := range tags {
+		if _, err := txn.ExecContext(ctx, `insert into article_tags (articleid, tagid) values ($1, $2)`, a.ID, tid); err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+// SetArticleLive publishes or unpublishes the article with the given id.
+// Publishing a draft dates it to now.
+func SetArticleLive(db *sql.DB, id int, live bool) error {
+	return SetArticleLiveContext(context.Background(), db, id, live)
+}
+
+// SetArticleLiveContext is SetArticleLive with a context
+func SetArticleLiveContext(ctx context.Context, db *sql.DB, id int, live bool) error {
+	res, err := db.ExecContext(ctx, `
+		update articles set
+		published = case when $1 and not live then now() else published end,
+		live = $1
+		where id = $2`, live, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No article with id %d", id)
+}
+
+// GetTagIDS takes a list of tag names and returns a set of tag ids
+func GetTagIDS(db *sql.DB, s []string) (tagIDS []int, err error) {
+	return GetTagIDSContext(context.Background(), db, s)
+}
+
+// GetTagIDSContext is GetTagIDS with a context
+func GetTagIDSContext(ctx context.Context, db *sql.DB, s []string) (tagIDS []int, err error) {
+	sql := `
+select
+  id
+from tags
+where
+  name = ANY($1)
+`
+	rows, err := db.QueryContext(ctx, sql, pq.Array(s))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var i int
+		rows.Scan(&i)
+		tagIDS = append(tagIDS, i)
+	}
+
+	return tagIDS, nil
+}
+
+// GetAllTags returns all the tags in the DB
+func GetAllTags(db *sql.DB) (Tags, error) {
+	return GetAllTagsContext(context.Background(), db)
+}
+
+// GetAllTagsContext is GetAllTags with a context
+func GetAllTagsContext(ctx context.Context, db *sql.DB) (Tags, error) {
+	var ts = Tags{}
+	rows, err := db.QueryContext(ctx, `select id, created, name from tags`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t = Tag{}
+		err := rows.Scan(&t.ID, &t.Created, &t.Name)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, &t)
+	}
+
+	return ts, nil
+}
+
+// userPerms selects the permissions of the role of a users row
+const userPerms = `array(select permission from permissions where permissions.role = users.role order by permission)`
+
+// GetRoles returns the roles users can be given with their permissions,
+// least trusted first
+func GetRoles(db *sql.DB) (Roles, error) {
+	return GetRolesContext(context.Background(), db)
+}
+
+// GetRolesContext is GetRoles with a context
+func GetRolesContext(ctx context.Context, db *sql.DB) (Roles, error) {
+	var rs = Roles{}
+
+	rows, err := db.QueryContext(ctx, `select name, descr, array(select permission from permissions where permissions.role = roles.name order by permission) from roles order by rank`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var r = Role{}
+		err := rows.Scan(&r.Name, &r.Descr, pq.Array(&r.Perms))
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, &r)
+	}
+
+	return rs, rows.Err()
+}
+
+// GetAllUsers gets all the users in the DB
+func GetAllUsers(db *sql.DB) (Users, error) {
+	return GetAllUsersContext(context.Background(), db)
+}
+
+// GetAllUsersContext is GetAllUsers with a context
+func GetAllUsersContext(ctx context.Context, db *sql.DB) (Users, error) {
+	var us = Users{}
+
+	rows, err := db.QueryContext(ctx, `select id, created, fname, lname, email, username, role, disabled, verified, totp_secret <> '' from users order by username`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var u = User{}
+		err := rows.Scan(&u.ID, &u.Created, &u.FName, &u.LName, &u.Email, &u.User, &u.Role, &u.Disabled, &u.Verified, &u.TOTP)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, &u)
+	}
+
+	return us, nil
+}
+
+// GetTags returns tags for a given article
+func GetTags(db *sql.DB, id int) (Tags, error) {
+	return GetTagsContext(context.Background(), db, id)
+}
+
+// GetTagsContext is GetTags with a context
+func GetTagsContext(ctx context.Context, db *sql.DB, id int) (Tags, error) {
+	var ts = Tags{}
+	rows, err := db.QueryContext(ctx, `
+		select
+		tags.id,
+		tags.name
+		from article_tags
+		join tags on
+		(article_tags.tagid = tags.id)
+		where
+		articleid = $1
+		`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t = Tag{}
+		err := rows.Scan(&t.ID, &t.Name)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, &t)
+	}
+	return ts, nil
+}
+
+// GetUserIDByEmail takes a users email and returns a User that is associated with it
+func GetUserIDByEmail(db *sql.DB, e string) (id *int, err error) {
+	return GetUserIDByEmailContext(context.Background(), db, e)
+}
+
+// GetUserIDByEmailContext is GetUserIDByEmail with a context
+func GetUserIDByEmailContext(ctx context.Context, db *sql.DB, e string) (id *int, err error) {
+	err = db.QueryRowContext(ctx, `
+select id from users where email = $1
+`, e).Scan(&id)
+	if err != nil {
+		return nil, notFound(err, "No user with email %q", e)
+	}
+
+	return id, nil
+}
+
+// GetPubkey returns the newest signify public key of the user with the
+// given id
+func GetPubkey(db *sql.DB, userID int) ([]byte, error) {
+	return GetPubkeyContext(context.Background(), db, userID)
+}
+
+// GetPubkeyContext is GetPubkey with a context
+func GetPubkeyContext(ctx context.Context, db *sql.DB, userID int) ([]byte, error) {
+	var key string
+	err := db.QueryRowContext(ctx, `select key from pubkeys where userid = $1 order by id desc limit 1`, userID).Scan(&key)
+	if err != nil {
+		return nil, notFound(err, "No public key on file for user %d", userID)
+	}
+
+	return []byte(key), nil
+}
+
+// GetArticlesByTag tags a tag and returns all the matching articles
+func GetArticlesByTag(db *sql.DB, t string) (Articles, error) {
+	return GetArticlesByTagContext(context.Background(), db, t)
+}
+
+// GetArticlesByTagContext is GetArticlesByTag with a context
+func GetArticlesByTagContext(ctx context.Context, db *sql.DB, t string) (Articles, error) {
+	var as = Articles{}
+	rows, err := db.QueryContext(ctx, `
+		select `+articleColumns+`
+		from articles
+		join users on
+		(articles.authorid = users.id)
+		join article_tags on
+		(article_tags.articleid = articles.id)
+		join tags on
+		(article_tags.tagid = tags.id)
+		where
+		live = true and
+		tags.name = $1
+		order by published desc
+		`, t)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanArticle(rows)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range as {
+		a.Tags, err = GetTagsContext(ctx, db, a.ID)
+		if err != nil {
+			return nil, err
+		}
+		a.Verify(a.Author.Pubkey)
+		a.HTML()
+	}
+
+	return as, nil
+}
+
+// GetNArticles returns N most recent articles from the DB
+func GetNArticles(db *sql.DB, n int) (Articles, error) {
+	return GetNArticlesContext(context.Background(), db, n)
+}
+
+// GetNArticlesContext is GetNArticles with a context
+func GetNArticlesContext(ctx context.Context, db *sql.DB, n int) (Articles, error) {
+	var as = Articles{}
+
+	rows, err := db.QueryContext(ctx, `
+		select `+articleColumns+`
+		from articles
+		join users on
+		(articles.authorid = users.id)
+		where
+		live = true
+		order by published desc
+		limit $1
+		`, n)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanArticle(rows)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, a := range as {
+		a.Tags, err = GetTagsContext(ctx, db, a.ID)
+		if err != nil {
+			return nil, err
+		}
+		a.Verify(a.Author.Pubkey)
+		a.HTML()
+	}
+
+	return as, nil
+}
+
+// SearchArticles uses pg's TS stuff to query all the articles for passed in values
+func SearchArticles(db *sql.DB, query string, limit int) (Articles, error) {
+	return SearchArticlesContext(context.Background(), db, query, limit)
+}
+
+// SearchArticlesContext is SearchArticles with a context
+func SearchArticlesContext(ctx context.Context, db *sql.DB, query string, limit int) (Articles, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, NewError(Invalid, nil, "Please enter something to search for")
+	}
+
+	var as = Articles{}
+	rows, err := db.QueryContext(ctx, `
+		select `+articleColumns+`,
+		ts_headline(body, q) as headline,
+		rank
+		from (
+			select
+			articles.*,
+			q,
+			ts_rank_cd(tsv, q) as rank
+			from articles, plainto_tsquery($1) q
+			where live and tsv @@ q
+			order by rank desc
+			limit $2) as articles
+		join users on
+		(articles.authorid = users.id)
+		order by rank desc
+		`, query, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var headline []byte
+		var rank float64
+		a, err := scanArticle(rows, &headline, &rank)
+		if err != nil {
+			return nil, err
+		}
+		a.Headline = headline
+		a.Rank = rank
+
+		a.Verify(a.Author.Pubkey)
+		a.HTML()
+
+		as = append(as, a)
+	}
+
+	return as, nil
+}
+
+// InsertUser takes a User and inserts them into the database. Without a
+// role they get DefaultRole.
+func InsertUser(db *sql.DB, u User) (*int, error) {
+	return InsertUserContext(context.Background(), db, u)
+}
+
+// InsertUserContext is InsertUser with a context
+func InsertUserContext(ctx context.Context, db *sql.DB, u User) (*int, error) {
+	if u.Role == "" {
+		u.Role = DefaultRole
+	}
+
+	var id int
+	err := db.QueryRowContext(ctx, `INSERT INTO users (fname, lname, email, username, role, hash) values ($1, $2, $3, $4, $5, (select hash($6))) returning id`, u.FName, u.LName, u.Email, u.User, u.Role, u.Pass).Scan(&id)
+	if err != nil {
+		if isViolation(err, "unique_violation") {
+			return nil, NewError(Invalid, err, "The user name %q or email address is already taken", u.User)
+		}
+		if isViolation(err, "foreign_key_violation") {
+			return nil, NewError(Invalid, err, "There is no role %q", u.Role)
+		}
+		return nil, err
+	}
+	return &id, nil
+}
+
+// RegisterUser adds a reader who signed up on the site. They get
+// DefaultRole and can not log in until SetUserVerified is called.
+func RegisterUser(db *sql.DB, u User) (*int, error) {
+	return RegisterUserContext(context.Background(), db, u)
+}
+
+// RegisterUserContext is RegisterUser with a context
+func RegisterUserContext(ctx context.Context, db *sql.DB, u User) (*int, error) {
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+
+	var id int
+	err := db.QueryRowContext(ctx, `insert into users (fname, lname, email, username, role, verified, hash) values ($1, $2, $3, $4, $5, false, (select hash($6))) returning id`, u.FName, u.LName, u.Email, u.User, DefaultRole, u.Pass).Scan(&id)
+	if err != nil {
+		if isViolation(err, "unique_violation") {
+			return nil, ErrTaken
+		}
+		return nil, err
+	}
+	return &id, nil
+}
+
+// GetUsersByNameOrEmail returns the users holding the user name name or the
+// email address email
+func GetUsersByNameOrEmail(db *sql.DB, name, email string) (Users, error) {
+	return GetUsersByNameOrEmailContext(context.Background(), db, name, email)
+}
+
+// GetUsersByNameOrEmailContext is GetUsersByNameOrEmail with a context
+func GetUsersByNameOrEmailContext(ctx context.Context, db *sql.DB, name, email string) (Users, error) {
+	var us = Users{}
+
+	rows, err := db.QueryContext(ctx, `select id, created, fname, lname, email, username, role, disabled, verified from users where username = $1 or email = $2 order by id`, name, email)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var u = User{}
+		err := rows.Scan(&u.ID, &u.Created, &u.FName, &u.LName, &u.Email, &u.User, &u.Role, &u.Disabled, &u.Verified)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, &u)
+	}
+
+	return us, rows.Err()
+}
+
+// SetUserVerified marks the email address of the user with the given id as
+// confirmed
+func SetUserVerified(db *sql.DB, id int) error {
+	return SetUserVerifiedContext(context.Background(), db, id)
+}
+
+// SetUserVerifiedContext is SetUserVerified with a context
+func SetUserVerifiedContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `update users set verified = true where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No user with id %d", id)
+}
+
+// GetUser returns the user with the given id
+func GetUser(db *sql.DB, id int) (*User, error) {
+	return GetUserContext(context.Background(), db, id)
+}
+
+// GetUserContext is GetUser with a context
+func GetUserContext(ctx context.Context, db *sql.DB, id int) (*User, error) {
+	var u = User{}
+	err := db.QueryRowContext(ctx, `select id, created, fname, lname, email, username, role, `+userPerms+`, disabled, verified, pass_changed, totp_secret <> '' from users where id = $1`, id).Scan(&u.ID, &u.Created, &u.FName, &u.LName, &u.Email, &u.User, &u.Role, pq.Array(&u.Perms), &u.Disabled, &u.Verified, &u.PassChanged, &u.TOTP)
+	if err != nil {
+		return nil, notFound(err, "No user with id %d", id)
+	}
+
+	return &u, nil
+}
+
+// GetUserByName returns the enabled user with the given user name
+func GetUserByName(db *sql.DB, name string) (*User, error) {
+	return GetUserByNameContext(context.Background(), db, name)
+}
+
+// GetUserByNameContext is GetUserByName with a context
+func GetUserByNameContext(ctx context.Context, db *sql.DB, name string) (*User, error) {
+	var u = User{}
+	err := db.QueryRowContext(ctx, `select id, created, fname, lname, email, username, role, `+userPerms+`, disabled, verified, pass_changed, totp_secret <> '' from users where username = $1 and not disabled`, name).Scan(&u.ID, &u.Created, &u.FName, &u.LName, &u.Email, &u.User, &u.Role, pq.Array(&u.Perms), &u.Disabled, &u.Verified, &u.PassChanged, &u.TOTP)
+	if err != nil {
+		return nil, notFound(err, "No user named %q", name)
+	}
+
+	return &u, nil
+}
+
+// UpdateUser saves the names, email, role and disabled flags of u
+func UpdateUser(db *sql.DB, u User) error {
+	return UpdateUserContext(context.Background(), db, u)
+}
+
+// UpdateUserContext is UpdateUser with a context
+func UpdateUserContext(ctx context.Context, db *sql.DB, u User) error {
+	res, err := db.ExecContext(ctx, `update users set fname = $1, lname = $2, email = $3, username = $4, role = $5, disabled = $6, verified = $7 where id = $8`, u.FName, u.LName, u.Email, u.User, u.Role, u.Disabled, u.Verified, u.ID)
+	if err != nil {
+		if isViolation(err, "unique_violation") {
+			return NewError(Invalid, err, "The user name %q or email address is already taken", u.User)
+		}
+		if isViolation(err, "foreign_key_violation") {
+			return NewError(Invalid, err, "There is no role %q", u.Role)
+		}
+		return err
+	}
+
+	return rowAffected(res, "No user with id %d", u.ID)
+}
+
+// SetUserPassword replaces the password of the user with the given id,
+// ending the sessions they have open
+func SetUserPassword(db *sql.DB, id int, pass string) error {
+	return SetUserPasswordContext(context.Background(), db, id, pass)
+}
+
+// SetUserPasswordContext is SetUserPassword with a context
+func SetUserPasswordContext(ctx context.Context, db *sql.DB, id int, pass string) error {
+	res, err := db.ExecContext(ctx, `update users set hash = (select hash($1)), pass_changed = now() where id = $2`, pass, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No user with id %d", id)
+}
+
+// GetLockedUsers returns the accounts currently locked by failed logins
+func GetLockedUsers(db *sql.DB) (Users, error) {
+	return GetLockedUsersContext(context.Background(), db)
+}
+
+// GetLockedUsersContext is GetLockedUsers with a context
+func GetLockedUsersContext(ctx context.Context, db *sql.DB) (Users, error) {
+	var us = Users{}
+
+	rows, err := db.QueryContext(ctx, `select id, username, email, failed_logins, locked_until from users where locked_until > now() order by locked_until desc`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var u = User{}
+		err := rows.Scan(&u.ID, &u.User, &u.Email, &u.FailedLogins, &u.LockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		us = append(us, &u)
+	}
+
+	return us, nil
+}
+
+// UnlockUser clears the failed logins of the user with the given id
+func UnlockUser(db *sql.DB, id int) error {
+	return UnlockUserContext(context.Background(), db, id)
+}
+
+// UnlockUserContext is UnlockUser with a context
+func UnlockUserContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `update users set failed_logins = 0, locked_until = null where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No user with id %d", id)
+}
+
+const sessionColumns = `id, userid, data, created, seen, expires, ip, agent`
+
+// scanSession reads a row selected with sessionColumns
+func scanSession(row interface {
+	Scan(...interface{}) error
+}) (*Session, error) {
+	var se = Session{}
+	var userID sql.NullInt64
+	err := row.Scan(&se.ID, &userID, &se.Data, &se.Created, &se.Seen, &se.Expires, &se.IP, &se.Agent)
+	se.UserID = int(userID.Int64)
+	return &se, err
+}
+
+// GetSession returns the unexpired session with the given cookie key
+func GetSession(db *sql.DB, key string) (*Session, error) {
+	return GetSessionContext(context.Background(), db, key)
+}
+
+// GetSessionContext is GetSession with a context
+func GetSessionContext(ctx context.Context, db *sql.DB, key string) (*Session, error) {
+	se, err := scanSession(db.QueryRowContext(ctx, `select `+sessionColumns+` from sessions where id = $1 and expires > now()`, SessionID(key)))
+	if err != nil {
+		return nil, notFound(err, "No such session")
+	}
+
+	return se, nil
+}
+
+// SaveSession stores se under the given cookie key, creating it if needed
+func SaveSession(db *sql.DB, key string, se *Session) error {
+	return SaveSessionContext(context.Background(), db, key, se)
+}
+
+// SaveSessionContext is SaveSession with a context
+func SaveSessionContext(ctx context.Context, db *sql.DB, key string, se *Session) error {
+	_, err := db.ExecContext(ctx, `
+		insert into sessions (id, userid, data, expires, ip, agent)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (id) do update set
+		userid = excluded.userid, data = excluded.data, seen = now(),
+		expires = excluded.expires, ip = excluded.ip, agent = excluded.agent`,
+		SessionID(key), nullID(se.UserID), se.Data, se.Expires, se.IP, se.Agent)
+	return err
+}
+
+// TouchSession records that the session with the given cookie key was used
+func TouchSession(db *sql.DB, key string) error {
+	return TouchSessionContext(context.Background(), db, key)
+}
+
+// TouchSessionContext is TouchSession with a context
+func TouchSessionContext(ctx context.Context, db *sql.DB, key string) error {
+	_, err := db.ExecContext(ctx, `update sessions set seen = now() where id = $1`, SessionID(key))
+	return err
+}
+
+// DeleteSession removes the session with the given cookie key
+func DeleteSession(db *sql.DB, key string) error {
+	return DeleteSessionContext(context.Background(), db, key)
+}
+
+// DeleteSessionContext is DeleteSession with a context
+func DeleteSessionContext(ctx context.Context, db *sql.DB, key string) error {
+	_, err := db.ExecContext(ctx, `delete from sessions where id = $1`, SessionID(key))
+	return err
+}
+
+// GetUserSessions returns the unexpired sessions of the user with the given
+// id, most recently used first
+func GetUserSessions(db *sql.DB, userID int) (Sessions, error) {
+	return GetUserSessionsContext(context.Background(), db, userID)
+}
+
+// GetUserSessionsContext is GetUserSessions with a context
+func GetUserSessionsContext(ctx context.Context, db *sql.DB, userID int) (Sessions, error) {
+	var ss = Sessions{}
+
+	rows, err := db.QueryContext(ctx, `select `+sessionColumns+` from sessions where userid = $1 and expires > now() order by seen desc`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		se, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, se)
+	}
+
+	return ss, rows.Err()
+}
+
+// EndSession logs out the session with the given ID, as shown by
+// GetUserSessions, if it belongs to the user with the given id
+func EndSession(db *sql.DB, userID int, id string) error {
+	return EndSessionContext(context.Background(), db, userID, id)
+}
+
+// EndSessionContext is EndSession with a context
+func EndSessionContext(ctx context.Context, db *sql.DB, userID int, id string) error {
+	res, err := db.ExecContext(ctx, `delete from sessions where id = $1 and userid = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No such session")
+}
+
+// EndUserSessions logs the user with the given id out everywhere. It
+// returns how many sessions were ended.
+func EndUserSessions(db *sql.DB, userID int) (int64, error) {
+	return EndUserSessionsContext(context.Background(), db, userID)
+}
+
+// EndUserSessionsContext is EndUserSessions with a context
+func EndUserSessionsContext(ctx context.Context, db *sql.DB, userID int) (int64, error) {
+	res, err := db.ExecContext(ctx, `delete from sessions where userid = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// PruneSessions removes expired sessions and returns how many there were
+func PruneSessions(db *sql.DB) (int64, error) {
+	return PruneSessionsContext(context.Background(), db)
+}
+
+// PruneSessionsContext is PruneSessions with a context
+func PruneSessionsContext(ctx context.Context, db *sql.DB) (int64, error) {
+	res, err := db.ExecContext(ctx, `delete from sessions where expires <= now()`)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+const apiTokenColumns = `t.id, t.userid, u.username, t.name, t.scopes, t.created, t.last_used, t.expires`
+
+// scanAPIToken reads a row selected with apiTokenColumns
+func scanAPIToken(row interface {
+	Scan(...interface{}) error
+}) (*APIToken, error) {
+	var t = APIToken{}
+	var lastUsed, expires pq.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.UserName, &t.Name, pq.Array(&t.Scopes), &t.Created, &lastUsed, &expires)
+	t.LastUsed = lastUsed.Time
+	t.Expires = expires.Time
+	return &t, err
+}
+
+// CreateAPIToken gives the user with the given id a new API token limited
+// to scopes. A zero expires makes a token that is good until revoked. It
+// returns the token, which is not stored and can not be shown again.
+func CreateAPIToken(db *sql.DB, userID int, name string, scopes []string, expires time.Time) (string, *APIToken, error) {
+	return CreateAPITokenContext(context.Background(), db, userID, name, scopes, expires)
+}
+
+// CreateAPITokenContext is CreateAPIToken with a context
+func CreateAPITokenContext(ctx context.Context, db *sql.DB, userID int, name string, scopes []string, expires time.Time) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, NewError(Invalid, nil, "A token needs a name")
+	}
+	if err := CheckScopes(scopes); err != nil {
+		return "", nil, err
+	}
+	if !expires.IsZero() && !expires.After(time.Now()) {
+		return "", nil, NewError(Invalid, nil, "A token has to expire in the future")
+	}
+
+	token, hash, err := newAPIToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var id int
+	err = db.QueryRowContext(ctx, `insert into api_tokens (userid, name, hash, scopes, expires) values ($1, $2, $3, $4, $5) returning id`,
+		userID, name, hash, pq.Array(scopes), nullTime(expires)).Scan(&id)
+	if err != nil {
+		if isViolation(err, "unique_violation") {
+			return "", nil, NewError(Invalid, err, "There already is a token named %q", name)
+		}
+		if isViolation(err, "foreign_key_violation") {
+			return "", nil, NewError(NotFound, err, "No user with id %d", userID)
+		}
+		return "", nil, err
+	}
+
+	t, err := scanAPIToken(db.QueryRowContext(ctx, `select `+apiTokenColumns+` from api_tokens t join users u on u.id = t.userid where t.id = $1`, id))
+	if err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// GetAPIToken returns the API token matching token and records that it was
+// used. Expired tokens and tokens of disabled or removed accounts are not
+// found.
+func GetAPIToken(db *sql.DB, token string) (*APIToken, error) {
+	return GetAPITokenContext(context.Background(), db, token)
+}
+
+// GetAPITokenContext is GetAPIToken with a context
+func GetAPITokenContext(ctx context.Context, db *sql.DB, token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, NewError(NotFound, nil, "No such API token")
+	}
+	t, err := scanAPIToken(db.QueryRowContext(ctx, `
+		update api_tokens t set last_used = now()
+		from users u
+		where u.id = t.userid and t.hash = $1 and not u.disabled
+		and (t.expires is null or t.expires > now())
+		returning `+apiTokenColumns, hashAPIToken(token)))
+	if err != nil {
+		return nil, notFound(err, "No such API token")
+	}
+
+	return t, nil
+}
+
+// GetAPITokens returns the API tokens of the user with the given id, or of
+// everyone when it is 0, newest first
+func GetAPITokens(db *sql.DB, userID int) (APITokens, error) {
+	return GetAPITokensContext(context.Background(), db, userID)
+}
+
+// GetAPITokensContext is GetAPITokens with a context
+func GetAPITokensContext(ctx context.Context, db *sql.DB, userID int) (APITokens, error) {
+	var ts = APITokens{}
+
+	rows, err := db.QueryContext(ctx, `
+		select `+apiTokenColumns+` from api_tokens t join users u on u.id = t.userid
+		where $1 = 0 or t.userid = $1
+		order by t.created desc`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+
+	return ts, rows.Err()
+}
+
+// RevokeAPIToken removes the API token with the given id if it belongs to
+// the user with the given id. A userID of 0 revokes anyone's token.
+func RevokeAPIToken(db *sql.DB, userID int, id int) error {
+	return RevokeAPITokenContext(context.Background(), db, userID, id)
+}
+
+// RevokeAPITokenContext is RevokeAPIToken with a context
+func RevokeAPITokenContext(ctx context.Context, db *sql.DB, userID int, id int) error {
+	res, err := db.ExecContext(ctx, `delete from api_tokens where id = $1 and ($2 = 0 or userid = $2)`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No API token with id %d", id)
+}
+
+const webhookColumns = `id, created, url, descr, secret, events, active`
+
+// scanWebhook reads a row selected with webhookColumns
+func scanWebhook(row interface {
+	Scan(...interface{}) error
+}) (*Webhook, error) {
+	var w = Webhook{}
+	err := row.Scan(&w.ID, &w.Created, &w.URL, &w.Descr, &w.Secret, pq.Array(&w.Events), &w.Active)
+	return &w, err
+}
+
+// GetWebhooks returns every webhook, oldest first
+func GetWebhooks(db *sql.DB) (Webhooks, error) {
+	return GetWebhooksContext(context.Background(), db)
+}
+
+// GetWebhooksContext is GetWebhooks with a context
+func GetWebhooksContext(ctx context.Context, db *sql.DB) (Webhooks, error) {
+	var ws = Webhooks{}
+
+	rows, err := db.QueryContext(ctx, `select `+webhookColumns+` from webhooks order by id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+
+	return ws, rows.Err()
+}
+
+// InsertWebhook registers w with a new secret and returns its id
+func InsertWebhook(db *sql.DB, w Webhook) (*int, error) {
+	return InsertWebhookContext(context.Background(), db, w)
+}
+
+// InsertWebhookContext is InsertWebhook with a context
+func InsertWebhookContext(ctx context.Context, db *sql.DB, w Webhook) (*int, error) {
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	var id int
+	err = db.QueryRowContext(ctx, `insert into webhooks (url, descr, secret, events, active) values ($1, $2, $3, $4, $5) returning id`,
+		w.URL, w.Descr, secret, pq.Array(w.Events), w.Active).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+// SetWebhookActive pauses or resumes the webhook with the given id. Paused
+// webhooks are not queued new events.
+func SetWebhookActive(db *sql.DB, id int, active bool) error {
+	return SetWebhookActiveContext(context.Background(), db, id, active)
+}
+
+// SetWebhookActiveContext is SetWebhookActive with a context
+func SetWebhookActiveContext(ctx context.Context, db *sql.DB, id int, active bool) error {
+	res, err := db.ExecContext(ctx, `update webhooks set active = $2 where id = $1`, id, active)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No webhook with id %d", id)
+}
+
+// DeleteWebhook removes the webhook with the given id and its deliveries
+func DeleteWebhook(db *sql.DB, id int) error {
+	return DeleteWebhookContext(context.Background(), db, id)
+}
+
+// DeleteWebhookContext is DeleteWebhook with a context
+func DeleteWebhookContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `delete from webhooks where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No webhook with id %d", id)
+}
+
+// QueueWebhookEvent queues payload for every active webhook registered for
+// event and returns how many there were
+func QueueWebhookEvent(db *sql.DB, event string, payload []byte) (int64, error) {
+	return QueueWebhookEventContext(context.Background(), db, event, payload)
+}
+
+// QueueWebhookEventContext is QueueWebhookEvent with a context
+func QueueWebhookEventContext(ctx context.Context, db *sql.DB, event string, payload []byte) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		insert into webhook_deliveries (webhookid, event, payload)
+		select id, $1, $2 from webhooks where active and $1 = any(events)`, event, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+const webhookDeliveryColumns = `d.id, d.webhookid, w.url, w.secret, d.event, d.payload, d.created, d.attempts, d.next_attempt, d.delivered, d.failed, d.last_status, d.last_error`
+
+// scanWebhookDelivery reads a row selected with webhookDeliveryColumns
+func scanWebhookDelivery(row interface {
+	Scan(...interface{}) error
+}) (*WebhookDelivery, error) {
+	var d = WebhookDelivery{}
+	var delivered pq.NullTime
+	err := row.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.Event, &d.Payload, &d.Created, &d.Attempts,
+		&d.NextAttempt, &delivered, &d.Failed, &d.LastStatus, &d.LastError)
+	d.Delivered = delivered.Time
+	return &d, err
+}
+
+// ClaimWebhookDeliveries returns up to limit deliveries that are due and
+// counts the attempt. They are not handed out again for lease, so several
+// servers can share the queue.
+func ClaimWebhookDeliveries(db *sql.DB, limit int, lease time.Duration) (WebhookDeliveries, error) {
+	return ClaimWebhookDeliveriesContext(context.Background(), db, limit, lease)
+}
+
+// ClaimWebhookDeliveriesContext is ClaimWebhookDeliveries with a context
+func ClaimWebhookDeliveriesContext(ctx context.Context, db *sql.DB, limit int, lease time.Duration) (WebhookDeliveries, error) {
+	var ds = WebhookDeliveries{}
+
+	rows, err := db.QueryContext(ctx, `
+		with due as (
+			select id from webhook_deliveries
+			where delivered is null and not failed and next_attempt <= now()
+			order by next_attempt
+			limit $1
+			for update skip locked
+		)
+		update webhook_deliveries d
+		set attempts = d.attempts + 1, next_attempt = now() + $2 * interval '1 second'
+		from due, webhooks w
+		where d.id = due.id and w.id = d.webhookid
+		returning `+webhookDeliveryColumns, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+
+	return ds, rows.Err()
+}
+
+// FinishWebhookDelivery records the outcome of an attempt of the delivery
+// with the given id. A message marks a failure, which is tried again at
+// retry or given up when retry is zero.
+func FinishWebhookDelivery(db *sql.DB, id int, status int, message string, retry time.Time) error {
+	return FinishWebhookDeliveryContext(context.Background(), db, id, status, message, retry)
+}
+
+// FinishWebhookDeliveryContext is FinishWebhookDelivery with a context
+func FinishWebhookDeliveryContext(ctx context.Context, db *sql.DB, id int, status int, message string, retry time.Time) error {
+	var err error
+	switch {
+	case message == "":
+		_, err = db.ExecContext(ctx, `update webhook_deliveries set delivered = now(), last_status = $2, last_error = '' where id = $1`, id, status)
+	case retry.IsZero():
+		_, err = db.ExecContext(ctx, `update webhook_deliveries set failed = true, last_status = $2, last_error = $3 where id = $1`, id, status, message)
+	default:
+		_, err = db.ExecContext(ctx, `update webhook_deliveries set next_attempt = $4, last_status = $2, last_error = $3 where id = $1`, id, status, message, retry)
+	}
+	return err
+}
+
+// RetryWebhookDelivery queues the delivery with the given id again, with a
+// fresh set of attempts
+func RetryWebhookDelivery(db *sql.DB, id int) error {
+	return RetryWebhookDeliveryContext(context.Background(), db, id)
+}
+
+// RetryWebhookDeliveryContext is RetryWebhookDelivery with a context
+func RetryWebhookDeliveryContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `
+		update webhook_deliveries set failed = false, delivered = null, attempts = 0, next_attempt = now()
+		where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No webhook delivery with id %d", id)
+}
+
+// GetWebhookDeliveries returns the limit most recent deliveries
+func GetWebhookDeliveries(db *sql.DB, limit int) (WebhookDeliveries, error) {
+	return GetWebhookDeliveriesContext(context.Background(), db, limit)
+}
+
+// GetWebhookDeliveriesContext is GetWebhookDeliveries with a context
+func GetWebhookDeliveriesContext(ctx context.Context, db *sql.DB, limit int) (WebhookDeliveries, error) {
+	var ds = WebhookDeliveries{}
+
+	rows, err := db.QueryContext(ctx, `
+		select `+webhookDeliveryColumns+` from webhook_deliveries d join webhooks w on w.id = d.webhookid
+		order by d.created desc, d.id desc
+		limit $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+
+	return ds, rows.Err()
+}
+
+// PruneWebhookDeliveries removes finished deliveries older than age and
+// returns how many there were
+func PruneWebhookDeliveries(db *sql.DB, age time.Duration) (int64, error) {
+	return PruneWebhookDeliveriesContext(context.Background(), db, age)
+}
+
+// PruneWebhookDeliveriesContext is PruneWebhookDeliveries with a context
+func PruneWebhookDeliveriesContext(ctx context.Context, db *sql.DB, age time.Duration) (int64, error) {
+	res, err := db.ExecContext(ctx, `
+		delete from webhook_deliveries
+		where (delivered is not null or failed) and created < $1`, time.Now().Add(-age))
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+const webSubColumns = `id, topic, callback, secret, created, expires`
+
+// scanWebSubSubscription reads a row selected with webSubColumns
+func scanWebSubSubscription(row interface {
+	Scan(...interface{}) error
+}) (*WebSubSubscription, error) {
+	var sub = WebSubSubscription{}
+	err := row.Scan(&sub.ID, &sub.Topic, &sub.Callback, &sub.Secret, &sub.Created, &sub.Expires)
+	return &sub, err
+}
+
+// SaveWebSubSubscription adds the subscription of sub.Callback to sub.Topic,
+// or renews it with the secret and expiry of sub
+func SaveWebSubSubscription(db *sql.DB, sub *WebSubSubscription) error {
+	return SaveWebSubSubscriptionContext(context.Background(), db, sub)
+}
+
+// SaveWebSubSubscriptionContext is SaveWebSubSubscription with a context
+func SaveWebSubSubscriptionContext(ctx context.Context, db *sql.DB, sub *WebSubSubscription) error {
+	_, err := db.ExecContext(ctx, `
+		insert into websub_subscriptions (topic, callback, secret, expires)
+		values ($1, $2, $3, $4)
+		on conflict (topic, callback) do update set
+		secret = excluded.secret, expires = excluded.expires`,
+		sub.Topic, sub.Callback, sub.Secret, sub.Expires)
+	return err
+}
+
+// DeleteWebSubSubscription ends the subscription of callback to topic
+func DeleteWebSubSubscription(db *sql.DB, topic, callback string) error {
+	return DeleteWebSubSubscriptionContext(context.Background(), db, topic, callback)
+}
+
+// DeleteWebSubSubscriptionContext is DeleteWebSubSubscription with a context
+func DeleteWebSubSubscriptionContext(ctx context.Context, db *sql.DB, topic, callback string) error {
+	_, err := db.ExecContext(ctx, `delete from websub_subscriptions where topic = $1 and callback = $2`, topic, callback)
+	return err
+}
+
+// GetWebSubSubscriptions returns the unexpired subscriptions to topic
+func GetWebSubSubscriptions(db *sql.DB, topic string) (WebSubSubscriptions, error) {
+	return GetWebSubSubscriptionsContext(context.Background(), db, topic)
+}
+
+// GetWebSubSubscriptionsContext is GetWebSubSubscriptions with a context
+func GetWebSubSubscriptionsContext(ctx context.Context, db *sql.DB, topic string) (WebSubSubscriptions, error) {
+	var subs = WebSubSubscriptions{}
+
+	rows, err := db.QueryContext(ctx, `select `+webSubColumns+` from websub_subscriptions where topic = $1 and expires > now() order by id`, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		sub, err := scanWebSubSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// PruneWebSubSubscriptions removes expired subscriptions and returns how
+// many there were
+func PruneWebSubSubscriptions(db *sql.DB) (int64, error) {
+	return PruneWebSubSubscriptionsContext(context.Background(), db)
+}
+
+// PruneWebSubSubscriptionsContext is PruneWebSubSubscriptions with a context
+func PruneWebSubSubscriptionsContext(ctx context.Context, db *sql.DB) (int64, error) {
+	res, err := db.ExecContext(ctx, `delete from websub_subscriptions where expires <= now()`)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// GetActorKey returns the key pair of the local actor with the given name,
+// making one the first time it is asked for
+func GetActorKey(db *sql.DB, actor string) (*ActorKey, error) {
+	return GetActorKeyContext(context.Background(), db, actor)
+}
+
+// GetActorKeyContext is GetActorKey with a context
+func GetActorKeyContext(ctx context.Context, db *sql.DB, actor string) (*ActorKey, error) {
+	var k = ActorKey{Actor: actor}
+	get := func() error {
+		return db.QueryRowContext(ctx, `select private_key, public_key, created from ap_keys where actor = $1`, actor).Scan(&k.PrivatePEM, &k.PublicPEM, &k.Created)
+	}
+	err := get()
+	if err != sql.ErrNoRows {
+		return &k, err
+	}
+
+	private, public, err := newActorKey()
+	if err != nil {
+		return nil, err
+	}
+	// Another request may have made one meanwhile, whichever came first
+	// is kept.
+	_, err = db.ExecContext(ctx, `insert into ap_keys (actor, private_key, public_key) values ($1, $2, $3) on conflict (actor) do nothing`, actor, private, public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, get()
+}
+
+const followerColumns = `id, actor, follower, inbox, created`
+
+// scanFollower reads a row selected with followerColumns
+func scanFollower(row interface {
+	Scan(...interface{}) error
+}) (*Follower, error) {
+	var f = Follower{}
+	err := row.Scan(&f.ID, &f.Actor, &f.Follower, &f.Inbox, &f.Created)
+	return &f, err
+}
+
+// AddFollower records that the remote actor follower follows the local
+// actor, or updates its inbox when it already did
+func AddFollower(db *sql.DB, actor, follower, inbox string) error {
+	return AddFollowerContext(context.Background(), db, actor, follower, inbox)
+}
+
+// AddFollowerContext is AddFollower with a context
+func AddFollowerContext(ctx context.Context, db *sql.DB, actor, follower, inbox string) error {
+	_, err := db.ExecContext(ctx, `
+		insert into ap_followers (actor, follower, inbox)
+		values ($1, $2, $3)
+		on conflict (actor, follower) do update set inbox = excluded.inbox`,
+		actor, follower, inbox)
+	return err
+}
+
+// RemoveFollower ends follower following the local actor. An empty actor
+// removes the follower from every local actor.
+func RemoveFollower(db *sql.DB, actor, follower string) error {
+	return RemoveFollowerContext(context.Background(), db, actor, follower)
+}
+
+// RemoveFollowerContext is RemoveFollower with a context
+func RemoveFollowerContext(ctx context.Context, db *sql.DB, actor, follower string) error {
+	_, err := db.ExecContext(ctx, `delete from ap_followers where ($1 = '' or actor = $1) and follower = $2`, actor, follower)
+	return err
+}
+
+// GetFollowers returns the followers of the local actors named
+func GetFollowers(db *sql.DB, actors ...string) (Followers, error) {
+	return GetFollowersContext(context.Background(), db, actors...)
+}
+
+// GetFollowersContext is GetFollowers with a context
+func GetFollowersContext(ctx context.Context, db *sql.DB, actors ...string) (Followers, error) {
+	var fs = Followers{}
+
+	rows, err := db.QueryContext(ctx, `select `+followerColumns+` from ap_followers where actor = any($1) order by id`, pq.Array(actors))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanFollower(rows)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+
+	return fs, rows.Err()
+}
+
+// CountFollowers returns how many followers the local actor has
+func CountFollowers(db *sql.DB, actor string) (int, error) {
+	return CountFollowersContext(context.Background(), db, actor)
+}
+
+// CountFollowersContext is CountFollowers with a context
+func CountFollowersContext(ctx context.Context, db *sql.DB, actor string) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `select count(*) from ap_followers where actor = $1`, actor).Scan(&n)
+	return n, err
+}
+
+const webmentionColumns = `
+	webmentions.id, articleid, articles.slug, articles.title, source, target,
+	webmentions.title, status, webmentions.created, verified`
+
+// scanWebmention reads a row selected with webmentionColumns
+func scanWebmention(row interface {
+	Scan(...interface{}) error
+}) (*Webmention, error) {
+	var m = Webmention{}
+	err := row.Scan(&m.ID, &m.ArticleID, &m.ArticleSlug, &m.ArticleTitle, &m.Source, &m.Target, &m.Title, &m.Status, &m.Created, &m.Verified)
+	return &m, err
+}
+
+// SaveWebmention records that source was found to link to the article with
+// the given id at target. A mention that is seen again keeps its status
+// unless the title of an approved one changed, which makes it pending
+// again.
+func SaveWebmention(db *sql.DB, articleID int, source, target, title string) error {
+	return SaveWebmentionContext(context.Background(), db, articleID, source, target, title)
+}
+
+// SaveWebmentionContext is SaveWebmention with a context
+func SaveWebmentionContext(ctx context.Context, db *sql.DB, articleID int, source, target, title string) error {
+	_, err := db.ExecContext(ctx, `
+		insert into webmentions (articleid, source, target, title)
+		values ($1, $2, $3, $4)
+		on conflict (source, target) do update set
+		title = excluded.title, verified = now(),
+		status = case when webmentions.status = 'approved' and webmentions.title <> excluded.title
+			then 'pending' else webmentions.status end`,
+		articleID, source, target, title)
+	if isViolation(err, "foreign_key_violation") {
+		return NewError(NotFound, err, "No article with id %d", articleID)
+	}
+	return err
+}
+
+// DeleteWebmention removes the mention of target by source, if there is one
+func DeleteWebmention(db *sql.DB, source, target string) error {
+	return DeleteWebmentionContext(context.Background(), db, source, target)
+}
+
+// DeleteWebmentionContext is DeleteWebmention with a context
+func DeleteWebmentionContext(ctx context.Context, db *sql.DB, source, target string) error {
+	_, err := db.ExecContext(ctx, `delete from webmentions where source = $1 and target = $2`, source, target)
+	return err
+}
+
+// SetWebmentionStatus moderates the mention with the given id
+func SetWebmentionStatus(db *sql.DB, id int, status string) error {
+	return SetWebmentionStatusContext(context.Background(), db, id, status)
+}
+
+// SetWebmentionStatusContext is SetWebmentionStatus with a context
+func SetWebmentionStatusContext(ctx context.Context, db *sql.DB, id int, status string) error {
+	switch status {
+	case MentionPending, MentionApproved, MentionRejected:
+	default:
+		return NewError(Invalid, nil, "Unknown status %q", status)
+	}
+
+	res, err := db.ExecContext(ctx, `update webmentions set status = $1 where id = $2`, status, id)
+	if err != nil {
+		return err
+	}
+
+	return rowAffected(res, "No webmention with id %d", id)
+}
+
+// GetWebmentions returns the mentions matching f, oldest first
+func GetWebmentions(db *sql.DB, f WebmentionFilter) (Webmentions, error) {
+	return GetWebmentionsContext(context.Background(), db, f)
+}
+
+// GetWebmentionsContext is GetWebmentions with a context
+func GetWebmentionsContext(ctx context.Context, db *sql.DB, f WebmentionFilter) (Webmentions, error) {
+	var ms = Webmentions{}
+
+	rows, err := db.QueryContext(ctx, `
+		select `+webmentionColumns+`
+		from webmentions
+		join articles on (webmentions.articleid = articles.id)
+		where
+		($1 = 0 or articleid = $1) and
+		($2 = '' or status = $2)
+		order by webmentions.created, webmentions.id`, f.ArticleID, f.Status)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		m, err := scanWebmention(rows)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+
+	return ms, rows.Err()
+}
+
+// CreatePasswordReset starts a password reset for the enabled account with
+// the given email address. It returns the user and the token for the reset
+// link, which is good for ttl and can be used once.
+func CreatePasswordReset(db *sql.DB, email string, ttl time.Duration) (*User, string, error) {
+	return CreatePasswordResetContext(context.Background(), db, email, ttl)
+}
+
+// CreatePasswordResetContext is CreatePasswordReset with a context
+func CreatePasswordResetContext(ctx context.Context, db *sql.DB, email string, ttl time.Duration) (*User, string, error) {
+	var u = User{}
+	err := db.QueryRowContext(ctx, `select id, fname, lname, email, username from users where lower(email) = lower($1) and not disabled`, email).Scan(&u.ID, &u.FName, &u.LName, &u.Email, &u.User)
+	if err != nil {
+		return nil, "", notFound(err, "No user with email %q", email)
+	}
+
+	token, hash, err := newResetToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = db.ExecContext(ctx, `insert into password_resets (userid, hash, expires) values ($1, $2, $3)`, u.ID, hash, time.Now().Add(ttl))
 	if err != nil {
+		return nil, "", err
+	}
+
+	return &u, token, nil
+}
+
+// resetUserQuery selects the user of a reset token that is still good
+const resetUserQuery = `
+		select u.id, u.fname, u.lname, u.email, u.username
+		from password_resets r
+		join users u on (r.userid = u.id)
+		where r.hash = $1 and r.expires > now() and not u.disabled
+		`
+
+// GetPasswordReset returns the user a reset token belongs to, if it is
+// still good
+func GetPasswordReset(db *sql.DB, token string) (*User, error) {
+	return GetPasswordResetContext(context.Background(), db, token)
+}
+
+// GetPasswordResetContext is GetPasswordReset with a context
+func GetPasswordResetContext(ctx context.Context, db *sql.DB, token string) (*User, error) {
+	var u = User{}
+	err := db.QueryRowContext(ctx, resetUserQuery, hashResetToken(token)).Scan(&u.ID, &u.FName, &u.LName, &u.Email, &u.User)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NewError(Invalid, err, "This link is invalid or has expired")
+		}
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// ResetPassword sets a new password using a reset token. The token and any
+// others of the user are used up, their sessions end, and since the mail
+// arrived their address counts as confirmed.
+func ResetPassword(db *sql.DB, token string, pass string) (*User, error) {
+	return ResetPasswordContext(context.Background(), db, token, pass)
+}
+
+// ResetPasswordContext is ResetPassword with a context
+func ResetPasswordContext(ctx context.Context, db *sql.DB, token string, pass string) (*User, error) {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	var u = User{}
+	err = txn.QueryRowContext(ctx, resetUserQuery+` for update`, hashResetToken(token)).Scan(&u.ID, &u.FName, &u.LName, &u.Email, &u.User)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, NewError(Invalid, err, "This link is invalid or has expired")
+		}
+		return nil, err
+	}
+
+	if err := CheckPassword(&u, pass); err != nil {
+		return nil, err
+	}
+
+	_, err = txn.ExecContext(ctx, `update users set hash = (select hash($1)), pass_changed = now(), verified = true where id = $2`, pass, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = txn.ExecContext(ctx, `delete from password_resets where userid = $1 or expires < now()`, u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &u, txn.Commit()
+}
+
+// EnableTOTP turns on two-factor authentication for the user with the
+// given id and returns their new recovery codes. Old codes stop working.
+// step is the time step of the code the user confirmed the secret with, as
+// returned by ValidTOTP, so that code can not be used again to log in.
+func EnableTOTP(db *sql.DB, id int, secret string, step int64) ([]string, error) {
+	return EnableTOTPContext(context.Background(), db, id, secret, step)
+}
+
+// EnableTOTPContext is EnableTOTP with a context
+func EnableTOTPContext(ctx context.Context, db *sql.DB, id int, secret string, step int64) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	res, err := txn.ExecContext(ctx, `update users set totp_secret = $1, totp_last = $2 where id = $3`, secret, step, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = rowAffected(res, "No user with id %d", id); err != nil {
+		return nil, err
+	}
+
+	_, err = txn.ExecContext(ctx, `delete from recovery_codes where userid = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hashes {
+		_, err = txn.ExecContext(ctx, `insert into recovery_codes (userid, hash) values ($1, $2)`, id, h)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, txn.Commit()
+}
+
+// DisableTOTP turns off two-factor authentication for the user with the
+// given id and removes their recovery codes
+func DisableTOTP(db *sql.DB, id int) error {
+	return DisableTOTPContext(context.Background(), db, id)
+}
+
+// DisableTOTPContext is DisableTOTP with a context
+func DisableTOTPContext(ctx context.Context, db *sql.DB, id int) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	res, err := txn.ExecContext(ctx, `update users set totp_secret = '', totp_last = 0 where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err = rowAffected(res, "No user with id %d", id); err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, `delete from recovery_codes where userid = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// CheckTOTP reports whether code is the current TOTP code or an unused
+// recovery code of the enabled user with the given id. Either can only be
+// used once. Wrong codes count towards locking the account like wrong
+// passwords do in Auth, a right one clears the failures.
+func CheckTOTP(db *sql.DB, id int, code string) (bool, error) {
+	return CheckTOTPContext(context.Background(), db, id, code)
+}
+
+// CheckTOTPContext is CheckTOTP with a context
+func CheckTOTPContext(ctx context.Context, db *sql.DB, id int, code string) (bool, error) {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer txn.Rollback()
+
+	var secret string
+	var last int64
+	var locked bool
+	err = txn.QueryRowContext(ctx, `select totp_secret, totp_last, coalesce(locked_until > now(), false) from users where id = $1 and totp_secret <> '' and not disabled for update`, id).Scan(&secret, &last, &locked)
+	if err != nil {
+		return false, notFound(err, "Two-factor authentication is not enabled")
+	}
+	if locked {
+		return false, ErrLockedOut
+	}
+
+	if step, ok := ValidTOTP(secret, code, time.Now(), last); ok {
+		_, err = txn.ExecContext(ctx, `update users set totp_last = $1, failed_logins = 0, locked_until = null where id = $2`, step, id)
+		if err != nil {
+			return false, err
+		}
+		return true, txn.Commit()
+	}
+
+	res, err := txn.ExecContext(ctx, `delete from recovery_codes where userid = $1 and hash = $2`, id, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		if err := failLogin(ctx, txn, id); err != nil {
+			return false, err
+		}
+		return false, txn.Commit()
+	}
+
+	_, err = txn.ExecContext(ctx, `update users set failed_logins = 0, locked_until = null where id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	return true, txn.Commit()
+}
+
+// DeleteUser removes the user with the given id. Users that still own
+// articles can not be removed, disable them instead.
+func DeleteUser(db *sql.DB, id int) error {
+	return DeleteUserContext(context.Background(), db, id)
+}
+
+// DeleteUserContext is DeleteUser with a context
+func DeleteUserContext(ctx context.Context, db *sql.DB, id int) error {
+	res, err := db.ExecContext(ctx, `delete from users where id = $1`, id)
+	if err != nil {
+		if isViolation(err, "foreign_key_violation") {
+			return NewError(Invalid, err, "This user still owns articles, disable the account instead")
+		}
+		return err
+	}
+
+	return rowAffected(res, "No user with id %d", id)
+}
+
+// InsertArticle takes an Article and inserts it into the db, it will verify the Author exists
+// prior to inserting. Tags that do not exist yet are created when createTags is set, otherwise
+// the article is rejected.
+func InsertArticle(db *sql.DB, a Article, createTags bool) (*int, error) {
+	return InsertArticleContext(context.Background(), db, a, createTags)
+}
+
+// InsertArticleContext is InsertArticle with a context
+func InsertArticleContext(ctx context.Context, db *sql.DB, a Article, createTags bool) (*int, error) {
+	var id int
+	uid, err := AssignUserContext(ctx, db, a.Author.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	a.AuthorID = *uid
+
+	Logger(ctx).WithField("author_id", a.AuthorID).Debug("assigned article author")
+
+	// New tags are only kept when the article is.
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	tags, err := resolveTags(ctx, txn, a.Tags.Join(), createTags)
+	if err != nil {
+		return nil, err
+	}
+
+	err = txn.QueryRowContext(ctx, `INSERT INTO articles (title, body, created, live, sig, authorid) values ($1, $2, $3, $4, $5, $6) returning id`, a.Title, a.Body, a.Date, a.Live, a.Signature, a.AuthorID).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tid := range tags {
+		if _, err := txn.ExecContext(ctx, `insert into article_tags (articleid, tagid) values ($1, $2)`, id, tid); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
 		return nil, err
 	}
 
@@ -420,7 +2345,12 @@ func InsertArticle(db *sql.DB, a Article) (*int, error) {
 // AssignUser takes a article (with user already assigned), gets the ID of said user from the db, and creates
 // the association assuming the user exists in the db.
 func AssignUser(db *sql.DB, e string) (*int, error) {
-	uid, err := GetUserIDByEmail(db, e)
+	return AssignUserContext(context.Background(), db, e)
+}
+
+// AssignUserContext is AssignUser with a context
+func AssignUserContext(ctx context.Context, db *sql.DB, e string) (*int, error) {
+	uid, err := GetUserIDByEmailContext(ctx, db, e)
 	if err != nil {
 		return nil, err
 	}
@@ -430,23 +2360,28 @@ func AssignUser(db *sql.DB, e string) (*int, error) {
 
 // AssignTags takes a set of tag ids and an article id and creates the association in the article_tags table
 func AssignTags(db *sql.DB, ts []int, id int) error {
-	txn, err := db.Begin()
+	return AssignTagsContext(context.Background(), db, ts, id)
+}
+
+// AssignTagsContext is AssignTags with a context
+func AssignTagsContext(ctx context.Context, db *sql.DB, ts []int, id int) error {
+	txn, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	stmt, err := txn.Prepare(pq.CopyIn("article_tags", "articleid", "tagid"))
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn("article_tags", "articleid", "tagid"))
 	if err != nil {
 		return err
 	}
 
 	for _, tid := range ts {
-		_, err = stmt.Exec(id, tid)
+		_, err = stmt.ExecContext(ctx, id, tid)
 		if err != nil {
 			return err
 		}
 	}
-	_, err = stmt.Exec()
+	_, err = stmt.ExecContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -463,3 +2398,223 @@ func AssignTags(db *sql.DB, ts []int, id int) error {
 
 	return nil
 }
+
+// ResolveTags returns the ids of the named tags. Unknown tags are created when create
+// is set, otherwise an Invalid error listing them is returned.
+func ResolveTags(db *sql.DB, names []string, create bool) ([]int, error) {
+	return ResolveTagsContext(context.Background(), db, names, create)
+}
+
+// ResolveTagsContext is ResolveTags with a context
+func ResolveTagsContext(ctx context.Context, db *sql.DB, names []string, create bool) ([]int, error) {
+	return resolveTags(ctx, db, names, create)
+}
+
+// rowQuerier is a *sql.DB or a *sql.Tx
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// resolveTags is ResolveTags on q, so articles can create their tags in
+// the transaction that saves them. A name given twice is resolved once and
+// blank names, as left by a trailing comma in a tags: line, are skipped.
+func resolveTags(ctx context.Context, q rowQuerier, names []string, create bool) ([]int, error) {
+	var ids []int
+	var unknown []string
+
+	seen := map[string]bool{}
+	for _, n := range names {
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+
+		t, err := getTagByName(ctx, q, n)
+		if err == nil {
+			ids = append(ids, t.ID)
+			continue
+		}
+		if KindOf(err) != NotFound {
+			return nil, err
+		}
+		unknown = append(unknown, n)
+	}
+
+	if len(unknown) > 0 && !create {
+		return nil, NewError(Invalid, nil, "Unknown tags: %s", strings.Join(unknown, ", "))
+	}
+
+	for _, n := range unknown {
+		id, err := insertTag(ctx, q, n)
+		if err != nil {
+			return nil, err
+		}
+		Logger(ctx).WithField("tag", n).Info("created tag")
+		ids = append(ids, *id)
+	}
+
+	return ids, nil
+}
+
+// GetTag returns the tag with the given id
+func GetTag(db *sql.DB, id int) (*Tag, error) {
+	return GetTagContext(context.Background(), db, id)
+}
+
+// GetTagContext is GetTag with a context
+func GetTagContext(ctx context.Context, db *sql.DB, id int) (*Tag, error) {
+	var t = Tag{}
+	err := db.QueryRowContext(ctx, `select id, created, name from tags where id = $1`, id).Scan(&t.ID, &t.Created, &t.Name)
+	if err != nil {
+		return nil, notFound(err, "No tag with id %d", id)
+	}
+
+	return &t, nil
+}
+
+// GetTagByName returns the tag with the given name
+func GetTagByName(db *sql.DB, name string) (*Tag, error) {
+	return GetTagByNameContext(context.Background(), db, name)
+}
+
+// GetTagByNameContext is GetTagByName with a context
+func GetTagByNameContext(ctx context.Context, db *sql.DB, name string) (*Tag, error) {
+	return getTagByName(ctx, db, name)
+}
+
+func getTagByName(ctx context.Context, q rowQuerier, name string) (*Tag, error) {
+	var t = Tag{}
+	err := q.QueryRowContext(ctx, `select id, created, name from tags where name = $1`, name).Scan(&t.ID, &t.Created, &t.Name)
+	if err != nil {
+		return nil, notFound(err, "No tag named %q", name)
+	}
+
+	return &t, nil
+}
+
+// InsertTag creates a new tag
+func InsertTag(db *sql.DB, name string) (*int, error) {
+	return InsertTagContext(context.Background(), db, name)
+}
+
+// InsertTagContext is InsertTag with a context
+func InsertTagContext(ctx context.Context, db *sql.DB, name string) (*int, error) {
+	return insertTag(ctx, db, name)
+}
+
+func insertTag(ctx context.Context, q rowQuerier, name string) (*int, error) {
+	if err := ValidTagName(name); err != nil {
+		return nil, err
+	}
+
+	var id int
+	err := q.QueryRowContext(ctx, `insert into tags (name) values ($1) returning id`, name).Scan(&id)
+	if err != nil {
+		if isViolation(err, "unique_violation") {
+			return nil, NewError(Invalid, err, "The tag %q already exists", name)
+		}
+		return nil, err
+	}
+
+	return &id, nil
+}
+
+// RenameTag changes the name of a tag
+func RenameTag(db *sql.DB, id int, name string) error {
+	return RenameTagContext(context.Background(), db, id, name)
+}
+
+// RenameTagContext is RenameTag with a context
+func RenameTagContext(ctx context.Context, db *sql.DB, id int, name string) error {
+	if err := ValidTagName(name); err != nil {
+		return err
+	}
+
+	res, err := db.ExecContext(ctx, `update tags set name = $1 where id = $2`, name, id)
+	if err != nil {
+		if isViolation(err, "unique_violation") {
+			return NewError(Invalid, err, "The tag %q already exists, merge the tags instead", name)
+		}
+		return err
+	}
+
+	return rowAffected(res, "No tag with id %d", id)
+}
+
+// DeleteTag removes a tag and its associations with articles
+func DeleteTag(db *sql.DB, id int) error {
+	return DeleteTagContext(context.Background(), db, id)
+}
+
+// DeleteTagContext is DeleteTag with a context
+func DeleteTagContext(ctx context.Context, db *sql.DB, id int) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	_, err = txn.ExecContext(ctx, `delete from article_tags where tagid = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	res, err := txn.ExecContext(ctx, `delete from tags where id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if err = rowAffected(res, "No tag with id %d", id); err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// MergeTags moves every article tagged with from over to into and removes from
+func MergeTags(db *sql.DB, from, into int) error {
+	return MergeTagsContext(context.Background(), db, from, into)
+}
+
+// MergeTagsContext is MergeTags with a context
+func MergeTagsContext(ctx context.Context, db *sql.DB, from, into int) error {
+	if from == into {
+		return NewError(Invalid, nil, "Can not merge a tag into itself")
+	}
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	var n int
+	err = txn.QueryRowContext(ctx, `select count(*) from tags where id = any($1)`, pq.Array([]int{from, into})).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n != 2 {
+		return NewError(NotFound, nil, "Both tags need to exist to merge them")
+	}
+
+	// Articles carrying both tags would end up with a duplicate row.
+	_, err = txn.ExecContext(ctx, `
+		update article_tags set tagid = $2
+		where tagid = $1 and articleid not in (
+			select articleid from article_tags where tagid = $2
+		)`, from, into)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, `delete from article_tags where tagid = $1`, from)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.ExecContext(ctx, `delete from tags where id = $1`, from)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
@@ -0,0 +1,13 @@
+package dnews
+
+import "testing"
+
+func TestLockoutDoublings(t *testing.T) {
+	n := lockoutDoublings()
+	if LockoutBase<<uint(n) < LockoutMax {
+		t.Errorf("%d doublings of %s stay below %s", n, LockoutBase, LockoutMax)
+	}
+	if n > 0 && LockoutBase<<uint(n-1) >= LockoutMax {
+		t.Errorf("%d doublings of %s already reach %s", n-1, LockoutBase, LockoutMax)
+	}
+}
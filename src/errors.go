@@ -0,0 +1,92 @@
+package dnews
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Kind classifies an Error so callers can decide how to report it
+type Kind int
+
+// Kinds of errors returned by the dnews package
+const (
+	Internal Kind = iota
+	NotFound
+	Forbidden
+	Invalid
+	Limited
+	Unauthorized
+)
+
+// Error is returned by the dnews package for failures callers are expected
+// to handle. Message is safe to show to visitors, Err is the underlying
+// cause and is only meant for logs.
+type Error struct {
+	Kind    Kind
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+// KindOf returns the Kind of err. Errors that did not come from this
+// package are Internal.
+func KindOf(err error) Kind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return Internal
+}
+
+// MessageOf returns the visitor safe message of err, or "" for errors that
+// did not come from this package.
+func MessageOf(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Message
+	}
+	return ""
+}
+
+// NewError builds an Error of the given kind
+func NewError(k Kind, err error, format string, args ...interface{}) error {
+	return &Error{
+		Kind:    k,
+		Message: fmt.Sprintf(format, args...),
+		Err:     err,
+	}
+}
+
+// notFound turns sql.ErrNoRows into a NotFound error, leaving anything
+// else untouched
+func notFound(err error, format string, args ...interface{}) error {
+	if err == sql.ErrNoRows {
+		return NewError(NotFound, err, format, args...)
+	}
+	return err
+}
+
+// isViolation reports whether err is a PostgreSQL error for the named
+// condition, e.g. "unique_violation"
+func isViolation(err error, name string) bool {
+	pe, ok := err.(*pq.Error)
+	return ok && pe.Code.Name() == name
+}
+
+// rowAffected returns a NotFound error when res did not touch any rows
+func rowAffected(res sql.Result, format string, args ...interface{}) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return NewError(NotFound, nil, format, args...)
+	}
+	return nil
+}
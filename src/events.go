@@ -0,0 +1,427 @@
+package dnews
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of events
+const (
+	EventMeeting    = "meeting"
+	EventConference = "conference"
+)
+
+// How an event repeats. RecurMonthly repeats on the same weekday of the
+// month as the first meeting, e.g. every second Tuesday, which is how most
+// user groups schedule.
+const (
+	RecurNone    = ""
+	RecurWeekly  = "weekly"
+	RecurMonthly = "monthly"
+)
+
+// Event is a user group meeting or a conference
+type Event struct {
+	ID         int
+	Created    time.Time
+	BugID      int
+	BugName    string
+	Kind       string
+	Title      string
+	Descr      string
+	Location   string
+	URL        string
+	Starts     time.Time
+	Ends       time.Time
+	TZ         string
+	Recur      string
+	RecurUntil time.Time
+}
+
+// Events are a collection of Event
+type Events []*Event
+
+// EventFilter narrows down the results of GetEvents. Zero values match
+// everything.
+type EventFilter struct {
+	BugID      int
+	PublicOnly bool
+}
+
+// Occurrence is a single instance of a possibly recurring Event
+type Occurrence struct {
+	Event  *Event
+	Starts time.Time
+	Ends   time.Time
+}
+
+// Validate checks the fields of e
+func (e *Event) Validate() error {
+	if strings.TrimSpace(e.Title) == "" {
+		return NewError(Invalid, nil, "A title is required")
+	}
+	switch e.Kind {
+	case EventMeeting, EventConference:
+	default:
+		return NewError(Invalid, nil, "Unknown event kind %q", e.Kind)
+	}
+	switch e.Recur {
+	case RecurNone, RecurWeekly, RecurMonthly:
+	default:
+		return NewError(Invalid, nil, "Unknown recurrence %q", e.Recur)
+	}
+	if _, err := time.LoadLocation(e.TZ); err != nil {
+		return NewError(Invalid, err, "Unknown time zone %q", e.TZ)
+	}
+	if e.Starts.IsZero() || !e.Ends.After(e.Starts) {
+		return NewError(Invalid, nil, "An event needs to end after it starts")
+	}
+	if e.URL != "" {
+		if u, err := url.Parse(e.URL); err != nil || u.Host == "" {
+			return NewError(Invalid, err, "%q is not a valid URL", e.URL)
+		}
+	}
+	return nil
+}
+
+// location returns the time zone the event is scheduled in
+func (e *Event) location() *time.Location {
+	loc, err := time.LoadLocation(e.TZ)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// In returns t in the time zone of e, for showing times the way the
+// organisers entered them
+func (e *Event) In(t time.Time) time.Time {
+	return t.In(e.location())
+}
+
+// maxOccurrences bounds the number of occurrences Occurrences returns for a
+// single event
+const maxOccurrences = 1000
+
+// Occurrences returns the instances of e that overlap [from, to). Recurring
+// events are expanded in their own time zone so meetings stay at the same
+// wall clock time across daylight saving changes.
+func (e *Event) Occurrences(from, to time.Time) []Occurrence {
+	var occ []Occurrence
+	length := e.Ends.Sub(e.Starts)
+	start := e.Starts.In(e.location())
+
+	for i := e.firstNear(start, from.Add(-length)); len(occ) < maxOccurrences; i++ {
+		s := e.nth(start, i)
+		if s.IsZero() || !s.Before(to) {
+			break
+		}
+		if e.Recur != RecurNone && !e.RecurUntil.IsZero() && s.After(e.RecurUntil) {
+			break
+		}
+		if s.Add(length).After(from) {
+			occ = append(occ, Occurrence{Event: e, Starts: s, Ends: s.Add(length)})
+		}
+		if e.Recur == RecurNone {
+			break
+		}
+	}
+
+	return occ
+}
+
+// firstNear returns the index of a repetition starting at most a step
+// before t, so Occurrences need not walk every repetition since start. It
+// errs on the early side to be safe across daylight saving changes.
+func (e *Event) firstNear(start, t time.Time) int {
+	if !t.After(start) {
+		return 0
+	}
+	var i int
+	switch e.Recur {
+	case RecurWeekly:
+		i = int(t.Sub(start)/(7*24*time.Hour)) - 1
+	case RecurMonthly:
+		ty, tm, _ := t.In(start.Location()).Date()
+		sy, sm, _ := start.Date()
+		i = (ty-sy)*12 + int(tm-sm) - 1
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// nth returns the start of the i'th repetition of an event first starting
+// at start, or the zero time if there is none
+func (e *Event) nth(start time.Time, i int) time.Time {
+	switch e.Recur {
+	case RecurNone:
+		if i > 0 {
+			return time.Time{}
+		}
+		return start
+	case RecurWeekly:
+		return start.AddDate(0, 0, 7*i)
+	case RecurMonthly:
+		week, last := weekOfMonth(start)
+		y, m, _ := start.Date()
+		first := time.Date(y, m+time.Month(i), 1, start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+		if last {
+			// Step back from the first of the next month.
+			d := first.AddDate(0, 1, -1)
+			for d.Weekday() != start.Weekday() {
+				d = d.AddDate(0, 0, -1)
+			}
+			return d
+		}
+		d := first
+		for d.Weekday() != start.Weekday() {
+			d = d.AddDate(0, 0, 1)
+		}
+		return d.AddDate(0, 0, 7*(week-1))
+	}
+	return time.Time{}
+}
+
+// weekOfMonth returns which weekday of its month t falls on, e.g. 2 for the
+// second Tuesday. A fifth weekday is reported as the last one.
+func weekOfMonth(t time.Time) (week int, last bool) {
+	week = (t.Day()-1)/7 + 1
+	return week, week == 5
+}
+
+// Upcoming returns the occurrences of all events in [from, to) ordered by
+// start time
+func (es Events) Upcoming(from, to time.Time) []Occurrence {
+	var occ []Occurrence
+	for _, e := range es {
+		occ = append(occ, e.Occurrences(from, to)...)
+	}
+	sort.Slice(occ, func(i, j int) bool {
+		return occ[i].Starts.Before(occ[j].Starts)
+	})
+	return occ
+}
+
+// rrule returns the iCalendar recurrence rule of e, or "" if it does not
+// repeat
+func (e *Event) rrule() string {
+	var r string
+	switch e.Recur {
+	case RecurWeekly:
+		r = "FREQ=WEEKLY"
+	case RecurMonthly:
+		start := e.Starts.In(e.location())
+		week, last := weekOfMonth(start)
+		if last {
+			week = -1
+		}
+		day := strings.ToUpper(start.Weekday().String()[:2])
+		r = fmt.Sprintf("FREQ=MONTHLY;BYDAY=%d%s", week, day)
+	default:
+		return ""
+	}
+	if !e.RecurUntil.IsZero() {
+		r += ";UNTIL=" + e.RecurUntil.UTC().Format(icalUTC)
+	}
+	return r
+}
+
+const icalUTC = "20060102T150405Z"
+const icalLocal = "20060102T150405"
+
+// ICal writes es as an RFC 5545 calendar named name, using host to build
+// unique event ids. Recurring events are written in their own time zone by
+// TZID so repetitions follow daylight saving, with a VTIMEZONE for each
+// zone, everything else is written in UTC.
+func (es Events) ICal(w io.Writer, name string, host string) error {
+	c := &icalWriter{w: w}
+	c.line("BEGIN:VCALENDAR")
+	c.line("VERSION:2.0")
+	c.line("PRODID:-//Daemon.News//dnews//EN")
+	c.line("CALSCALE:GREGORIAN")
+	c.line("X-WR-CALNAME:" + icalEscape(name))
+
+	// Every TZID needs its VTIMEZONE, described from the year the
+	// earliest event using it starts.
+	years := map[*time.Location]int{}
+	var zones []*time.Location
+	for _, e := range es {
+		if e.rrule() == "" {
+			continue
+		}
+		loc := e.location()
+		y, seen := years[loc]
+		if !seen {
+			zones = append(zones, loc)
+		}
+		if start := e.Starts.In(loc).Year(); !seen || start < y {
+			years[loc] = start
+		}
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return zones[i].String() < zones[j].String()
+	})
+	for _, loc := range zones {
+		c.vtimezone(loc, years[loc])
+	}
+
+	now := time.Now().UTC().Format(icalUTC)
+	for _, e := range es {
+		c.line("BEGIN:VEVENT")
+		c.line(fmt.Sprintf("UID:event-%d@%s", e.ID, host))
+		c.line("DTSTAMP:" + now)
+		if rule := e.rrule(); rule != "" {
+			loc := e.location()
+			c.line(fmt.Sprintf("DTSTART;TZID=%s:%s", loc, e.Starts.In(loc).Format(icalLocal)))
+			c.line(fmt.Sprintf("DTEND;TZID=%s:%s", loc, e.Ends.In(loc).Format(icalLocal)))
+			c.line("RRULE:" + rule)
+		} else {
+			c.line("DTSTART:" + e.Starts.UTC().Format(icalUTC))
+			c.line("DTEND:" + e.Ends.UTC().Format(icalUTC))
+		}
+		c.line("SUMMARY:" + icalEscape(e.Title))
+		if e.Descr != "" {
+			c.line("DESCRIPTION:" + icalEscape(e.Descr))
+		}
+		if e.Location != "" {
+			c.line("LOCATION:" + icalEscape(e.Location))
+		}
+		if e.URL != "" {
+			c.line("URL:" + e.URL)
+		}
+		if e.Kind == EventConference {
+			c.line("CATEGORIES:CONFERENCE")
+		} else {
+			c.line("CATEGORIES:MEETING")
+		}
+		c.line("END:VEVENT")
+	}
+
+	c.line("END:VCALENDAR")
+	return c.err
+}
+
+// zoneTransitions returns the instants in year at which loc changes its
+// offset from UTC
+func zoneTransitions(loc *time.Location, year int) []time.Time {
+	var ts []time.Time
+	day := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := day.AddDate(1, 0, 0)
+	for ; day.Before(end); day = day.AddDate(0, 0, 1) {
+		_, before := day.In(loc).Zone()
+		next := day.AddDate(0, 0, 1)
+		if _, after := next.In(loc).Zone(); after == before {
+			continue
+		}
+		// narrow the day down to the second the offset changes
+		lo, hi := day, next
+		for hi.Sub(lo) > time.Second {
+			mid := lo.Add(hi.Sub(lo) / 2)
+			if _, off := mid.In(loc).Zone(); off == before {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		ts = append(ts, hi)
+	}
+	return ts
+}
+
+// icalOffset formats an offset from UTC in seconds as +HHMM
+func icalOffset(secs int) string {
+	sign := "+"
+	if secs < 0 {
+		sign, secs = "-", -secs
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, secs/3600, secs/60%60)
+}
+
+// vtimezone writes the VTIMEZONE of loc. Its daylight saving changes are
+// described by the weekday of the month they fall on in year, which is how
+// zones schedule them.
+func (c *icalWriter) vtimezone(loc *time.Location, year int) {
+	c.line("BEGIN:VTIMEZONE")
+	c.line("TZID:" + loc.String())
+
+	ts := zoneTransitions(loc, year)
+	if len(ts) == 0 {
+		name, off := time.Date(year, time.January, 1, 0, 0, 0, 0, loc).Zone()
+		c.line("BEGIN:STANDARD")
+		c.line("DTSTART:19700101T000000")
+		c.line("TZOFFSETFROM:" + icalOffset(off))
+		c.line("TZOFFSETTO:" + icalOffset(off))
+		c.line("TZNAME:" + name)
+		c.line("END:STANDARD")
+	}
+
+	largest := 0
+	for i, t := range ts {
+		if _, off := t.In(loc).Zone(); i == 0 || off > largest {
+			largest = off
+		}
+	}
+	for _, t := range ts {
+		_, from := t.Add(-time.Second).In(loc).Zone()
+		name, to := t.In(loc).Zone()
+		kind := "STANDARD"
+		if to == largest && to > from {
+			kind = "DAYLIGHT"
+		}
+
+		// The onset is given in the local time before the change.
+		onset := t.In(time.FixedZone("", from))
+		week, last := weekOfMonth(onset)
+		if last || onset.AddDate(0, 0, 7).Month() != onset.Month() {
+			week = -1
+		}
+
+		c.line("BEGIN:" + kind)
+		c.line("DTSTART:" + onset.Format(icalLocal))
+		c.line("TZOFFSETFROM:" + icalOffset(from))
+		c.line("TZOFFSETTO:" + icalOffset(to))
+		c.line("TZNAME:" + name)
+		c.line(fmt.Sprintf("RRULE:FREQ=YEARLY;BYMONTH=%d;BYDAY=%d%s", onset.Month(), week, strings.ToUpper(onset.Weekday().String()[:2])))
+		c.line("END:" + kind)
+	}
+
+	c.line("END:VTIMEZONE")
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icalEscape(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// icalWriter writes CRLF terminated content lines, folding them at 75
+// octets without splitting UTF-8 sequences
+type icalWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *icalWriter) line(s string) {
+	if c.err != nil {
+		return
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		l := len(string(r))
+		if n+l > 75 {
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += l
+	}
+	b.WriteString("\r\n")
+	_, c.err = io.WriteString(c.w, b.String())
+}
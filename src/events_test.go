@@ -0,0 +1,262 @@
+package dnews
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestOccurrencesLongRunning(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	starts := time.Date(1998, 3, 4, 19, 0, 0, 0, ny)
+	from := time.Date(2018, 3, 1, 0, 0, 0, 0, ny)
+	to := time.Date(2018, 4, 1, 0, 0, 0, 0, ny)
+
+	for _, tc := range []struct {
+		recur string
+		want  []time.Time
+	}{
+		{RecurWeekly, []time.Time{
+			time.Date(2018, 3, 7, 19, 0, 0, 0, ny),
+			time.Date(2018, 3, 14, 19, 0, 0, 0, ny),
+			time.Date(2018, 3, 21, 19, 0, 0, 0, ny),
+			time.Date(2018, 3, 28, 19, 0, 0, 0, ny),
+		}},
+		// The first Wednesday of the month
+		{RecurMonthly, []time.Time{
+			time.Date(2018, 3, 7, 19, 0, 0, 0, ny),
+		}},
+	} {
+		e := &Event{
+			Starts: starts,
+			Ends:   starts.Add(2 * time.Hour),
+			TZ:     "America/New_York",
+			Recur:  tc.recur,
+		}
+		occ := e.Occurrences(from, to)
+		if len(occ) != len(tc.want) {
+			t.Fatalf("%s: got %d occurrences, want %d", tc.recur, len(occ), len(tc.want))
+		}
+		for i, o := range occ {
+			if !o.Starts.Equal(tc.want[i]) {
+				t.Errorf("%s: occurrence %d starts %s, want %s", tc.recur, i, o.Starts, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestOccurrencesOverlapFrom(t *testing.T) {
+	starts := time.Date(2018, 1, 1, 22, 0, 0, 0, time.UTC)
+	e := &Event{
+		Starts: starts,
+		Ends:   starts.Add(4 * time.Hour),
+		TZ:     "UTC",
+		Recur:  RecurWeekly,
+	}
+
+	// The meeting of 2018-03-05 runs past midnight into the window.
+	from := time.Date(2018, 3, 6, 0, 0, 0, 0, time.UTC)
+	occ := e.Occurrences(from, from.Add(time.Hour))
+	if len(occ) != 1 || !occ[0].Starts.Equal(time.Date(2018, 3, 5, 22, 0, 0, 0, time.UTC)) {
+		t.Fatalf("got %v, want the meeting of 2018-03-05", occ)
+	}
+}
+
+func TestOccurrencesCap(t *testing.T) {
+	starts := time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := &Event{
+		Starts: starts,
+		Ends:   starts.Add(time.Hour),
+		TZ:     "UTC",
+		Recur:  RecurWeekly,
+	}
+
+	from := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	occ := e.Occurrences(from, from.AddDate(100, 0, 0))
+	if len(occ) != maxOccurrences {
+		t.Fatalf("got %d occurrences, want %d", len(occ), maxOccurrences)
+	}
+	if occ[0].Starts.Before(from) {
+		t.Errorf("first occurrence %s is before %s", occ[0].Starts, from)
+	}
+}
+
+// icalGolden is the calendar TestICal expects, with LF line ends and the
+// DTSTAMPs replaced by NOW
+const icalGolden = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Daemon.News//dnews//EN
+CALSCALE:GREGORIAN
+X-WR-CALNAME:Daemon.News\, events
+BEGIN:VTIMEZONE
+TZID:Australia/Sydney
+BEGIN:STANDARD
+DTSTART:20180401T030000
+TZOFFSETFROM:+1100
+TZOFFSETTO:+1000
+TZNAME:AEST
+RRULE:FREQ=YEARLY;BYMONTH=4;BYDAY=1SU
+END:STANDARD
+BEGIN:DAYLIGHT
+DTSTART:20181007T020000
+TZOFFSETFROM:+1000
+TZOFFSETTO:+1100
+TZNAME:AEDT
+RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=1SU
+END:DAYLIGHT
+END:VTIMEZONE
+BEGIN:VTIMEZONE
+TZID:Europe/Berlin
+BEGIN:DAYLIGHT
+DTSTART:20180325T020000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0200
+TZNAME:CEST
+RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU
+END:DAYLIGHT
+BEGIN:STANDARD
+DTSTART:20181028T030000
+TZOFFSETFROM:+0200
+TZOFFSETTO:+0100
+TZNAME:CET
+RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU
+END:STANDARD
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:event-1@daemon.news
+DTSTAMP:NOW
+DTSTART;TZID=Europe/Berlin:20180130T190000
+DTEND;TZID=Europe/Berlin:20180130T220000
+RRULE:FREQ=MONTHLY;BYDAY=-1TU;UNTIL=20181231T000000Z
+SUMMARY:BSD night
+LOCATION:c-base\, Rungestraße 20\; Berlin
+CATEGORIES:MEETING
+END:VEVENT
+BEGIN:VEVENT
+UID:event-2@daemon.news
+DTSTAMP:NOW
+DTSTART;TZID=Australia/Sydney:20180206T183000
+DTEND;TZID=Australia/Sydney:20180206T203000
+RRULE:FREQ=WEEKLY
+SUMMARY:SyBUG
+URL:https://sybug.example/
+CATEGORIES:MEETING
+END:VEVENT
+BEGIN:VEVENT
+UID:event-3@daemon.news
+DTSTAMP:NOW
+DTSTART:20180920T080000Z
+DTEND:20180923T180000Z
+SUMMARY:EuroBSDCon
+DESCRIPTION:Talks\, tutorials and a hallway track.\nÜbernachtung is not in
+ cluded\; bring a towel \\ and snacks.
+CATEGORIES:CONFERENCE
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestICal(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	es := Events{
+		// The last Tuesday of the month, in a zone that changes on the
+		// last Sunday of March and October.
+		{
+			ID:         1,
+			Kind:       EventMeeting,
+			Title:      "BSD night",
+			Location:   "c-base, Rungestraße 20; Berlin",
+			TZ:         "Europe/Berlin",
+			Starts:     time.Date(2018, 1, 30, 19, 0, 0, 0, berlin),
+			Ends:       time.Date(2018, 1, 30, 22, 0, 0, 0, berlin),
+			Recur:      RecurMonthly,
+			RecurUntil: time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC),
+		},
+		// Daylight saving ends in April and starts in October.
+		{
+			ID:     2,
+			Kind:   EventMeeting,
+			Title:  "SyBUG",
+			URL:    "https://sybug.example/",
+			TZ:     "Australia/Sydney",
+			Starts: time.Date(2018, 2, 6, 18, 30, 0, 0, sydney),
+			Ends:   time.Date(2018, 2, 6, 20, 30, 0, 0, sydney),
+			Recur:  RecurWeekly,
+		},
+		{
+			ID:     3,
+			Kind:   EventConference,
+			Title:  "EuroBSDCon",
+			Descr:  "Talks, tutorials and a hallway track.\nÜbernachtung is not included; bring a towel \\ and snacks.",
+			TZ:     "UTC",
+			Starts: time.Date(2018, 9, 20, 8, 0, 0, 0, time.UTC),
+			Ends:   time.Date(2018, 9, 23, 18, 0, 0, 0, time.UTC),
+		},
+	}
+
+	var b bytes.Buffer
+	if err := es.ICal(&b, "Daemon.News, events", "daemon.news"); err != nil {
+		t.Fatal(err)
+	}
+	got := regexp.MustCompile(`DTSTAMP:\d{8}T\d{6}Z`).ReplaceAllString(b.String(), "DTSTAMP:NOW")
+	want := strings.Replace(icalGolden, "\n", "\r\n", -1)
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestICalFolding(t *testing.T) {
+	var b bytes.Buffer
+	c := &icalWriter{w: &b}
+	value := strings.Repeat("é", 40)
+	c.line("SUMMARY:" + value)
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), lines)
+	}
+	for _, l := range lines {
+		if len(l) > 75 {
+			t.Errorf("%q is %d octets long", l, len(l))
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("%q splits a UTF-8 sequence", l)
+		}
+	}
+	// 8 octets of name and 33 two octet runes fill the first line to 74,
+	// the next rune would not fit.
+	if len(lines[0]) != 74 || !strings.HasPrefix(lines[1], " ") {
+		t.Errorf("folded as %q", lines)
+	}
+	if unfolded := lines[0] + lines[1][1:]; unfolded != "SUMMARY:"+value {
+		t.Errorf("unfolds to %q", unfolded)
+	}
+}
+
+func TestICalEscape(t *testing.T) {
+	for in, want := range map[string]string{
+		"plain":             "plain",
+		"a, b; c":           `a\, b\; c`,
+		`back\slash`:        `back\\slash`,
+		"one\ntwo\r\nthree": `one\ntwo\nthree`,
+	} {
+		if got := icalEscape(in); got != want {
+			t.Errorf("icalEscape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
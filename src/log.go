@@ -0,0 +1,34 @@
+package dnews
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log is where the dnews package sends its log output. Programs using the
+// package may change its level, formatter and output.
+var Log = logrus.New()
+
+type ctxKey int
+
+const requestIDKey ctxKey = iota
+
+// WithRequestID returns a copy of ctx carrying the given request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id stored in ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Logger returns a log entry for ctx, tagged with its request id when known
+func Logger(ctx context.Context) *logrus.Entry {
+	if id := RequestID(ctx); id != "" {
+		return Log.WithField("request_id", id)
+	}
+	return logrus.NewEntry(Log)
+}
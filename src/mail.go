@@ -0,0 +1,100 @@
+package dnews
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. SMTPMailer is used in production, FileMailer and
+// LogMailer keep mail local for development.
+type Mailer interface {
+	Send(from string, m *Message) error
+}
+
+// headerSafe keeps visitor supplied values from adding headers
+var headerSafe = strings.NewReplacer("\r", "", "\n", "")
+
+// Bytes renders m as an RFC 5322 message from from
+func (m *Message) Bytes(from string) []byte {
+	var id [12]byte
+	rand.Read(id[:])
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerSafe.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerSafe.Replace(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerSafe.Replace(m.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%x@dnews>\r\n", id)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.Write(bytes.Replace([]byte(m.Body), []byte("\n"), []byte("\r\n"), -1))
+	return b.Bytes()
+}
+
+// SMTPMailer sends mail through an SMTP server, authenticating when User
+// is set
+type SMTPMailer struct {
+	Addr string
+	User string
+	Pass string
+}
+
+// Send implements Mailer. from may carry a display name, only its address
+// is given to the server as the envelope sender.
+func (s *SMTPMailer) Send(from string, m *Message) error {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.User != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.User, s.Pass, host)
+	}
+	return smtp.SendMail(s.Addr, auth, sender.Address, []string{m.To}, m.Bytes(from))
+}
+
+// FileMailer writes each message to its own file in Dir
+type FileMailer struct {
+	Dir string
+}
+
+// Send implements Mailer
+func (f *FileMailer) Send(from string, m *Message) error {
+	name := filepath.Join(f.Dir, fmt.Sprintf("%d.eml", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(name, m.Bytes(from), 0600); err != nil {
+		return err
+	}
+	Log.WithField("to", m.To).WithField("file", name).Info("mail written")
+	return nil
+}
+
+// LogMailer writes messages to the log instead of sending them
+type LogMailer struct{}
+
+// Send implements Mailer
+func (LogMailer) Send(from string, m *Message) error {
+	Log.WithField("to", m.To).WithField("subject", m.Subject).Info(m.Body)
+	return nil
+}
@@ -0,0 +1,112 @@
+package dnews
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP accepts one message on a loopback listener and sends the
+// commands and data it received on the returned channel
+func fakeSMTP(t *testing.T) (string, <-chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tp := textproto.NewConn(c)
+		var lines []string
+		defer func() { got <- lines }()
+
+		tp.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				lines = append(lines, data...)
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return l.Addr().String(), got
+}
+
+func TestSMTPMailerEnvelope(t *testing.T) {
+	addr, got := fakeSMTP(t)
+	m := &Message{To: "reader@example.com", Subject: "Hello", Body: "hi\n"}
+	s := &SMTPMailer{Addr: addr}
+	if err := s.Send("Daemon.News <daemons@daemon.news>", m); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-got
+	has := func(want string) bool {
+		for _, l := range lines {
+			if l == want {
+				return true
+			}
+		}
+		return false
+	}
+	for _, want := range []string{
+		"MAIL FROM:<daemons@daemon.news>",
+		"RCPT TO:<reader@example.com>",
+		"From: Daemon.News <daemons@daemon.news>",
+		"To: reader@example.com",
+	} {
+		if !has(want) {
+			t.Errorf("%q was not sent in %q", want, lines)
+		}
+	}
+}
+
+func TestSMTPMailerBadFrom(t *testing.T) {
+	s := &SMTPMailer{Addr: "127.0.0.1:1"}
+	if err := s.Send("not an address", &Message{To: "reader@example.com"}); err == nil {
+		t.Error("a malformed sender was accepted")
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	m := &Message{
+		To:      "reader@example.com\r\nBcc: victim@example.com",
+		Subject: "Café",
+		Body:    "one\ntwo\n",
+	}
+	b := string(m.Bytes("daemons@daemon.news"))
+	if strings.Contains(b, "\r\nBcc:") {
+		t.Error("a header was injected through To")
+	}
+	if !strings.Contains(b, "Subject: =?utf-8?q?Caf=C3=A9?=\r\n") {
+		t.Errorf("the subject is not encoded:\n%s", b)
+	}
+	if !strings.HasSuffix(b, "\r\n\r\none\r\ntwo\r\n") {
+		t.Errorf("the body does not use CRLF:\n%q", b)
+	}
+	if _, err := textproto.NewReader(bufio.NewReader(strings.NewReader(b))).ReadMIMEHeader(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,89 @@
+package dnews
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits of the password policy enforced by CheckPassword
+const (
+	MinPasswordLength = 10
+	MaxPasswordLength = 1024
+)
+
+// commonPasswords are rejected outright. They are the usual suspects from
+// breach lists that otherwise pass the length check.
+var commonPasswords = map[string]bool{
+	"1234567890":    true,
+	"0123456789":    true,
+	"1q2w3e4r5t":    true,
+	"qwertyuiop":    true,
+	"password12":    true,
+	"password123":   true,
+	"password1234":  true,
+	"iloveyou12":    true,
+	"letmein123":    true,
+	"welcome123":    true,
+	"changeme123":   true,
+	"administrator": true,
+	"daemonnews":    true,
+	"freebsd123":    true,
+	"openbsd123":    true,
+	"netbsd1234":    true,
+}
+
+// CheckPassword enforces the password policy for u: a minimum length,
+// enough distinct characters and nothing derived from the account itself.
+func CheckPassword(u *User, pass string) error {
+	n := utf8.RuneCountInString(pass)
+	if n < MinPasswordLength {
+		return NewError(Invalid, nil, "Passwords need at least %d characters", MinPasswordLength)
+	}
+	if n > MaxPasswordLength {
+		return NewError(Invalid, nil, "Passwords can have at most %d characters", MaxPasswordLength)
+	}
+
+	distinct := map[rune]bool{}
+	for _, r := range pass {
+		distinct[r] = true
+	}
+	if len(distinct) < 5 {
+		return NewError(Invalid, nil, "That password repeats too few characters, pick a harder one")
+	}
+
+	lower := strings.ToLower(pass)
+	if commonPasswords[lower] {
+		return NewError(Invalid, nil, "That password is too common, pick a harder one")
+	}
+	if u != nil {
+		local := strings.ToLower(strings.SplitN(u.Email, "@", 2)[0])
+		for _, s := range []string{strings.ToLower(u.User), local} {
+			if len(s) >= 3 && strings.Contains(lower, s) {
+				return NewError(Invalid, nil, "Passwords can not contain your user name or email address")
+			}
+		}
+	}
+
+	return nil
+}
+
+// newResetToken returns a random token for the reset link and the hash
+// stored in the database, so a leaked table can not be used to reset
+// passwords
+func newResetToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashResetToken(token), nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
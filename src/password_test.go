@@ -0,0 +1,71 @@
+package dnews
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	u := &User{User: "beastie", Email: "Kirk.McKusick@example.org"}
+	for _, tc := range []struct {
+		pass string
+		ok   bool
+	}{
+		{"correct horse battery", true},
+		{"short pw", false},
+		{strings.Repeat("x", 9), false},
+		{"ünïcödé pw", true},
+		{strings.Repeat("abcde", MaxPasswordLength/5), true},
+		{strings.Repeat("abcde", MaxPasswordLength/5+1), false},
+		{"abababababab", false},
+		{"abcdabcdabcd", false},
+		{"abcdeabcdeab", true},
+		{"1234567890", false},
+		{"Password123", false},
+		{"DaemonNews", false},
+		{"my beastie rocks", false},
+		{"my BEASTIE rocks", false},
+		{"kirk.mckusick rules", false},
+		{"KIRK.McKusick rules", false},
+		{"kirk mckusick rules", true},
+	} {
+		err := CheckPassword(u, tc.pass)
+		if (err == nil) != tc.ok {
+			t.Errorf("CheckPassword(%q) = %v, want ok %v", tc.pass, err, tc.ok)
+		}
+		if err != nil && KindOf(err) != Invalid {
+			t.Errorf("CheckPassword(%q) failed with kind %v", tc.pass, KindOf(err))
+		}
+	}
+}
+
+func TestCheckPasswordShortNames(t *testing.T) {
+	// Names shorter than three characters would rule out too much.
+	u := &User{User: "ed", Email: "ed@example.org"}
+	if err := CheckPassword(u, "edited words here"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckPassword(nil, "beastie rocks"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewResetToken(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token, hash, err := newResetToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[token] {
+			t.Fatalf("token %q was handed out twice", token)
+		}
+		seen[token] = true
+		if hash == token || hash != hashResetToken(token) {
+			t.Errorf("token %q is stored as %q", token, hash)
+		}
+		if len(token) != 43 {
+			t.Errorf("token %q does not carry 32 bytes", token)
+		}
+	}
+}
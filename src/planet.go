@@ -0,0 +1,114 @@
+package dnews
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/mmcdole/gofeed"
+)
+
+// MaxFeedSize is the most we read from a user group feed
+const MaxFeedSize = 2 << 20
+
+// Entry is a post from the feed of a user group, shown on the planet
+type Entry struct {
+	ID        int
+	BugID     int
+	BugName   string
+	BugURL    string
+	GUID      string
+	Title     string
+	Link      string
+	Author    string
+	Content   []byte
+	Published time.Time
+}
+
+// Entries are a collection of Entry
+type Entries []*Entry
+
+// ParseFeed reads an RSS or Atom feed into entries. Content is sanitized
+// with the same policy as articles, so it is safe to render as is.
+func ParseFeed(r io.Reader) (Entries, error) {
+	feed, err := gofeed.NewParser().Parse(r)
+	if err != nil {
+		return nil, NewError(Invalid, err, "Unable to parse feed")
+	}
+
+	policy := bluemonday.UGCPolicy()
+	now := time.Now()
+	var es = Entries{}
+	for _, item := range feed.Items {
+		e := Entry{
+			GUID:  item.GUID,
+			Title: strings.TrimSpace(item.Title),
+		}
+		if validHTTPURL(item.Link) {
+			e.Link = item.Link
+		}
+		if item.Author != nil {
+			e.Author = item.Author.Name
+		}
+
+		switch {
+		case item.PublishedParsed != nil:
+			e.Published = *item.PublishedParsed
+		case item.UpdatedParsed != nil:
+			e.Published = *item.UpdatedParsed
+		}
+		// Keep misdated posts from sticking to the top.
+		if e.Published.IsZero() || e.Published.After(now) {
+			e.Published = now
+		}
+
+		content := item.Content
+		if content == "" {
+			content = item.Description
+		}
+		e.Content = policy.SanitizeBytes([]byte(content))
+
+		// Not every feed has ids, fall back to something that stays the
+		// same between fetches.
+		if e.GUID == "" {
+			e.GUID = item.Link
+		}
+		if e.GUID == "" {
+			e.GUID = fmt.Sprintf("%x", sha1.Sum([]byte(e.Title+"\x00"+content)))
+		}
+		if e.Title == "" {
+			e.Title = "Untitled"
+		}
+
+		es = append(es, &e)
+	}
+
+	return es, nil
+}
+
+// FetchFeed downloads the feed at url and parses it with ParseFeed
+func FetchFeed(ctx context.Context, client *http.Client, url string) (Entries, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "dnews-planet (+https://daemon.news/planet)")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+
+	return ParseFeed(io.LimitReader(resp.Body, MaxFeedSize))
+}
@@ -0,0 +1,190 @@
+package dnews
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rssFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+<channel>
+  <title>NYC*BUG</title>
+  <link>https://nycbug.example/</link>
+  <item>
+    <guid>https://nycbug.example/2017/meeting</guid>
+    <title> Monthly meeting </title>
+    <link>https://nycbug.example/2017/meeting.html</link>
+    <description>&lt;p&gt;Talk on pf&lt;/p&gt;&lt;script&gt;alert(1)&lt;/script&gt;</description>
+    <pubDate>Wed, 01 Mar 2017 19:00:00 +0000</pubDate>
+  </item>
+  <item>
+    <title>No guid</title>
+    <link>https://nycbug.example/2017/no-guid.html</link>
+    <description>Only a link</description>
+    <pubDate>Thu, 02 Mar 2017 19:00:00 +0000</pubDate>
+  </item>
+  <item>
+    <description>Neither guid nor link</description>
+    <pubDate>Fri, 01 Jan 2100 00:00:00 +0000</pubDate>
+  </item>
+  <item>
+    <title>Bad link</title>
+    <link>javascript:alert(1)</link>
+    <guid>bad-link</guid>
+  </item>
+</channel>
+</rss>`
+
+const atomFixture = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>BSD Users Group</title>
+  <id>urn:uuid:feed</id>
+  <updated>2017-03-03T10:00:00Z</updated>
+  <entry>
+    <id>urn:uuid:entry-1</id>
+    <title>Install fest</title>
+    <link href="https://bug.example/installfest"/>
+    <author><name>Beastie</name></author>
+    <updated>2017-03-03T10:00:00Z</updated>
+    <content type="html">&lt;b&gt;Bring&lt;/b&gt; a laptop&lt;script src="x.js"&gt;&lt;/script&gt;</content>
+  </entry>
+  <entry>
+    <id>urn:uuid:entry-2</id>
+    <title>From the future</title>
+    <published>2999-01-01T00:00:00Z</published>
+    <updated>2999-01-01T00:00:00Z</updated>
+    <summary>Soon</summary>
+  </entry>
+</feed>`
+
+// feedServer serves the fixtures at /rss and /atom and fails everything
+// else with the status in the path, /status/404 answers 404
+func feedServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rss":
+			w.Header().Set("Content-Type", "application/rss+xml")
+			fmt.Fprint(w, rssFixture)
+		case "/atom":
+			w.Header().Set("Content-Type", "application/atom+xml")
+			fmt.Fprint(w, atomFixture)
+		case "/garbage":
+			fmt.Fprint(w, "<html>not a feed</html>")
+		default:
+			var code int
+			fmt.Sscanf(r.URL.Path, "/status/%d", &code)
+			if code == 0 {
+				code = http.StatusNotFound
+			}
+			w.WriteHeader(code)
+			fmt.Fprint(w, rssFixture)
+		}
+	}))
+}
+
+func fetchFixture(t *testing.T, srv *httptest.Server, path string) Entries {
+	t.Helper()
+	es, err := FetchFeed(context.Background(), srv.Client(), srv.URL+path)
+	if err != nil {
+		t.Fatalf("FetchFeed(%s): %v", path, err)
+	}
+	return es
+}
+
+func TestFetchFeedRSS(t *testing.T) {
+	srv := feedServer()
+	defer srv.Close()
+
+	before := time.Now()
+	es := fetchFixture(t, srv, "/rss")
+	if len(es) != 4 {
+		t.Fatalf("got %d entries, want 4", len(es))
+	}
+
+	e := es[0]
+	if e.GUID != "https://nycbug.example/2017/meeting" {
+		t.Errorf("GUID = %q", e.GUID)
+	}
+	if e.Title != "Monthly meeting" {
+		t.Errorf("Title = %q, want it trimmed", e.Title)
+	}
+	if e.Link != "https://nycbug.example/2017/meeting.html" {
+		t.Errorf("Link = %q", e.Link)
+	}
+	if c := string(e.Content); strings.Contains(c, "script") || !strings.Contains(c, "<p>Talk on pf</p>") {
+		t.Errorf("Content = %q, want the script removed and the paragraph kept", c)
+	}
+	if want := time.Date(2017, 3, 1, 19, 0, 0, 0, time.UTC); !e.Published.Equal(want) {
+		t.Errorf("Published = %v, want %v", e.Published, want)
+	}
+
+	if es[1].GUID != "https://nycbug.example/2017/no-guid.html" {
+		t.Errorf("GUID without guid = %q, want the link", es[1].GUID)
+	}
+
+	e = es[2]
+	if e.GUID == "" || e.GUID == e.Link {
+		t.Errorf("GUID without guid and link = %q, want a hash", e.GUID)
+	}
+	again := fetchFixture(t, srv, "/rss")
+	if again[2].GUID != e.GUID {
+		t.Errorf("hashed GUID changed between fetches: %q and %q", e.GUID, again[2].GUID)
+	}
+	if e.Title != "Untitled" {
+		t.Errorf("Title = %q, want Untitled", e.Title)
+	}
+	if e.Published.Before(before) || e.Published.After(time.Now()) {
+		t.Errorf("Published = %v, want a date in the future to become now", e.Published)
+	}
+
+	if es[3].Link != "" {
+		t.Errorf("Link = %q, want links that are not http dropped", es[3].Link)
+	}
+}
+
+func TestFetchFeedAtom(t *testing.T) {
+	srv := feedServer()
+	defer srv.Close()
+
+	before := time.Now()
+	es := fetchFixture(t, srv, "/atom")
+	if len(es) != 2 {
+		t.Fatalf("got %d entries, want 2", len(es))
+	}
+
+	e := es[0]
+	if e.GUID != "urn:uuid:entry-1" || e.Author != "Beastie" || e.Link != "https://bug.example/installfest" {
+		t.Errorf("got GUID %q, Author %q, Link %q", e.GUID, e.Author, e.Link)
+	}
+	if c := string(e.Content); strings.Contains(c, "script") || !strings.Contains(c, "<b>Bring</b> a laptop") {
+		t.Errorf("Content = %q, want the script removed", c)
+	}
+	if want := time.Date(2017, 3, 3, 10, 0, 0, 0, time.UTC); !e.Published.Equal(want) {
+		t.Errorf("Published = %v, want the updated date %v", e.Published, want)
+	}
+
+	if p := es[1].Published; p.Before(before) || p.After(time.Now()) {
+		t.Errorf("Published = %v, want a date in the future to become now", p)
+	}
+}
+
+func TestFetchFeedErrors(t *testing.T) {
+	srv := feedServer()
+	defer srv.Close()
+
+	for _, path := range []string{"/status/404", "/status/500", "/status/304", "/status/202"} {
+		if es, err := FetchFeed(context.Background(), srv.Client(), srv.URL+path); err == nil {
+			t.Errorf("FetchFeed(%s) = %d entries, want an error", path, len(es))
+		}
+	}
+
+	_, err := FetchFeed(context.Background(), srv.Client(), srv.URL+"/garbage")
+	if KindOf(err) != Invalid {
+		t.Errorf("FetchFeed(/garbage) = %v, want an Invalid error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package dnews
+
+// Permissions checked by the site. Which role grants which permission is
+// kept in the permissions table.
+const (
+	PermComment          = "comment"
+	PermWriteArticles    = "articles:write"
+	PermEditArticles     = "articles:edit"
+	PermManageTags       = "tags:manage"
+	PermManageBugs       = "bugs:manage"
+	PermManageEvents     = "events:manage"
+	PermAdminPage        = "admin:view"
+	PermManageUsers      = "users:manage"
+	PermDeleteUsers      = "users:delete"
+	PermManageWebhooks   = "webhooks:manage"
+	PermModerateMentions = "mentions:moderate"
+)
+
+// DefaultRole is given to accounts that did not get another one
+const DefaultRole = "reader"
+
+// Role is a named set of permissions a user can be given
+type Role struct {
+	Name  string
+	Descr string
+	Perms []string
+}
+
+// Roles is a collection of Role
+type Roles []*Role
+
+// Can reports whether u was granted perm through their role
+func (u *User) Can(perm string) bool {
+	for _, p := range u.Perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package dnews
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Session is a login kept in the database. The cookie only carries a random
+// key, ID is its hash so sessions can be listed and ended without the key
+// leaking from the database or the admin pages.
+type Session struct {
+	ID      string
+	UserID  int
+	Data    []byte
+	Created time.Time
+	Seen    time.Time
+	Expires time.Time
+	IP      string
+	Agent   string
+}
+
+// Sessions is a collection of Session
+type Sessions []*Session
+
+// NewSessionKey returns a random key for a new session cookie
+func NewSessionKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// SessionID is the ID stored for the session with the given cookie key
+func SessionID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,76 @@
+package dnews
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// RecoveryCodes is how many single use recovery codes a user gets when
+// enabling two-factor authentication
+const RecoveryCodes = 10
+
+// totpPeriod is the RFC 6238 time step
+const totpPeriod = 30
+
+// NewTOTPKey generates a TOTP secret for the account name of u
+func NewTOTPKey(u *User) (*otp.Key, error) {
+	return totp.Generate(totp.GenerateOpts{
+		Issuer:      "Daemon.News",
+		AccountName: u.User,
+		Period:      totpPeriod,
+	})
+}
+
+// ValidTOTP reports whether code is right for secret at t, allowing one
+// step of clock skew either way. Steps at or before last were already used
+// and are refused so a code can not be replayed. The matching step is
+// returned to be stored as the new last.
+func ValidTOTP(secret, code string, t time.Time, last int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	now := t.Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		if step <= last {
+			continue
+		}
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && want == code {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns fresh recovery codes for the user to write down
+// and the hashes to store
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < RecoveryCodes; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, hashRecoveryCode(c))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes and hashes a recovery code. The codes are
+// random enough that a plain hash is sufficient.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,105 @@
+package dnews
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed "12345678901234567890" of RFC 6238
+// appendix B in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidTOTPVectors(t *testing.T) {
+	// The eight digit codes of RFC 6238 appendix B cut to the six we use
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		step, ok := ValidTOTP(rfc6238Secret, tc.code, time.Unix(tc.unix, 0), 0)
+		if !ok {
+			t.Errorf("%d: %s was refused", tc.unix, tc.code)
+			continue
+		}
+		if step != tc.unix/totpPeriod {
+			t.Errorf("%d: got step %d, want %d", tc.unix, step, tc.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidTOTPSkew(t *testing.T) {
+	// 287082 is the code of step 1, 30s to 59s
+	for _, tc := range []struct {
+		unix int64
+		ok   bool
+	}{
+		{0, true},   // a step early
+		{29, true},  // a step early
+		{30, true},  // on time
+		{89, true},  // a step late
+		{90, false}, // two steps late
+	} {
+		step, ok := ValidTOTP(rfc6238Secret, " 287082 ", time.Unix(tc.unix, 0), 0)
+		if ok != tc.ok {
+			t.Errorf("at %d: got %v, want %v", tc.unix, ok, tc.ok)
+		}
+		if ok && step != 1 {
+			t.Errorf("at %d: got step %d, want 1", tc.unix, step)
+		}
+	}
+}
+
+func TestValidTOTPReplay(t *testing.T) {
+	now := time.Unix(59, 0)
+	step, ok := ValidTOTP(rfc6238Secret, "287082", now, 0)
+	if !ok {
+		t.Fatal("first use was refused")
+	}
+	if _, ok := ValidTOTP(rfc6238Secret, "287082", now, step); ok {
+		t.Error("the same code was accepted twice")
+	}
+	if _, ok := ValidTOTP(rfc6238Secret, "287082", now.Add(totpPeriod*time.Second), step); ok {
+		t.Error("the code was accepted again a step later")
+	}
+	if _, ok := ValidTOTP(rfc6238Secret, "000000", now, 0); ok {
+		t.Error("a wrong code was accepted")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodes || len(hashes) != RecoveryCodes {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), RecoveryCodes)
+	}
+
+	seen := map[string]bool{}
+	for i, c := range codes {
+		if len(c) != 9 || c[4] != '-' {
+			t.Errorf("code %q is not of the form xxxx-xxxx", c)
+		}
+		if seen[c] {
+			t.Errorf("code %q handed out twice", c)
+		}
+		seen[c] = true
+
+		if hashes[i] != hashRecoveryCode(c) {
+			t.Errorf("hash of %q does not match", c)
+		}
+		// Users may type them in upper case, without the dash or with
+		// spaces around.
+		typed := " " + strings.ToUpper(strings.Replace(c, "-", "", 1)) + " "
+		if hashRecoveryCode(typed) != hashes[i] {
+			t.Errorf("%q does not match %q", typed, c)
+		}
+	}
+}
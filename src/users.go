@@ -2,24 +2,35 @@ package dnews
 
 import (
 	"fmt"
+	"net/mail"
 	"regexp"
+	"strings"
 	"time"
 )
 
 // User represents an author of an article
 type User struct {
-	ID      int
-	Created time.Time
-	LName   string
-	FName   string
-	Email   string
-	Pubkey  []byte
-	User    string
-	Pass    string
-	Hash    string
-	Authed  bool
-	Admin   bool
-	Token   string
+	ID       int
+	Created  time.Time
+	LName    string
+	FName    string
+	Email    string
+	Pubkey   []byte
+	User     string
+	Pass     string
+	Hash     string
+	Authed   bool
+	Disabled bool
+	Verified bool
+	TOTP     bool
+	// Role names the permissions of the user, Perms lists them, see Can
+	Role  string
+	Perms []string
+	// PassChanged is when the password was last set. Sessions started
+	// before then are no longer valid.
+	PassChanged  time.Time
+	FailedLogins int
+	LockedUntil  time.Time
 }
 
 var userLineRE = regexp.MustCompile(`^(.*)\s(.*)\s<(.*)>$`)
@@ -36,5 +47,19 @@ func (u *User) Combine() string {
 	return fmt.Sprintf("%s %s <%s>", u.FName, u.LName, u.Email)
 }
 
+// Validate checks that the required fields of u are filled in
+func (u *User) Validate() error {
+	switch {
+	case strings.TrimSpace(u.User) == "":
+		return NewError(Invalid, nil, "A user name is required")
+	case strings.TrimSpace(u.FName) == "" || strings.TrimSpace(u.LName) == "":
+		return NewError(Invalid, nil, "First and last name are required")
+	}
+	if a, err := mail.ParseAddress(u.Email); err != nil || a.Address != u.Email {
+		return NewError(Invalid, err, "%q is not a valid email address", u.Email)
+	}
+	return nil
+}
+
 // Users are a collection of User
 type Users []*User
@@ -1,9 +1,7 @@
 package dnews
 
 import (
-	"fmt"
 	"io/ioutil"
-	"os"
 	"time"
 )
 
@@ -11,8 +9,7 @@ import (
 func LoadFileOrDie(s string) []byte {
 	data, err := ioutil.ReadFile(s)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		Log.Fatal(err)
 	}
 	return data
 }
@@ -0,0 +1,143 @@
+package dnews
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Events webhooks can be registered for
+const (
+	EventArticlePublished = "article.published"
+	EventArticleUpdated   = "article.updated"
+	EventCommentCreated   = "comment.created"
+)
+
+// WebhookEvents lists every event in the order they are shown
+var WebhookEvents = []string{EventArticlePublished, EventArticleUpdated, EventCommentCreated}
+
+// Retry policy of webhook deliveries: a failed delivery is tried again
+// after WebhookRetryBase, doubling every time up to WebhookRetryMax, until
+// it was tried WebhookMaxAttempts times.
+const (
+	WebhookMaxAttempts = 10
+	WebhookRetryBase   = 30 * time.Second
+	WebhookRetryMax    = 6 * time.Hour
+)
+
+// Webhook is a URL that is sent the events it asked for
+type Webhook struct {
+	ID      int
+	Created time.Time
+	URL     string
+	Descr   string
+	// Secret signs the deliveries, see SignWebhook
+	Secret string
+	Events []string
+	Active bool
+}
+
+// Webhooks is a collection of Webhook
+type Webhooks []*Webhook
+
+// WebhookDelivery is one event queued for one webhook
+type WebhookDelivery struct {
+	ID          int
+	WebhookID   int
+	URL         string
+	Secret      string
+	Event       string
+	Payload     []byte
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+	// Delivered is zero until the webhook accepted the event
+	Delivered  time.Time
+	Failed     bool
+	LastStatus int
+	LastError  string
+}
+
+// WebhookDeliveries is a collection of WebhookDelivery
+type WebhookDeliveries []*WebhookDelivery
+
+// WebhookPayload is the body of every delivery
+type WebhookPayload struct {
+	Event   string      `json:"event"`
+	Created time.Time   `json:"created"`
+	URL     string      `json:"url,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+// Validate checks the URL and events of w
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return NewError(Invalid, err, "%q is not an http:// or https:// URL", w.URL)
+	}
+	if len(w.Events) == 0 {
+		return NewError(Invalid, nil, "A webhook needs at least one event")
+	}
+	for _, e := range w.Events {
+		known := false
+		for _, k := range WebhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return NewError(Invalid, nil, "%q is not an event, use one of %s", e, strings.Join(WebhookEvents, ", "))
+		}
+	}
+	return nil
+}
+
+// Wants reports whether w was registered for event
+func (w *Webhook) Wants(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// newWebhookSecret returns a random secret for signing deliveries
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SignWebhook returns the X-Dnews-Signature header of a delivery of body
+// at time t: "t=UNIX,sha256=HEX" where HEX is the HMAC-SHA256 of
+// "UNIX.body" keyed with secret. Receivers should recompute it and reject
+// old timestamps.
+func SignWebhook(secret string, t time.Time, body []byte) string {
+	ts := fmt.Sprint(t.Unix())
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(ts + "."))
+	m.Write(body)
+	return fmt.Sprintf("t=%s,sha256=%s", ts, hex.EncodeToString(m.Sum(nil)))
+}
+
+// WebhookRetry returns when a delivery that failed its attempts-th try is
+// tried next, or the zero time when it is given up
+func WebhookRetry(attempts int, now time.Time) time.Time {
+	if attempts >= WebhookMaxAttempts {
+		return time.Time{}
+	}
+	d := WebhookRetryBase
+	for i := 1; i < attempts && d < WebhookRetryMax; i++ {
+		d *= 2
+	}
+	if d > WebhookRetryMax {
+		d = WebhookRetryMax
+	}
+	return now.Add(d)
+}
@@ -0,0 +1,58 @@
+package dnews
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// printf '1500000000.{"event":"ping"}' | openssl dgst -sha256 -hmac whsec
+	const want = "t=1500000000,sha256=dcd35804149b0f44d99a4d5081437f0f58e2f976e9f3af3e57d1fe134c4c4f42"
+	at := time.Unix(1500000000, 0)
+	body := []byte(`{"event":"ping"}`)
+	if got := SignWebhook("whsec", at, body); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// The timestamp is signed too, a replayed body with a new time fails.
+	mac := func(sig string) string { return sig[strings.Index(sig, ",")+1:] }
+	if mac(SignWebhook("whsec", at.Add(time.Second), body)) == mac(want) {
+		t.Error("the signature does not cover the timestamp")
+	}
+	if SignWebhook("other", at, body) == want {
+		t.Error("the signature does not depend on the secret")
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		attempts int
+		wait     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{9, 128 * time.Minute},
+		{WebhookMaxAttempts, 0},
+		{WebhookMaxAttempts + 1, 0},
+	} {
+		got := WebhookRetry(tc.attempts, now)
+		if tc.wait == 0 {
+			if !got.IsZero() {
+				t.Errorf("after %d attempts: retried at %v, want given up", tc.attempts, got)
+			}
+			continue
+		}
+		if got.Sub(now) != tc.wait {
+			t.Errorf("after %d attempts: retried after %v, want %v", tc.attempts, got.Sub(now), tc.wait)
+		}
+	}
+
+	for i := 1; i < WebhookMaxAttempts; i++ {
+		if d := WebhookRetry(i, now).Sub(now); d <= 0 || d > WebhookRetryMax {
+			t.Errorf("after %d attempts: retried after %v, more than the cap of %v", i, d, WebhookRetryMax)
+		}
+	}
+}
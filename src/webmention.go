@@ -0,0 +1,174 @@
+package dnews
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Moderation states of a Webmention. Only approved mentions are shown
+// under articles.
+const (
+	MentionPending  = "pending"
+	MentionApproved = "approved"
+	MentionRejected = "rejected"
+)
+
+// Webmention is a page that links to an article. It is only kept once the
+// link was found on the source.
+type Webmention struct {
+	ID           int
+	ArticleID    int
+	ArticleSlug  string
+	ArticleTitle string
+	Source       string
+	Target       string
+	// Title is the title of the source page, empty when it has none
+	Title    string
+	Status   string
+	Created  time.Time
+	Verified time.Time
+}
+
+// Webmentions is a collection of Webmention
+type Webmentions []*Webmention
+
+// WebmentionFilter narrows down the results of GetWebmentions. Zero values
+// match everything.
+type WebmentionFilter struct {
+	ArticleID int
+	Status    string
+}
+
+// Page is what the Webmention code needs to know of an HTML page
+type Page struct {
+	Title string
+	// Links are the absolute targets of the a and link elements
+	Links []string
+	// Endpoint is the first Webmention endpoint the page names
+	Endpoint string
+}
+
+// hasRel reports whether the rel attribute value rels contains rel
+func hasRel(rels, rel string) bool {
+	for _, r := range strings.Fields(strings.ToLower(rels)) {
+		if r == rel {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePage reads the HTML page r, served from base
+func ParsePage(r io.Reader, base *url.URL) (*Page, error) {
+	var p Page
+	var inTitle bool
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				p.Title = strings.Join(strings.Fields(p.Title), " ")
+				return &p, nil
+			}
+			return nil, z.Err()
+		case html.TextToken:
+			if inTitle {
+				p.Title += string(z.Text())
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) == "title" {
+				inTitle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, more := z.TagName()
+			tag := string(name)
+			if tag == "title" && p.Title == "" {
+				inTitle = true
+			}
+			if tag != "a" && tag != "link" {
+				continue
+			}
+
+			var href, rel string
+			hasHref := false
+			for more {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				switch string(k) {
+				case "href":
+					href, hasHref = string(v), true
+				case "rel":
+					rel = string(v)
+				}
+			}
+			if !hasHref {
+				continue
+			}
+			u, err := base.Parse(strings.TrimSpace(href))
+			if err != nil {
+				continue
+			}
+			u.Fragment = ""
+			p.Links = append(p.Links, u.String())
+			if p.Endpoint == "" && hasRel(rel, "webmention") {
+				p.Endpoint = u.String()
+			}
+		}
+	}
+}
+
+// LinkEndpoint returns the Webmention endpoint named in the Link headers
+// of h, resolved against base, or "" when there is none
+func LinkEndpoint(h http.Header, base *url.URL) string {
+	for _, v := range h["Link"] {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || strings.ToLower(kv[0]) != "rel" || !hasRel(strings.Trim(kv[1], `"`), "webmention") {
+					continue
+				}
+				if u, err := base.Parse(target[1 : len(target)-1]); err == nil {
+					return u.String()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Mentions reports whether p links to target
+func (p *Page) Mentions(target string) bool {
+	for _, l := range p.Links {
+		if l == target {
+			return true
+		}
+	}
+	return false
+}
+
+// OutboundLinks returns the http and https links of p that leave host,
+// each once
+func (p *Page) OutboundLinks(host string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, l := range p.Links {
+		u, err := url.Parse(l)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || strings.EqualFold(u.Host, host) || seen[l] {
+			continue
+		}
+		seen[l] = true
+		out = append(out, l)
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+package dnews
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestParsePage(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html><head>
+<title>
+  Running   OpenBSD
+  on a toaster
+</title>
+<link rel="stylesheet" href="/style.css">
+<link rel="WebMention" href="/mention">
+</head><body>
+<h1><title>not the title</title></h1>
+<a href="https://daemon.news/article/toaster#comments">an article</a>
+<a href=" ../about ">about</a>
+<a name="anchor">no href</a>
+<a rel="nofollow webmention" href="https://other.example/wm">a second endpoint</a>
+<img src="https://img.example/a.png">
+</body></html>`
+
+	p, err := ParsePage(strings.NewReader(page), mustURL(t, "https://blog.example/posts/toaster"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Running OpenBSD on a toaster" {
+		t.Errorf("title is %q", p.Title)
+	}
+	if p.Endpoint != "https://blog.example/mention" {
+		t.Errorf("endpoint is %q", p.Endpoint)
+	}
+	want := []string{
+		"https://blog.example/style.css",
+		"https://blog.example/mention",
+		"https://daemon.news/article/toaster",
+		"https://blog.example/about",
+		"https://other.example/wm",
+	}
+	if !reflect.DeepEqual(p.Links, want) {
+		t.Errorf("links are\n%q, want\n%q", p.Links, want)
+	}
+}
+
+func TestParsePageEmpty(t *testing.T) {
+	p, err := ParsePage(strings.NewReader(""), mustURL(t, "https://blog.example/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "" || len(p.Links) != 0 || p.Endpoint != "" {
+		t.Errorf("got %+v", p)
+	}
+}
+
+func TestLinkEndpoint(t *testing.T) {
+	base := mustURL(t, "https://blog.example/posts/toaster")
+	for _, tc := range []struct {
+		links []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{`<https://blog.example/wm>; rel="webmention"`}, "https://blog.example/wm"},
+		{[]string{`</wm>; rel=webmention`}, "https://blog.example/wm"},
+		{[]string{`<wm?x=1>; rel="webmention"`}, "https://blog.example/posts/wm?x=1"},
+		{[]string{`</hub>; rel="hub", </wm>; rel="webmention"`}, "https://blog.example/wm"},
+		{[]string{`</hub>; rel="hub"`, `</wm>; REL="other WebMention"`}, "https://blog.example/wm"},
+		{[]string{`</first>; rel="webmention", </second>; rel="webmention"`}, "https://blog.example/first"},
+		{[]string{`</wm>; rel="webmentions"`}, ""},
+		{[]string{`https://blog.example/wm; rel="webmention"`}, ""},
+	} {
+		h := http.Header{"Link": tc.links}
+		if got := LinkEndpoint(h, base); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.links, got, tc.want)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	p := &Page{Links: []string{"https://daemon.news/article/toaster", "https://daemon.news/"}}
+	for target, want := range map[string]bool{
+		"https://daemon.news/article/toaster":  true,
+		"https://daemon.news/article/toast":    false,
+		"https://daemon.news/article/toaster/": false,
+		"http://daemon.news/article/toaster":   false,
+		"":                                     false,
+	} {
+		if got := p.Mentions(target); got != want {
+			t.Errorf("Mentions(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestOutboundLinks(t *testing.T) {
+	p := &Page{Links: []string{
+		"https://daemon.news/tag/openbsd",
+		"https://DAEMON.NEWS/about",
+		"https://www.openbsd.org/",
+		"http://man.openbsd.org/pf.conf",
+		"https://www.openbsd.org/",
+		"mailto:editors@daemon.news",
+		"ftp://ftp.openbsd.org/pub",
+	}}
+	want := []string{"https://www.openbsd.org/", "http://man.openbsd.org/pf.conf"}
+	if got := p.OutboundLinks("daemon.news"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package dnews
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Leases of WebSub subscriptions. Subscribers renew by subscribing again
+// before their lease runs out.
+const (
+	WebSubLease    = 10 * 24 * time.Hour
+	WebSubMinLease = time.Hour
+	WebSubMaxLease = 30 * 24 * time.Hour
+)
+
+// WebSubSubscription is a callback that is sent a topic when it changes
+type WebSubSubscription struct {
+	ID       int
+	Topic    string
+	Callback string
+	// Secret signs the content sent, it is empty when the subscriber did
+	// not give one
+	Secret  string
+	Created time.Time
+	Expires time.Time
+}
+
+// WebSubSubscriptions is a collection of WebSubSubscription
+type WebSubSubscriptions []*WebSubSubscription
+
+// WebSubLeaseFor returns the lease granted for the requested number of
+// seconds, 0 asks for the default
+func WebSubLeaseFor(seconds int) time.Duration {
+	// Seconds are compared before they become a Duration, which a large
+	// request would overflow.
+	switch {
+	case seconds <= 0:
+		return WebSubLease
+	case seconds < int(WebSubMinLease/time.Second):
+		return WebSubMinLease
+	case seconds > int(WebSubMaxLease/time.Second):
+		return WebSubMaxLease
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SignWebSub returns the X-Hub-Signature header of body sent to a
+// subscriber with secret
+func SignWebSub(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
@@ -0,0 +1,29 @@
+package dnews
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWebSubLeaseFor(t *testing.T) {
+	for _, tc := range []struct {
+		seconds int
+		lease   time.Duration
+	}{
+		{-1, WebSubLease},
+		{0, WebSubLease},
+		{1, WebSubMinLease},
+		{3599, WebSubMinLease},
+		{3600, time.Hour},
+		{86400, 24 * time.Hour},
+		{int(WebSubMaxLease.Seconds()), WebSubMaxLease},
+		{int(WebSubMaxLease.Seconds()) + 1, WebSubMaxLease},
+		{math.MaxInt32, WebSubMaxLease},
+		{int(^uint(0) >> 1), WebSubMaxLease},
+	} {
+		if got := WebSubLeaseFor(tc.seconds); got != tc.lease {
+			t.Errorf("WebSubLeaseFor(%d) = %v, want %v", tc.seconds, got, tc.lease)
+		}
+	}
+}
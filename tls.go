@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader holds the current TLS certificate and swaps it out when the
+// files on disk change or the process receives SIGHUP.
+type certReloader struct {
+	sync.RWMutex
+	certPath string
+	keyPath  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the certificate and key from disk. The old certificate is
+// kept if the new pair fails to load.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	mod, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.cert = &cert
+	c.modTime = mod
+	c.Unlock()
+
+	return nil
+}
+
+// lastModified returns the newest modification time of the cert and key
+func (c *certReloader) lastModified() (time.Time, error) {
+	var mod time.Time
+	for _, p := range []string{c.certPath, c.keyPath} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return mod, err
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate on SIGHUP, and whenever the files on disk
+// are newer than the loaded pair. It never returns.
+func (c *certReloader) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-tick.C:
+			mod, err := c.lastModified()
+			if err != nil {
+				logger.WithError(err).Error("tls: checking certificate")
+				continue
+			}
+			c.RLock()
+			changed := mod.After(c.modTime)
+			c.RUnlock()
+			if !changed {
+				continue
+			}
+		}
+
+		if err := c.reload(); err != nil {
+			logger.WithError(err).Error("tls: keeping old certificate")
+			continue
+		}
+		logger.WithField("cert", c.certPath).Info("tls: reloaded certificate")
+	}
+}
+
+// hstsHandler sets the Strict-Transport-Security header on every response
+func hstsHandler(maxAge time.Duration, h http.Handler) http.Handler {
+	v := fmt.Sprintf("max-age=%d; includeSubDomains", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", v)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// redirectHandler sends plain HTTP requests to the same URL on the TLS
+// listener at addr
+func redirectHandler(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Purposes of the tokens mailed to users
+const (
+	tokenVerify = "verify-email"
+)
+
+// defaultJWTSecret is the default of -jwt. It is public, so setup refuses
+// to run with it outside of insecure mode.
+const defaultJWTSecret = "super secret neat"
+
+// tokenKey derives the signing key for purpose from -jwt, so a token made
+// for one purpose is never accepted for another or by the API.
+func tokenKey(purpose string) []byte {
+	m := hmac.New(sha256.New, []byte(jwtSecret))
+	m.Write([]byte(purpose))
+	return m.Sum(nil)
+}
+
+// signToken returns a token for purpose naming user id that expires after
+// ttl
+func signToken(purpose string, id int, ttl time.Duration) (string, error) {
+	claims := jwt.StandardClaims{
+		Subject:   strconv.Itoa(id),
+		Audience:  purpose,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(tokenKey(purpose))
+}
+
+// verifyToken checks a token made by signToken and returns the user id it
+// names
+func verifyToken(purpose, token string) (int, error) {
+	claims := &jwt.StandardClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return tokenKey(purpose), nil
+	})
+	if err == nil && !claims.VerifyAudience(purpose, true) {
+		err = fmt.Errorf("token is for %q", claims.Audience)
+	}
+	if err != nil {
+		return 0, dnews.NewError(dnews.Invalid, err, "This link is invalid or has expired")
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, dnews.NewError(dnews.Invalid, err, "This link is invalid or has expired")
+	}
+	return id, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestTokenRoundTrip(t *testing.T) {
+	token, err := signToken(tokenVerify, 42, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := verifyToken(tokenVerify, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 42 {
+		t.Errorf("got user %d, want 42", id)
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	claims := func(purpose string, expires time.Time) jwt.StandardClaims {
+		return jwt.StandardClaims{Subject: "42", Audience: purpose, ExpiresAt: expires.Unix()}
+	}
+	hs256 := func(c jwt.StandardClaims, key []byte) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	later := time.Now().Add(time.Hour)
+
+	other, err := signToken("reset-password", 42, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := signToken(tokenVerify, 42, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims(tokenVerify, later)).SignedString(newTestKey(t).private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims(tokenVerify, later)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{
+		"other purpose": other,
+		"expired":       expired,
+		"alg none":      unsigned,
+		"alg RS256":     rs256,
+		// Signed with the key of another purpose but claiming this one
+		"wrong key": hs256(claims(tokenVerify, later), tokenKey("reset-password")),
+		// The API signs with -jwt itself
+		"raw secret":  hs256(claims(tokenVerify, later), []byte(jwtSecret)),
+		"no audience": hs256(claims("", later), tokenKey(tokenVerify)),
+		"bad subject": hs256(jwt.StandardClaims{Subject: "x", Audience: tokenVerify, ExpiresAt: later.Unix()}, tokenKey(tokenVerify)),
+		"garbage":     "not.a.token",
+	} {
+		id, err := verifyToken(tokenVerify, token)
+		if err == nil {
+			t.Errorf("%s: accepted for user %s", name, strconv.Itoa(id))
+			continue
+		}
+		if dnews.KindOf(err) != dnews.Invalid {
+			t.Errorf("%s: failed with kind %v", name, dnews.KindOf(err))
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/pquerna/otp"
+)
+
+// secondFactorTTL is how long a user has to enter their code after the
+// password was accepted
+const secondFactorTTL = 5 * time.Minute
+
+// secondFactorTries is how many wrong codes end a pending login
+const secondFactorTries = 5
+
+// pendingLogin is kept in the session between the password and the code
+type pendingLogin struct {
+	User    *dnews.User
+	Expires time.Time
+	Tries   int
+}
+
+// twoFactorPage is the data for twofactor.html
+type twoFactorPage struct {
+	Enabled  bool
+	Required bool
+	QR       template.URL
+	Secret   string
+	Codes    []string
+}
+
+func init() {
+	gob.Register(&pendingLogin{})
+}
+
+// startSecondFactor parks u in the session until they enter a code and
+// sends them to the second login step
+func startSecondFactor(w http.ResponseWriter, r *http.Request, session *sessions.Session, u *dnews.User) {
+	delete(session.Values, "user")
+	session.Values["pending"] = &pendingLogin{User: u, Expires: time.Now().Add(secondFactorTTL)}
+	if err := session.Save(r, w); err != nil {
+		errorPage(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+}
+
+// pendingFrom returns the pending login in session, or nil if there is none
+// or it expired
+func pendingFrom(session *sessions.Session) *pendingLogin {
+	p, ok := session.Values["pending"].(*pendingLogin)
+	if !ok || time.Now().After(p.Expires) {
+		return nil
+	}
+	return p
+}
+
+// needsTwoFactor reports whether u has to set up two-factor authentication
+// before using admin pages
+func needsTwoFactor(u *dnews.User) bool {
+	return require2FA && u.Can(dnews.PermAdminPage) && !u.TOTP
+}
+
+// qrImage renders key as a PNG data URI for an img tag
+func qrImage(key *otp.Key) (template.URL, error) {
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func registerTwoFactor(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		if pendingFrom(session) == nil {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		renderTemplate(w, r, data, "login_2fa.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		p := pendingFrom(session)
+		if p == nil {
+			errorPage(w, r, dnews.NewError(dnews.Forbidden, nil, "Your login expired, please log in again"))
+			return
+		}
+
+		ip := clientIP(r)
+		name := strings.ToLower(p.User.User)
+		if loginIPs.Wait(ip) > 0 || loginNames.Wait(name) > 0 {
+			loginAttempts.WithLabelValues("locked").Inc()
+			errorPage(w, r, dnews.ErrLockedOut)
+			return
+		}
+
+		ok, err := dnews.CheckTOTPContext(ctx, db, p.User.ID, r.FormValue("code"))
+		if err != nil {
+			if dnews.KindOf(err) == dnews.Limited {
+				loginAttempts.WithLabelValues("locked").Inc()
+			}
+			errorPage(w, r, err)
+			return
+		}
+		l := reqLog(r).WithField("user_id", p.User.ID)
+		if !ok {
+			loginAttempts.WithLabelValues("failed").Inc()
+			loginIPs.Fail(ip)
+			loginNames.Fail(name)
+			p.Tries++
+			if p.Tries >= secondFactorTries {
+				delete(session.Values, "pending")
+				session.Save(r, w)
+				l.Warn("too many wrong two-factor codes")
+				errorPage(w, r, dnews.NewError(dnews.Forbidden, nil, "Too many wrong codes, please log in again"))
+				return
+			}
+			session.Save(r, w)
+			l.Info("wrong two-factor code")
+			errorPage(w, r, dnews.NewError(dnews.Forbidden, nil, "That code is not right"))
+			return
+		}
+
+		if err := store.Renew(r, session); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		delete(session.Values, "pending")
+		session.Values["user"] = p.User
+		if err := session.Save(r, w); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		loginAttempts.WithLabelValues("ok").Inc()
+		loginNames.Reset(name)
+		l.Info("logged in with two-factor code")
+		http.Redirect(w, r, "/", http.StatusFound)
+	}).Methods("POST")
+
+	router.HandleFunc("/2fa", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		page := twoFactorPage{Enabled: u.TOTP, Required: needsTwoFactor(u)}
+		if !u.TOTP {
+			// Keep offering the same secret until it is confirmed, so
+			// reloading the page does not invalidate a scanned code.
+			var key *otp.Key
+			if s, ok := session.Values["totp"].(string); ok {
+				key, err = otp.NewKeyFromURL(s)
+			} else {
+				key, err = dnews.NewTOTPKey(u)
+			}
+			if err != nil {
+				errorPage(w, r, err)
+				return
+			}
+			session.Values["totp"] = key.String()
+			session.Save(r, w)
+
+			page.Secret = key.Secret()
+			page.QR, err = qrImage(key)
+			if err != nil {
+				errorPage(w, r, err)
+				return
+			}
+		}
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = page
+		renderTemplate(w, r, data, "twofactor.html")
+	}).Methods("GET")
+
+	router.HandleFunc("/2fa/enable", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		s, _ := session.Values["totp"].(string)
+		key, err := otp.NewKeyFromURL(s)
+		if err != nil {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, err, "Please scan the code again"))
+			return
+		}
+		step, ok := dnews.ValidTOTP(key.Secret(), r.FormValue("code"), time.Now(), 0)
+		if !ok {
+			errorPage(w, r, dnews.NewError(dnews.Invalid, nil, "That code is not right, check the clock of your device"))
+			return
+		}
+
+		codes, err := dnews.EnableTOTPContext(ctx, db, u.ID, key.Secret(), step)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		delete(session.Values, "totp")
+		u.TOTP = true
+		session.Values["user"] = u
+		session.Save(r, w)
+		reqLog(r).WithField("user_id", u.ID).Info("two-factor authentication enabled")
+
+		data, err := grabUser(w, r)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		data.Data = twoFactorPage{Enabled: true, Codes: codes}
+		renderTemplate(w, r, data, "twofactor.html")
+	}).Methods("POST")
+
+	router.HandleFunc("/2fa/disable", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		if require2FA && u.Can(dnews.PermAdminPage) {
+			errorPage(w, r, dnews.NewError(dnews.Forbidden, nil, "Editors and administrators have to keep two-factor authentication on"))
+			return
+		}
+		current, err := dnews.AuthContext(ctx, db, u.User, r.FormValue("passwd"))
+		if err != nil || !current.Authed {
+			errorPage(w, r, dnews.NewError(dnews.Forbidden, err, "Your password is not right"))
+			return
+		}
+
+		if err := dnews.DisableTOTPContext(ctx, db, u.ID); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		session, err := store.Get(r, "session-name")
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+		u.TOTP = false
+		session.Values["user"] = u
+		session.Save(r, w)
+		reqLog(r).WithField("user_id", u.ID).Info("two-factor authentication disabled")
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+	}).Methods("POST")
+}
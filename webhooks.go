@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "dnews",
+	Name:      "webhook_deliveries_total",
+	Help:      "Webhook delivery attempts by result: ok, retry or failed.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(webhookDeliveries)
+}
+
+// Webhook deliveries are claimed in batches of webhookBatch and not handed
+// to another server for webhookLease. Finished ones are kept in the log
+// for webhookKeep.
+const (
+	webhookBatch   = 20
+	webhookLease   = time.Minute
+	webhookTimeout = 10 * time.Second
+	webhookKeep    = 30 * 24 * time.Hour
+)
+
+// queueWebhook queues event for every webhook registered for it. Failing
+// to queue is logged, it does not fail the request that caused the event.
+func queueWebhook(r *http.Request, db *sql.DB, event, link string, data interface{}) {
+	l := reqLog(r).WithField("event", event)
+	payload, err := json.Marshal(dnews.WebhookPayload{
+		Event:   event,
+		Created: time.Now(),
+		URL:     link,
+		Data:    data,
+	})
+	if err != nil {
+		l.WithError(err).Error("encoding webhook payload")
+		return
+	}
+
+	ctx, cancel := dbContext(r)
+	defer cancel()
+	n, err := dnews.QueueWebhookEventContext(ctx, db, event, payload)
+	if err != nil {
+		l.WithError(err).Error("queueing webhook event")
+		return
+	}
+	if n > 0 {
+		l.WithField("webhooks", n).Info("webhook event queued")
+	}
+}
+
+// articleURL is the public link of a
+func articleURL(a *dnews.Article) string {
+	return siteURL("/article/"+a.Slug, nil)
+}
+
+// runWebhooks sends due deliveries every interval until ctx is done
+func runWebhooks(ctx context.Context, db *sql.DB, interval time.Duration) {
+	client := &http.Client{
+		Timeout: webhookTimeout,
+		// A redirect could send the signed payload elsewhere.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		sendWebhooks(ctx, db, client)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-prune.C:
+			dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+			n, err := dnews.PruneWebhookDeliveriesContext(dctx, db, webhookKeep)
+			cancel()
+			if err != nil {
+				logger.WithError(err).Error("webhooks: pruning deliveries")
+			} else if n > 0 {
+				logger.WithField("deliveries", n).Info("webhooks: pruned deliveries")
+			}
+		}
+	}
+}
+
+// sendWebhooks claims batches of due deliveries until none are left
+func sendWebhooks(ctx context.Context, db *sql.DB, client *http.Client) {
+	for ctx.Err() == nil {
+		dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		ds, err := dnews.ClaimWebhookDeliveriesContext(dctx, db, webhookBatch, webhookLease)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Error("webhooks: claiming deliveries")
+			return
+		}
+
+		for _, d := range ds {
+			deliverWebhook(ctx, db, client, d)
+		}
+		if len(ds) < webhookBatch {
+			return
+		}
+	}
+}
+
+// deliverWebhook makes one attempt at d and records how it went
+func deliverWebhook(ctx context.Context, db *sql.DB, client *http.Client, d *dnews.WebhookDelivery) {
+	l := logger.WithField("delivery_id", d.ID).WithField("webhook_id", d.WebhookID).WithField("event", d.Event)
+
+	status, err := postWebhook(ctx, client, d)
+	msg, retry, result := "", time.Time{}, "ok"
+	if err != nil {
+		msg = err.Error()
+		retry = dnews.WebhookRetry(d.Attempts, time.Now())
+		result = "retry"
+		if retry.IsZero() {
+			result = "failed"
+		}
+		l = l.WithError(err).WithField("attempts", d.Attempts)
+	}
+	webhookDeliveries.WithLabelValues(result).Inc()
+
+	dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	err = dnews.FinishWebhookDeliveryContext(dctx, db, d.ID, status, msg, retry)
+	cancel()
+	if err != nil {
+		l.WithError(err).Error("webhooks: recording delivery")
+		return
+	}
+
+	switch result {
+	case "ok":
+		l.Debug("webhook delivered")
+	case "retry":
+		l.WithField("retry", retry).Warn("webhook delivery failed")
+	default:
+		l.Error("webhook delivery given up")
+	}
+}
+
+// postWebhook sends the signed payload of d. Anything but a 2xx answer is
+// a failure.
+func postWebhook(ctx context.Context, client *http.Client, d *dnews.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "dnews-webhooks/"+version)
+	req.Header.Set("X-Dnews-Event", d.Event)
+	req.Header.Set("X-Dnews-Delivery", fmt.Sprint(d.ID))
+	req.Header.Set("X-Dnews-Signature", dnews.SignWebhook(d.Secret, time.Now(), d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func registerWebhookAdmin(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/webhook/add", guard(dnews.PermManageWebhooks, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		r.ParseForm()
+		wh := dnews.Webhook{
+			URL:    r.FormValue("url"),
+			Descr:  r.FormValue("descr"),
+			Events: r.Form["event"],
+			Active: true,
+		}
+		id, err := dnews.InsertWebhookContext(ctx, db, wh)
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("webhook_id", *id).WithField("url", wh.URL).Info("webhook added")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/webhook/{id:[0-9]+}/active", guard(dnews.PermManageWebhooks, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		active := r.FormValue("active") == "true"
+		if err := dnews.SetWebhookActiveContext(ctx, db, id, active); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("webhook_id", id).WithField("active", active).Info("webhook changed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/webhook/remove/{id:[0-9]+}", guard(dnews.PermManageWebhooks, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.DeleteWebhookContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("webhook_id", id).Info("webhook removed")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+
+	router.HandleFunc("/webhook/delivery/{id:[0-9]+}/retry", guard(dnews.PermManageWebhooks, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		id := pathID(r)
+		if err := dnews.RetryWebhookDeliveryContext(ctx, db, id); err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		reqLog(r).WithField("delivery_id", id).Info("webhook delivery queued again")
+		http.Redirect(w, r, "/admin", http.StatusFound)
+	})).Methods("POST")
+}
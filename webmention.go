@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var webmentions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "dnews",
+	Name:      "webmentions_total",
+	Help:      "Webmentions sent and received by result.",
+}, []string{"direction", "result"})
+
+func init() {
+	prometheus.MustRegister(webmentions)
+}
+
+// Pages fetched for Webmentions are read up to webmentionMaxBody
+const (
+	webmentionTimeout = 10 * time.Second
+	webmentionMaxBody = 1 << 20
+)
+
+// webmentionRequests limits how many mentions one address can send per
+// hour, every one makes the server fetch the source
+var webmentionRequests = newRateLimiter(60, time.Hour)
+
+// webmentionClient fetches sources, targets and endpoints. Pages move, so
+// a few redirects are followed, none of them to a private address.
+var webmentionClient = &http.Client{
+	Timeout:   webmentionTimeout,
+	Transport: publicTransport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return nil
+	},
+}
+
+// articlePathRE matches the path of article pages, the only targets that
+// are taken
+var articlePathRE = regexp.MustCompile(`^/article/([a-zA-Z0-9-]+)$`)
+
+// webmentionURL is where Webmentions are received
+func webmentionURL() string {
+	return siteURL("/webmention", nil)
+}
+
+// webmentionLink advertises the Webmention endpoint
+func webmentionLink(w http.ResponseWriter) {
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="webmention"`, webmentionURL()))
+}
+
+// targetSlug returns the slug of the article target links to, or "" when
+// it is not an article of the site
+func targetSlug(target string) string {
+	prefix := siteURL("", nil)
+	if !strings.HasPrefix(target, prefix) {
+		return ""
+	}
+	m := articlePathRE.FindStringSubmatch(strings.TrimPrefix(target, prefix))
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// fetchPage gets and parses the HTML page at link
+func fetchPage(link string) (*http.Response, *dnews.Page, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "dnews-webmention/"+version)
+
+	resp, err := webmentionClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, nil, fmt.Errorf("%s answered %s", link, resp.Status)
+	}
+
+	p, err := dnews.ParsePage(io.LimitReader(resp.Body, webmentionMaxBody), resp.Request.URL)
+	return resp, p, err
+}
+
+// verifyWebmention checks that source links to target and saves or
+// removes the mention accordingly
+func verifyWebmention(db *sql.DB, articleID int, source, target string) {
+	l := logger.WithField("source", source).WithField("target", target)
+	resp, p, ferr := fetchPage(source)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var err error
+	switch {
+	case ferr == nil && p.Mentions(target):
+		err = dnews.SaveWebmentionContext(ctx, db, articleID, source, target, p.Title)
+		webmentions.WithLabelValues("received", "verified").Inc()
+		l = l.WithField("title", p.Title)
+	case ferr != nil && resp == nil:
+		// The source could not be reached, a mention that was
+		// verified before is kept.
+		webmentions.WithLabelValues("received", "failed").Inc()
+		l.WithError(ferr).Info("webmention: fetching source failed")
+		return
+	default:
+		err = dnews.DeleteWebmentionContext(ctx, db, source, target)
+		webmentions.WithLabelValues("received", "invalid").Inc()
+		l = l.WithError(ferr)
+	}
+	if err != nil {
+		l.WithError(err).Error("webmention: saving mention")
+		return
+	}
+	l.Info("webmention: source checked")
+}
+
+// sendWebmentions tells every page a links to that it does. It returns
+// at once, the mentions are sent in the background.
+func sendWebmentions(a *dnews.Article) {
+	source := articleURL(a)
+	html := *a
+	html.HTML()
+
+	go func() {
+		base, _ := url.Parse(source)
+		p, err := dnews.ParsePage(strings.NewReader(string(html.Body)), base)
+		if err != nil {
+			logger.WithError(err).WithField("source", source).Error("webmention: reading article links")
+			return
+		}
+		for _, target := range p.OutboundLinks(base.Host) {
+			l := logger.WithField("source", source).WithField("target", target)
+			sent, err := sendWebmention(source, target)
+			switch {
+			case err != nil:
+				webmentions.WithLabelValues("sent", "failed").Inc()
+				l.WithError(err).Info("webmention: sending failed")
+			case !sent:
+				webmentions.WithLabelValues("sent", "none").Inc()
+				l.Debug("webmention: target takes no webmentions")
+			default:
+				webmentions.WithLabelValues("sent", "ok").Inc()
+				l.Info("webmention sent")
+			}
+		}
+	}()
+}
+
+// sendWebmention discovers the endpoint of target and tells it that source
+// links there. It reports false when target names no endpoint.
+func sendWebmention(source, target string) (bool, error) {
+	resp, p, err := fetchPage(target)
+	if err != nil {
+		return false, err
+	}
+	endpoint := dnews.LinkEndpoint(resp.Header, resp.Request.URL)
+	if endpoint == "" {
+		endpoint = p.Endpoint
+	}
+	if endpoint == "" {
+		return false, nil
+	}
+
+	resp, err = webmentionClient.PostForm(endpoint, url.Values{
+		"source": {source},
+		"target": {target},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("%s answered %s", endpoint, resp.Status)
+	}
+	return true, nil
+}
+
+// registerWebmention adds the endpoint, which answers 202 Accepted once a
+// mention looks right and checks the source afterwards, and the moderation
+// of mentions
+func registerWebmention(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/webmention", func(w http.ResponseWriter, r *http.Request) {
+		if !webmentionRequests.Allow(clientIP(r)) {
+			http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+		ctx, cancel := dbContext(r)
+		defer cancel()
+
+		source := r.FormValue("source")
+		target := r.FormValue("target")
+
+		u, err := url.Parse(source)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			http.Error(w, "source has to be an http:// or https:// URL", http.StatusBadRequest)
+			return
+		}
+		if source == target {
+			http.Error(w, "source and target have to differ", http.StatusBadRequest)
+			return
+		}
+		slug := targetSlug(target)
+		if slug == "" {
+			http.Error(w, "target has to be an article of this site", http.StatusBadRequest)
+			return
+		}
+		a, err := dnews.GetArticleContext(ctx, db, slug)
+		if dnews.KindOf(err) == dnews.NotFound || (err == nil && !a.Live) {
+			http.Error(w, "target has to be an article of this site", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			errorPage(w, r, err)
+			return
+		}
+
+		go verifyWebmention(db, a.ID, source, target)
+
+		reqLog(r).WithField("source", source).WithField("article_id", a.ID).Info("webmention received")
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST")
+
+	for action, status := range map[string]string{
+		"approve": dnews.MentionApproved,
+		"reject":  dnews.MentionRejected,
+	} {
+		status := status
+		router.HandleFunc("/mention/"+action+"/{id:[0-9]+}", guard(dnews.PermModerateMentions, func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := dbContext(r)
+			defer cancel()
+
+			id := pathID(r)
+			if err := dnews.SetWebmentionStatusContext(ctx, db, id, status); err != nil {
+				errorPage(w, r, err)
+				return
+			}
+
+			reqLog(r).WithField("mention_id", id).WithField("status", status).Info("webmention moderated")
+			http.Redirect(w, r, "/admin", http.StatusFound)
+		})).Methods("POST")
+	}
+}
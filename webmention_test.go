@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// mentionTable records what verifyWebmention does to the webmentions
+// table of f
+type mentionTable struct {
+	saved, deleted []driver.Value
+}
+
+func newMentionTable(f *fakeDB) *mentionTable {
+	m := &mentionTable{}
+	f.on("insert into webmentions", func(args []driver.Value) (fakeResult, error) {
+		m.saved = args
+		return fakeResult{affected: 1}, nil
+	})
+	f.on("delete from webmentions", func(args []driver.Value) (fakeResult, error) {
+		m.deleted = args
+		return fakeResult{affected: 1}, nil
+	})
+	return m
+}
+
+func TestVerifyWebmention(t *testing.T) {
+	defer allowLoopback()()
+	target := siteURL("/article/toaster", nil)
+
+	pages := http.NewServeMux()
+	pages.HandleFunc("/links", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<title>A reply</title><p>See <a href="%s#comments">this</a>.`, target)
+	})
+	pages.HandleFunc("/nolink", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<title>Nothing</title><a href="https://daemon.news/">home</a>`)
+	})
+	pages.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	pages.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/links", http.StatusMovedPermanently)
+	})
+	src := httptest.NewServer(pages)
+	defer src.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		source        string
+		keep, deleted bool
+	}{
+		{src.URL + "/links", true, false},
+		{src.URL + "/moved", true, false},
+		{src.URL + "/nolink", false, true},
+		{src.URL + "/gone", false, true},
+		// A source that cannot be reached keeps what was verified before.
+		{down.URL + "/links", false, false},
+	} {
+		f, db := newFakeDB(t)
+		m := newMentionTable(f)
+		verifyWebmention(db, 42, tc.source, target)
+		db.Close()
+
+		if got := m.saved != nil; got != tc.keep {
+			t.Errorf("%s: saved %v, want %v", tc.source, got, tc.keep)
+		}
+		if got := m.deleted != nil; got != tc.deleted {
+			t.Errorf("%s: deleted %v, want %v", tc.source, got, tc.deleted)
+		}
+		if m.saved != nil && (m.saved[0] != int64(42) || m.saved[1] != tc.source || m.saved[2] != target || m.saved[3] != "A reply") {
+			t.Errorf("%s: saved %v", tc.source, m.saved)
+		}
+	}
+}
+
+func TestVerifyWebmentionRefusesPrivateSources(t *testing.T) {
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the loopback source was fetched")
+	}))
+	defer src.Close()
+
+	f, db := newFakeDB(t)
+	defer db.Close()
+	m := newMentionTable(f)
+	verifyWebmention(db, 42, src.URL, siteURL("/article/toaster", nil))
+	if m.saved != nil || m.deleted != nil {
+		t.Error("an unreachable source changed the mentions")
+	}
+}
+
+func TestSendWebmention(t *testing.T) {
+	defer allowLoopback()()
+	received := make(chan url.Values, 1)
+
+	pages := http.NewServeMux()
+	pages.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `</hub>; rel="hub"`)
+		w.Header().Add("Link", `</wm?from=header>; rel="webmention"`)
+		fmt.Fprint(w, `<link rel="webmention" href="/wm?from=html">`)
+	})
+	pages.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<link rel="webmention" href="/wm?from=html">`)
+	})
+	pages.HandleFunc("/none", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<title>No mentions here</title>`)
+	})
+	pages.HandleFunc("/wm", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		r.PostForm.Set("from", r.URL.Query().Get("from"))
+		received <- r.PostForm
+		w.WriteHeader(http.StatusAccepted)
+	})
+	ts := httptest.NewServer(pages)
+	defer ts.Close()
+
+	source := siteURL("/article/toaster", nil)
+	for _, tc := range []struct {
+		path, from string
+	}{
+		{"/header", "header"},
+		{"/html", "html"},
+		{"/none", ""},
+	} {
+		target := ts.URL + tc.path
+		sent, err := sendWebmention(source, target)
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if sent != (tc.from != "") {
+			t.Errorf("%s: sent is %v", tc.path, sent)
+		}
+		if !sent {
+			continue
+		}
+		got := <-received
+		if got.Get("source") != source || got.Get("target") != target || got.Get("from") != tc.from {
+			t.Errorf("%s: endpoint got %v", tc.path, got)
+		}
+	}
+}
+
+func TestWebmentionEndpoint(t *testing.T) {
+	f, db := newFakeDB(t)
+	defer db.Close()
+	now := time.Now()
+	f.on("where articles.slug = $1", func(args []driver.Value) (fakeResult, error) {
+		live := args[0] == "toaster"
+		if args[0] != "toaster" && args[0] != "draft" {
+			return fakeResult{}, nil
+		}
+		return fakeResult{rows: [][]driver.Value{{int64(1), args[0], now, live, "Toasters", "title: Toasters", "", int64(1),
+			"beastie@example.org", "Beastie", "Daemon", "beastie", ""}}}, nil
+	})
+	f.rows("from article_tags")
+	router := mux.NewRouter()
+	registerWebmention(router, db)
+
+	// Nothing listens there, so the check started in the background
+	// fails without touching the database.
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, tc := range []struct {
+		source, target string
+		status         int
+	}{
+		{down.URL + "/post", siteURL("/article/toaster", nil), http.StatusAccepted},
+		{"javascript:alert(1)", siteURL("/article/toaster", nil), http.StatusBadRequest},
+		{"/relative", siteURL("/article/toaster", nil), http.StatusBadRequest},
+		{siteURL("/article/toaster", nil), siteURL("/article/toaster", nil), http.StatusBadRequest},
+		{down.URL + "/post", "https://example.org/article/toaster", http.StatusBadRequest},
+		{down.URL + "/post", siteURL("/tag/openbsd", nil), http.StatusBadRequest},
+		{down.URL + "/post", siteURL("/article/nothing", nil), http.StatusBadRequest},
+		{down.URL + "/post", siteURL("/article/draft", nil), http.StatusBadRequest},
+	} {
+		form := url.Values{"source": {tc.source}, "target": {tc.target}}
+		r := httptest.NewRequest("POST", "/webmention", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s -> %s: got %d, want %d: %s", tc.source, tc.target, w.Code, tc.status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var webSubPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "dnews",
+	Name:      "websub_pushes_total",
+	Help:      "Feed updates pushed to WebSub subscribers by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(webSubPushes)
+}
+
+// feedTypes are the feeds the hub takes subscriptions for
+var feedTypes = []string{"atom", "rss"}
+
+// feedContentTypes are sent with the content pushed to subscribers
+var feedContentTypes = map[string]string{
+	"atom": "application/atom+xml",
+	"rss":  "application/rss+xml",
+}
+
+// webSubTries is how often a push is tried before it is given up. They are
+// webSubRetry apart.
+const (
+	webSubTries   = 3
+	webSubRetry   = 30 * time.Second
+	webSubTimeout = 10 * time.Second
+)
+
+// webSubRequests limits how many (un)subscriptions one address can ask for
+// per hour, every one makes the hub call the callback
+var webSubRequests = newRateLimiter(30, time.Hour)
+
+// webSubClient verifies and pushes to subscribers. Redirects are not
+// followed, a callback is used as given, and only if it is on a public
+// address.
+var webSubClient = &http.Client{
+	Timeout:   webSubTimeout,
+	Transport: publicTransport,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// hubURL is where the hub takes subscriptions
+func hubURL() string {
+	return siteURL("/websub", nil)
+}
+
+// feedTopic is the WebSub topic of the feed of the given type
+func feedTopic(feedType string) string {
+	return siteURL("/feed/"+feedType, nil)
+}
+
+// topicFeedType returns the feed type of topic, or "" for anything the hub
+// does not serve
+func topicFeedType(topic string) string {
+	for _, t := range feedTypes {
+		if topic == feedTopic(t) {
+			return t
+		}
+	}
+	return ""
+}
+
+// webSubLinks advertises the hub and the topic of a feed
+func webSubLinks(w http.ResponseWriter, topic string) {
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hubURL()))
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="self"`, topic))
+}
+
+// verifyWebSub asks the subscriber whether they really want mode and saves
+// or ends the subscription if so
+func verifyWebSub(db *sql.DB, mode string, sub *dnews.WebSubSubscription, lease time.Duration) {
+	l := logger.WithField("callback", sub.Callback).WithField("topic", sub.Topic).WithField("mode", mode)
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		l.WithError(err).Error("websub: making challenge")
+		return
+	}
+	challenge := hex.EncodeToString(b)
+
+	u, err := url.Parse(sub.Callback)
+	if err != nil {
+		l.WithError(err).Warn("websub: bad callback")
+		return
+	}
+	q := u.Query()
+	q.Set("hub.mode", mode)
+	q.Set("hub.topic", sub.Topic)
+	q.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		q.Set("hub.lease_seconds", fmt.Sprint(int(lease.Seconds())))
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := webSubClient.Get(u.String())
+	if err != nil {
+		l.WithError(err).Info("websub: verification failed")
+		return
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || strings.TrimSpace(string(body)) != challenge {
+		l.WithField("status", resp.StatusCode).Info("websub: subscriber did not confirm")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+	if mode == "subscribe" {
+		sub.Expires = time.Now().Add(lease)
+		err = dnews.SaveWebSubSubscriptionContext(ctx, db, sub)
+	} else {
+		err = dnews.DeleteWebSubSubscriptionContext(ctx, db, sub.Topic, sub.Callback)
+	}
+	if err != nil {
+		l.WithError(err).Error("websub: saving subscription")
+		return
+	}
+	l.WithField("lease", lease).Info("websub: subscription verified")
+}
+
+// pushFeeds sends the current article feeds to their subscribers. It
+// returns at once, the pushes happen in the background.
+func pushFeeds(db *sql.DB) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+		defer cancel()
+
+		for _, t := range feedTypes {
+			topic := feedTopic(t)
+			subs, err := dnews.GetWebSubSubscriptionsContext(ctx, db, topic)
+			if err != nil {
+				logger.WithError(err).Error("websub: listing subscriptions")
+				return
+			}
+			if len(subs) == 0 {
+				continue
+			}
+
+			feed, err := articleFeed(ctx, db)
+			if err != nil {
+				logger.WithError(err).Error("websub: building feed")
+				return
+			}
+			out, err := renderFeed(feed, t)
+			if err != nil {
+				logger.WithError(err).Error("websub: rendering feed")
+				return
+			}
+
+			for _, sub := range subs {
+				go pushFeed(db, sub, t, []byte(out))
+			}
+		}
+	}()
+}
+
+// pushFeed sends body to one subscriber, trying again webSubTries times.
+// A subscriber answering 410 Gone is dropped.
+func pushFeed(db *sql.DB, sub *dnews.WebSubSubscription, feedType string, body []byte) {
+	l := logger.WithField("callback", sub.Callback).WithField("topic", sub.Topic)
+
+	for try := 1; try <= webSubTries; try++ {
+		req, err := http.NewRequest("POST", sub.Callback, bytes.NewReader(body))
+		if err != nil {
+			l.WithError(err).Warn("websub: bad callback")
+			return
+		}
+		req.Header.Set("Content-Type", feedContentTypes[feedType])
+		req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="hub"`, hubURL()))
+		req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, sub.Topic))
+		if sub.Secret != "" {
+			req.Header.Set("X-Hub-Signature", dnews.SignWebSub(sub.Secret, body))
+		}
+
+		resp, err := webSubClient.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+				webSubPushes.WithLabelValues("ok").Inc()
+				return
+			case resp.StatusCode == http.StatusGone:
+				webSubPushes.WithLabelValues("gone").Inc()
+				ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+				err = dnews.DeleteWebSubSubscriptionContext(ctx, db, sub.Topic, sub.Callback)
+				cancel()
+				if err != nil {
+					l.WithError(err).Error("websub: removing subscription")
+				}
+				l.Info("websub: subscriber is gone")
+				return
+			}
+			err = fmt.Errorf("answered %s", resp.Status)
+		}
+
+		l = l.WithError(err).WithField("try", try)
+		if try < webSubTries {
+			webSubPushes.WithLabelValues("retry").Inc()
+			time.Sleep(webSubRetry)
+		}
+	}
+	webSubPushes.WithLabelValues("failed").Inc()
+	l.Warn("websub: push given up")
+}
+
+// runWebSubPrune removes expired subscriptions every interval until ctx is
+// done
+func runWebSubPrune(ctx context.Context, db *sql.DB, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		dctx, cancel := context.WithTimeout(ctx, dbTimeout)
+		n, err := dnews.PruneWebSubSubscriptionsContext(dctx, db)
+		cancel()
+		if err != nil {
+			logger.WithError(err).Error("pruning websub subscriptions")
+		} else if n > 0 {
+			logger.WithField("subscriptions", n).Debug("pruned expired websub subscriptions")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// registerWebSub adds the hub. Requests are answered with 202 Accepted once
+// they look right, the subscriber is asked to confirm afterwards.
+func registerWebSub(router *mux.Router, db *sql.DB) {
+	router.HandleFunc("/websub", func(w http.ResponseWriter, r *http.Request) {
+		if !webSubRequests.Allow(clientIP(r)) {
+			http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		mode := r.FormValue("hub.mode")
+		topic := r.FormValue("hub.topic")
+		callback := r.FormValue("hub.callback")
+		secret := r.FormValue("hub.secret")
+
+		if mode != "subscribe" && mode != "unsubscribe" {
+			http.Error(w, "hub.mode has to be subscribe or unsubscribe", http.StatusBadRequest)
+			return
+		}
+		if topicFeedType(topic) == "" {
+			http.Error(w, fmt.Sprintf("Unknown hub.topic, this hub serves %s", strings.Join([]string{feedTopic("atom"), feedTopic("rss")}, " and ")), http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(callback)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			http.Error(w, "hub.callback has to be an http:// or https:// URL", http.StatusBadRequest)
+			return
+		}
+		if len(secret) >= 200 {
+			http.Error(w, "hub.secret has to be shorter than 200 bytes", http.StatusBadRequest)
+			return
+		}
+		seconds := 0
+		if v := r.FormValue("hub.lease_seconds"); v != "" {
+			seconds, err = strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "hub.lease_seconds has to be a number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		sub := &dnews.WebSubSubscription{Topic: topic, Callback: callback, Secret: secret}
+		go verifyWebSub(db, mode, sub, dnews.WebSubLeaseFor(seconds))
+
+		reqLog(r).WithField("callback", callback).WithField("mode", mode).Info("websub request")
+		w.WriteHeader(http.StatusAccepted)
+	}).Methods("POST")
+}
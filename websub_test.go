@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaemonNews/dnews/src"
+	"github.com/gorilla/mux"
+)
+
+// subscriber is an httptest WebSub subscriber. answer decides the reply to
+// verification requests, pushes are answered with status.
+type subscriber struct {
+	*httptest.Server
+	verifications chan url.Values
+	pushes        chan *http.Request
+	bodies        chan []byte
+}
+
+func newSubscriber(answer func(q url.Values) (int, string), status int) *subscriber {
+	s := &subscriber{
+		verifications: make(chan url.Values, 1),
+		pushes:        make(chan *http.Request, 1),
+		bodies:        make(chan []byte, 1),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			code, body := answer(r.URL.Query())
+			w.WriteHeader(code)
+			w.Write([]byte(body))
+			s.verifications <- r.URL.Query()
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+		s.pushes <- r
+		s.bodies <- b
+	}))
+	return s
+}
+
+// echo confirms every verification
+func echo(q url.Values) (int, string) {
+	return http.StatusOK, q.Get("hub.challenge")
+}
+
+func TestVerifyWebSubSubscribe(t *testing.T) {
+	defer allowLoopback()()
+	f, db := newFakeDB(t)
+	defer db.Close()
+	var saved []driver.Value
+	f.on("insert into websub_subscriptions", func(args []driver.Value) (fakeResult, error) {
+		saved = args
+		return fakeResult{affected: 1}, nil
+	})
+
+	s := newSubscriber(echo, http.StatusOK)
+	defer s.Close()
+
+	lease := dnews.WebSubLeaseFor(7200)
+	sub := &dnews.WebSubSubscription{Topic: feedTopic("atom"), Callback: s.URL + "/cb?id=1", Secret: "s3cret"}
+	verifyWebSub(db, "subscribe", sub, lease)
+
+	q := <-s.verifications
+	if q.Get("hub.mode") != "subscribe" || q.Get("hub.topic") != feedTopic("atom") || q.Get("hub.lease_seconds") != "7200" {
+		t.Errorf("verification asked %v", q)
+	}
+	if q.Get("id") != "1" {
+		t.Error("the query of the callback was dropped")
+	}
+	if saved == nil {
+		t.Fatal("the confirmed subscription was not saved")
+	}
+	if saved[0] != sub.Topic || saved[1] != sub.Callback || saved[2] != "s3cret" {
+		t.Errorf("saved %v", saved)
+	}
+	if d := time.Until(saved[3].(time.Time)); d > lease || d < lease-time.Minute {
+		t.Errorf("subscription expires in %v, want %v", d, lease)
+	}
+}
+
+func TestVerifyWebSubRefused(t *testing.T) {
+	defer allowLoopback()()
+	_, db := newFakeDB(t)
+	defer db.Close()
+
+	for name, answer := range map[string]func(url.Values) (int, string){
+		"wrong challenge": func(url.Values) (int, string) { return http.StatusOK, "nope" },
+		"not found":       func(q url.Values) (int, string) { return http.StatusNotFound, q.Get("hub.challenge") },
+	} {
+		s := newSubscriber(answer, http.StatusOK)
+		// The fake database fails the test on any query.
+		verifyWebSub(db, "subscribe", &dnews.WebSubSubscription{Topic: feedTopic("rss"), Callback: s.URL}, dnews.WebSubLease)
+		<-s.verifications
+		s.Close()
+		if t.Failed() {
+			t.Fatalf("%s: the subscription was saved", name)
+		}
+	}
+}
+
+func TestVerifyWebSubUnsubscribe(t *testing.T) {
+	defer allowLoopback()()
+	f, db := newFakeDB(t)
+	defer db.Close()
+	f.rows("delete from websub_subscriptions")
+
+	s := newSubscriber(echo, http.StatusOK)
+	defer s.Close()
+	verifyWebSub(db, "unsubscribe", &dnews.WebSubSubscription{Topic: feedTopic("rss"), Callback: s.URL}, 0)
+
+	if q := <-s.verifications; q.Get("hub.lease_seconds") != "" {
+		t.Errorf("unsubscribing sent a lease: %v", q)
+	}
+	if !f.ran("delete from websub_subscriptions") {
+		t.Error("the subscription was not removed")
+	}
+}
+
+func TestWebSubHub(t *testing.T) {
+	defer allowLoopback()()
+	_, db := newFakeDB(t)
+	defer db.Close()
+	router := mux.NewRouter()
+	registerWebSub(router, db)
+
+	s := newSubscriber(func(url.Values) (int, string) { return http.StatusNotFound, "" }, http.StatusOK)
+	defer s.Close()
+
+	post := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/websub", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+	form := func(mode, topic, callback, lease string) url.Values {
+		return url.Values{"hub.mode": {mode}, "hub.topic": {topic}, "hub.callback": {callback}, "hub.lease_seconds": {lease}}
+	}
+
+	for _, tc := range []struct {
+		form   url.Values
+		status int
+	}{
+		{form("follow", feedTopic("atom"), s.URL, ""), http.StatusBadRequest},
+		{form("subscribe", "https://example.org/feed", s.URL, ""), http.StatusBadRequest},
+		{form("subscribe", feedTopic("atom"), "ftp://example.org/", ""), http.StatusBadRequest},
+		{form("subscribe", feedTopic("atom"), s.URL, "soon"), http.StatusBadRequest},
+	} {
+		if got := post(tc.form); got != tc.status {
+			t.Errorf("%v: got %d, want %d", tc.form, got, tc.status)
+		}
+	}
+
+	// Leases are kept within WebSubMinLease and WebSubMaxLease.
+	for requested, granted := range map[string]time.Duration{
+		"60":       dnews.WebSubMinLease,
+		"":         dnews.WebSubLease,
+		"86400":    24 * time.Hour,
+		"99999999": dnews.WebSubMaxLease,
+	} {
+		if got := post(form("subscribe", feedTopic("atom"), s.URL, requested)); got != http.StatusAccepted {
+			t.Fatalf("got %d, want 202", got)
+		}
+		q := <-s.verifications
+		if want := strconv.Itoa(int(granted.Seconds())); q.Get("hub.lease_seconds") != want {
+			t.Errorf("asked for %q, verification offered %s, want %s", requested, q.Get("hub.lease_seconds"), want)
+		}
+	}
+}
+
+func TestPushFeed(t *testing.T) {
+	defer allowLoopback()()
+	f, db := newFakeDB(t)
+	defer db.Close()
+	f.on("delete from websub_subscriptions", func(args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 1}, nil
+	})
+	body := []byte(`<feed xmlns="http://www.w3.org/2005/Atom"></feed>`)
+
+	s := newSubscriber(echo, http.StatusOK)
+	sub := &dnews.WebSubSubscription{Topic: feedTopic("atom"), Callback: s.URL, Secret: "s3cret"}
+	pushFeed(db, sub, "atom", body)
+	r, got := <-s.pushes, <-s.bodies
+	s.Close()
+
+	if string(got) != string(body) {
+		t.Errorf("pushed %q", got)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/atom+xml" {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	m := hmac.New(sha256.New, []byte("s3cret"))
+	m.Write(body)
+	if sig := r.Header.Get("X-Hub-Signature"); sig != "sha256="+hex.EncodeToString(m.Sum(nil)) {
+		t.Errorf("X-Hub-Signature is %q", sig)
+	}
+	links := strings.Join(r.Header["Link"], ", ")
+	if !strings.Contains(links, `<`+hubURL()+`>; rel="hub"`) || !strings.Contains(links, `<`+sub.Topic+`>; rel="self"`) {
+		t.Errorf("Link is %q", links)
+	}
+	if f.ran("delete from websub_subscriptions") {
+		t.Error("a subscriber that took the push was removed")
+	}
+
+	// Without a secret nothing is signed, and 410 Gone ends the
+	// subscription.
+	s = newSubscriber(echo, http.StatusGone)
+	defer s.Close()
+	pushFeed(db, &dnews.WebSubSubscription{Topic: feedTopic("atom"), Callback: s.URL}, "atom", body)
+	if r := <-s.pushes; r.Header.Get("X-Hub-Signature") != "" {
+		t.Error("an unsigned subscription got a signature")
+	}
+	<-s.bodies
+	if !f.ran("delete from websub_subscriptions") {
+		t.Error("a gone subscriber was kept")
+	}
+}